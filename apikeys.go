@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dyluth/npc2/middleware"
+)
+
+// manageAPIKeys runs an "apikey" subcommand on the key store in API_KEYS_FILE, returning the
+// exit status.
+func manageAPIKeys(args []string) int {
+	path := os.Getenv("API_KEYS_FILE")
+	if path == "" || len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: API_KEYS_FILE=keys.json npc2 apikey create|rotate|disable|enable|list [flags] [name]")
+		return 2
+	}
+	store, err := middleware.OpenAPIKeyStore(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open API keys: %v\n", err)
+		return 1
+	}
+
+	flags := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	owner := flags.String("owner", "", "who the key belongs to")
+	scopes := flags.String("scopes", "", "comma-separated actions or globs the key may run; all if empty")
+	expires := flags.Duration("expires", 0, "how long the key is valid for; forever if zero")
+	overlap := flags.Duration("overlap", 24*time.Hour, "how long the old key keeps working after a rotation")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	name := flags.Arg(0)
+
+	var secret string
+	switch args[0] {
+	case "create":
+		var expiry time.Time
+		if *expires > 0 {
+			expiry = time.Now().Add(*expires)
+		}
+		secret, err = store.Create(name, *owner, splitList(*scopes), expiry)
+	case "rotate":
+		secret, err = store.Rotate(name, *overlap)
+	case "disable", "enable":
+		err = store.SetDisabled(name, args[0] == "disable")
+	case "list":
+		for _, key := range store.Keys() {
+			status := "active"
+			if !key.Active(time.Now()) {
+				status = "inactive"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\tcreated %s\texpires %s\t%s\n", key.Name, key.ID, key.Owner,
+				strings.Join(key.Scopes, ","), key.Created.Format(time.RFC3339), formatExpiry(key.Expires), status)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown apikey command %s\n", args[0])
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to %s API key: %v\n", args[0], err)
+		return 1
+	}
+	if secret != "" {
+		fmt.Println(secret)
+	}
+	return 0
+}
+
+// formatExpiry formats a key's expiry time.
+func formatExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return "never"
+	}
+	return expires.Format(time.RFC3339)
+}
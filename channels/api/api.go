@@ -3,9 +3,13 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/dyluth/npc2/npc"
@@ -13,9 +17,13 @@ import (
 
 // APIChannel is a communication channel for a REST API.
 type APIChannel struct {
+	// Parser is used to derive the action and arguments from the "message" field
+	// of requests that do not name an action.
+	Parser npc.CommandParser
+
 	port           string
 	server         *http.Server
-	requestHandler func(request npc.Request) npc.Response
+	requestHandler npc.RequestHandler
 }
 
 // NewAPIChannel creates a new APIChannel instance.
@@ -27,12 +35,9 @@ func NewAPIChannel(port string) *APIChannel {
 
 // Start starts the API communication channel.
 func (ac *APIChannel) Start() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/request", ac.handleRequest)
-
 	ac.server = &http.Server{
 		Addr:    ac.port,
-		Handler: mux,
+		Handler: ac.routes(),
 	}
 
 	go func() {
@@ -43,6 +48,22 @@ func (ac *APIChannel) Start() {
 	fmt.Printf("API server listening on port %s\n", ac.port)
 }
 
+// routes returns the handler serving the channel's endpoints.
+func (ac *APIChannel) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/request", ac.handleRequest)
+	mux.HandleFunc("GET /api/actions", ac.handleActions)
+	mux.HandleFunc("GET /api/actions/{name}", ac.handleActions)
+	mux.HandleFunc("GET /api/jobs", ac.handleJobs)
+	mux.HandleFunc("GET /api/jobs/{id}", ac.handleJobs)
+	return mux
+}
+
+// Name returns "API", the Source of the channel's requests.
+func (ac *APIChannel) Name() string {
+	return "API"
+}
+
 // Stop stops the API communication channel.
 func (ac *APIChannel) Stop() {
 	if err := ac.server.Shutdown(context.Background()); err != nil {
@@ -51,13 +72,20 @@ func (ac *APIChannel) Stop() {
 	fmt.Println("API server stopped.")
 }
 
-// SendMessage is not applicable for the API channel in this context.
-func (ac *APIChannel) SendMessage(channelID string, message string) {
-	log.Println("SendMessage is not implemented for the API channel")
-}
+// SendMessage does nothing, as the API cannot push messages to its clients. Instead they poll
+// /api/jobs/{id} for the progress and result of their jobs.
+func (ac *APIChannel) SendMessage(channelID string, message string) {}
 
 // RegisterRequestHandler registers a handler for incoming requests.
 func (ac *APIChannel) RegisterRequestHandler(handler func(request npc.Request) npc.Response) {
+	ac.RegisterContextHandler(func(ctx context.Context, request npc.Request) npc.Response {
+		return handler(request)
+	})
+}
+
+// RegisterContextHandler registers a context-aware handler for incoming requests.
+// The context is cancelled when the HTTP client disconnects.
+func (ac *APIChannel) RegisterContextHandler(handler npc.RequestHandler) {
 	ac.requestHandler = handler
 }
 
@@ -81,6 +109,7 @@ func (ac *APIChannel) handleRequest(w http.ResponseWriter, r *http.Request) {
 	actionName, _ := requestData["action"].(string)
 	user := ""
 	channelID := ""
+	threadID := ""
 
 	// Extract args
 	args := make(map[string]string)
@@ -92,13 +121,16 @@ func (ac *APIChannel) handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// If the API request includes user/channel_id, extract them
+	// If the API request includes user/channel_id/thread_id, extract them
 	if u, ok := requestData["user"].(string); ok {
 		user = u
 	}
 	if c, ok := requestData["channel_id"].(string); ok {
 		channelID = c
 	}
+	if t, ok := requestData["thread_id"].(string); ok {
+		threadID = t
+	}
 
 	// Extract text representation of the payload
 	textPayload := ""
@@ -108,48 +140,211 @@ func (ac *APIChannel) handleRequest(w http.ResponseWriter, r *http.Request) {
 		textPayload = action // Use action as text if no message field
 	}
 
-	// Extract authentication information
-	authMethod := "apikey"
-	authToken := r.Header.Get("Authorization")
-	if strings.HasPrefix(authToken, "Bearer ") {
-		authToken = strings.TrimPrefix(authToken, "Bearer ")
+	// Without an explicit action, parse the message as a command. Explicit args take precedence.
+	if actionName == "" && textPayload != "" {
+		command, err := ac.Parser.Parse(textPayload)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(statusForError(err))
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		if command != nil {
+			actionName = command.Action
+			for k, v := range command.Args {
+				if _, ok := args[k]; !ok {
+					args[k] = v
+				}
+			}
+			args[npc.CommandTextArg] = command.Text
+		}
+	}
+
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		args[npc.IdempotencyArg] = key
 	}
 
 	// Construct npc.Request
 	npcRequest := npc.Request{
-		Action:    actionName,
-		User:      user,
-		ChannelID: channelID,
-		Text:      textPayload,
-		Source:    "API",
-		AuthMethod: authMethod,
-		AuthToken: authToken,
-		Args:      args,
-		RawData:   requestData,
+		Action:     actionName,
+		User:       user,
+		ChannelID:  channelID,
+		ThreadID:   threadID,
+		Text:       textPayload,
+		Source:     "API",
+		AuthMethod: "apikey",
+		AuthToken:  authToken(r),
+		Args:       args,
+		RawData:    requestData,
 	}
 
-	if ac.requestHandler != nil {
-		response := ac.requestHandler(npcRequest)
+	ac.dispatch(w, r, npcRequest)
+}
 
-		if response.Error != nil {
-			w.Header().Set("Content-Type", "application/json")
-			if response.Error.Error() == "unauthorized" {
-				w.WriteHeader(http.StatusUnauthorized)
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-			json.NewEncoder(w).Encode(map[string]string{"error": response.Error.Error()})
-			return
-		}
+// handleActions serves the catalogue of actions the caller may run, or the details of one
+// action, by running the help action on the caller's behalf.
+func (ac *APIChannel) handleActions(w http.ResponseWriter, r *http.Request) {
+	args := make(map[string]string)
+	if name := r.PathValue("name"); name != "" {
+		args["action"] = name
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		log.Printf("API response type before encoding: %T, value: %v", response.Data, response.Data)
-		if err := json.NewEncoder(w).Encode(response.Data); err != nil {
-			log.Printf("Failed to encode response: %v", err)
-		}
-	} else {
+	npcRequest := npc.Request{
+		Action:     npc.HelpAction,
+		User:       r.URL.Query().Get("user"),
+		Text:       r.URL.Path,
+		Source:     "API",
+		AuthMethod: "apikey",
+		AuthToken:  authToken(r),
+		Args:       args,
+	}
+
+	ac.dispatch(w, r, npcRequest)
+}
+
+// handleJobs serves the caller's asynchronous jobs, or the status of one job, by running the
+// built-in jobs action on the caller's behalf. API clients poll it for the progress and result
+// of their jobs, as the API cannot report them as they happen.
+func (ac *APIChannel) handleJobs(w http.ResponseWriter, r *http.Request) {
+	args := make(map[string]string)
+	if id := r.PathValue("id"); id != "" {
+		args["id"] = id
+	}
+
+	npcRequest := npc.Request{
+		Action:     npc.JobsAction,
+		User:       r.URL.Query().Get("user"),
+		Text:       r.URL.Path,
+		Source:     "API",
+		AuthMethod: "apikey",
+		AuthToken:  authToken(r),
+		Args:       args,
+	}
+
+	ac.dispatch(w, r, npcRequest)
+}
+
+// dispatch passes a request to the registered handler and writes the response as JSON.
+// Clients that accept server-sent events or newline-delimited JSON instead receive each message
+// the handler writes as it is written, followed by the final response.
+func (ac *APIChannel) dispatch(w http.ResponseWriter, r *http.Request, npcRequest npc.Request) {
+	if ac.requestHandler == nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "No request handler registered"})
+		return
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		npcRequest.Args[npc.RemoteAddrArg] = host
+	} else {
+		delete(npcRequest.Args, npc.RemoteAddrArg)
+	}
+	// Responses go back to the waiting client; the address is for job reports and other notices
+	if npcRequest.ReplyTo.Adapter == "" {
+		npcRequest.ReplyTo = npc.Address{Adapter: ac.Name(), ChannelID: npcRequest.ChannelID, ThreadID: npcRequest.ThreadID, User: npcRequest.User}
+	}
+
+	if format := streamFormat(r); format != "" {
+		stream := newStreamWriter(w, format)
+		stream.finish(ac.requestHandler(npc.WithResponseWriter(r.Context(), stream), npcRequest))
+		return
+	}
+
+	response := ac.requestHandler(r.Context(), npcRequest)
+
+	if response.Error != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if seconds := retryAfter(response.Error); seconds > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		}
+		w.WriteHeader(statusForError(response.Error))
+		json.NewEncoder(w).Encode(errorBody(response.Error))
+		return
+	}
+
+	body := responseBody(response)
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Code >= 200 && response.Code < 300 {
+		w.WriteHeader(response.Code)
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// richResponse is the JSON form of a response with blocks.
+type richResponse struct {
+	Text   string      `json:"text,omitempty"`
+	Blocks []npc.Block `json:"blocks"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// responseBody returns the JSON body for a successful response. Plain responses are written as a
+// JSON string and structured payloads as they are. Responses with blocks are written as an object
+// holding the summary text, the blocks and any payload.
+func responseBody(response npc.Response) interface{} {
+	switch {
+	case len(response.Blocks) > 0:
+		return richResponse{Text: response.Data, Blocks: response.Blocks, Data: response.Payload}
+	case response.Payload != nil:
+		return response.Payload
+	default:
+		return response.Data
+	}
+}
+
+// errorResponse is the JSON form of a failed response.
+type errorResponse struct {
+	Error       string   `json:"error"`
+	Suggestions []string `json:"suggestions,omitempty"` // Close matches for an unknown action
+	RetryAfter  int      `json:"retry_after,omitempty"` // Seconds to wait before retrying a rate limited request
+}
+
+// errorBody returns the JSON body for a failed response.
+func errorBody(err error) errorResponse {
+	body := errorResponse{Error: err.Error()}
+	var notFound *npc.NotFoundError
+	if errors.As(err, &notFound) {
+		body.Suggestions = notFound.Suggestions
+	}
+	body.RetryAfter = retryAfter(err)
+	return body
+}
+
+// retryAfter returns the whole number of seconds a rate limited request should wait before it
+// is retried, or zero if err does not say.
+func retryAfter(err error) int {
+	var limited *npc.RateLimitError
+	if !errors.As(err, &limited) || limited.RetryAfter <= 0 {
+		return 0
+	}
+	return int(math.Ceil(limited.RetryAfter.Seconds()))
+}
+
+// authToken extracts the bearer token from the Authorization header.
+func authToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// statusForError maps an npc error to the HTTP status code reported to the client.
+func statusForError(err error) int {
+	switch npc.KindOf(err) {
+	case npc.ErrUnauthorized:
+		return http.StatusUnauthorized
+	case npc.ErrForbidden:
+		return http.StatusForbidden
+	case npc.ErrNotFound:
+		return http.StatusNotFound
+	case npc.ErrInvalidArguments:
+		return http.StatusBadRequest
+	case npc.ErrRateLimited:
+		return http.StatusTooManyRequests
+	case npc.ErrTimeout:
+		return http.StatusGatewayTimeout
+	case npc.ErrUnavailable, npc.ErrBusy:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
 	}
 }
@@ -2,11 +2,14 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dyluth/npc2/npc"
 )
@@ -77,3 +80,271 @@ func TestAPIChannel(t *testing.T) {
 			actual, expected)
 	}
 }
+
+// TestStatusForError tests the mapping from npc errors to HTTP status codes.
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{npc.ErrUnauthorized, http.StatusUnauthorized},
+		{npc.ErrForbidden, http.StatusForbidden},
+		{npc.Errorf(npc.ErrNotFound, "action x not found"), http.StatusNotFound},
+		{npc.ErrInvalidArguments, http.StatusBadRequest},
+		{npc.ErrRateLimited, http.StatusTooManyRequests},
+		{npc.ErrTimeout, http.StatusGatewayTimeout},
+		{npc.ErrUnavailable, http.StatusServiceUnavailable},
+		{npc.ErrBusy, http.StatusServiceUnavailable},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if got := statusForError(test.err); got != test.want {
+			t.Errorf("statusForError(%v) = %d, expected %d", test.err, got, test.want)
+		}
+	}
+}
+
+// TestAPIChannelSuggestions tests that close matches for an unknown action are returned.
+func TestAPIChannelSuggestions(t *testing.T) {
+	core := npc.NewNpc()
+	core.RegisterAction(npc.Action{Name: "deploy", Handler: func(request npc.Request) npc.Response { return npc.Response{} }})
+	apiChannel := NewAPIChannel(":8082")
+	apiChannel.RegisterContextHandler(core.ProcessRequestContext)
+
+	req := httptest.NewRequest("POST", "/api/request", strings.NewReader(`{"action": "deplyo"}`))
+	rr := httptest.NewRecorder()
+	apiChannel.handleRequest(rr, req)
+
+	var body errorResponse
+	json.NewDecoder(rr.Body).Decode(&body)
+	if rr.Code != http.StatusNotFound || len(body.Suggestions) != 1 || body.Suggestions[0] != "deploy" {
+		t.Errorf("Expected a suggestion of deploy, got %d %+v", rr.Code, body)
+	}
+}
+
+// TestAPIChannelRetryAfter tests that rate limited requests are told when to retry.
+func TestAPIChannelRetryAfter(t *testing.T) {
+	apiChannel := NewAPIChannel(":8082")
+	apiChannel.RegisterRequestHandler(func(request npc.Request) npc.Response {
+		return npc.Response{Error: &npc.RateLimitError{RetryAfter: 1500 * time.Millisecond, Limit: 10, Window: time.Minute}}
+	})
+
+	req := httptest.NewRequest("POST", "/api/request", strings.NewReader(`{"action": "deploy"}`))
+	rr := httptest.NewRecorder()
+	apiChannel.handleRequest(rr, req)
+
+	var body errorResponse
+	json.NewDecoder(rr.Body).Decode(&body)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "2" || body.RetryAfter != 2 {
+		t.Errorf("Expected 429 with a retry after 2 seconds, got %d %q %+v", rr.Code, rr.Header().Get("Retry-After"), body)
+	}
+}
+
+// TestAPIChannelParsesMessage tests that a message without an action is parsed as a command.
+func TestAPIChannelParsesMessage(t *testing.T) {
+	apiChannel := NewAPIChannel(":8082")
+
+	var handled npc.Request
+	apiChannel.RegisterRequestHandler(func(request npc.Request) npc.Response {
+		handled = request
+		return npc.Response{Data: "ok"}
+	})
+
+	requestBody, _ := json.Marshal(map[string]interface{}{
+		"message": "deploy api env=prod --force",
+		"args":    map[string]string{"env": "staging", npc.RemoteAddrArg: "10.9.9.9"},
+	})
+	req := httptest.NewRequest("POST", "/api/request", bytes.NewBuffer(requestBody))
+	req.RemoteAddr = "192.0.2.7:41234"
+	rr := httptest.NewRecorder()
+	apiChannel.handleRequest(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if handled.Action != "deploy" {
+		t.Errorf("Expected action 'deploy', got %s", handled.Action)
+	}
+	if handled.Args["0"] != "api" || handled.Args["force"] != "true" {
+		t.Errorf("Expected parsed args, got %v", handled.Args)
+	}
+	if handled.Args["env"] != "staging" {
+		t.Errorf("Expected explicit arg to take precedence, got %s", handled.Args["env"])
+	}
+	if handled.Args[npc.RemoteAddrArg] != "192.0.2.7" {
+		t.Errorf("Expected the client's address to replace the one it sent, got %s", handled.Args[npc.RemoteAddrArg])
+	}
+}
+
+// TestAPIChannelActions tests that the action catalogue is served as JSON.
+func TestAPIChannelActions(t *testing.T) {
+	core := npc.NewNpc()
+	core.RegisterAction(npc.Action{
+		Name:        "deploy",
+		Description: "Deploy a service",
+		Params:      []npc.Param{{Name: "service", Required: true}},
+		Handler: func(request npc.Request) npc.Response {
+			return npc.Response{Data: "deployed"}
+		},
+	})
+
+	apiChannel := NewAPIChannel(":8083")
+	apiChannel.RegisterContextHandler(core.ProcessRequestContext)
+	routes := apiChannel.routes()
+
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, httptest.NewRequest("GET", "/api/actions", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /api/actions returned status %d: %s", rr.Code, rr.Body.String())
+	}
+	var catalogue []npc.ActionInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &catalogue); err != nil {
+		t.Fatalf("Failed to decode catalogue: %v", err)
+	}
+	found := false
+	for _, info := range catalogue {
+		found = found || info.Name == "deploy"
+	}
+	if !found {
+		t.Errorf("Expected deploy in catalogue %+v", catalogue)
+	}
+
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, httptest.NewRequest("GET", "/api/actions/deploy", nil))
+	var info npc.ActionInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode action info: %v", err)
+	}
+	if info.Usage != "deploy <service>" {
+		t.Errorf("Unexpected usage %q", info.Usage)
+	}
+
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, httptest.NewRequest("GET", "/api/actions/missing", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown action, got %d", rr.Code)
+	}
+}
+
+// TestAPIChannelJobs tests that job status is served as JSON.
+func TestAPIChannelJobs(t *testing.T) {
+	core := npc.NewNpc()
+	core.Use(npc.WrapFunc(func(ctx context.Context, request npc.Request, next npc.Next) npc.Response {
+		request.Identity = "apikey:ci" // As authentication would
+		return next(ctx, request)
+	}))
+	done := make(chan struct{})
+	core.RegisterAction(npc.Action{
+		Name: "build",
+		JobHandler: func(job *npc.Job) npc.Response {
+			<-done
+			return npc.Response{Data: "built"}
+		},
+	})
+	defer close(done)
+
+	apiChannel := NewAPIChannel(":8084")
+	apiChannel.RegisterContextHandler(core.ProcessRequestContext)
+	routes := apiChannel.routes()
+
+	requestBody, _ := json.Marshal(map[string]interface{}{"action": "build"})
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, httptest.NewRequest("POST", "/api/request", bytes.NewBuffer(requestBody)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 for an async action, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var started npc.JobInfo
+	json.Unmarshal(rr.Body.Bytes(), &started)
+
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, httptest.NewRequest("GET", "/api/jobs/"+started.ID, nil))
+	var info npc.JobInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode job: %v", err)
+	}
+	if info.ID != started.ID || info.Status != npc.JobRunning {
+		t.Errorf("Unexpected job %+v", info)
+	}
+
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, httptest.NewRequest("GET", "/api/jobs/missing", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", rr.Code)
+	}
+}
+
+// TestAPIChannelBlocks tests that responses with blocks are written as JSON objects.
+func TestAPIChannelBlocks(t *testing.T) {
+	apiChannel := NewAPIChannel(":8085")
+	apiChannel.RegisterRequestHandler(func(request npc.Request) npc.Response {
+		return npc.Response{
+			Data:   "Deployed",
+			Blocks: []npc.Block{npc.Header("Deploy"), npc.Fields(npc.Field{Label: "Env", Value: "prod"})},
+		}
+	})
+
+	requestBody, _ := json.Marshal(map[string]interface{}{"action": "deploy"})
+	rr := httptest.NewRecorder()
+	apiChannel.routes().ServeHTTP(rr, httptest.NewRequest("POST", "/api/request", bytes.NewBuffer(requestBody)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var body struct {
+		Text   string      `json:"text"`
+		Blocks []npc.Block `json:"blocks"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if body.Text != "Deployed" || len(body.Blocks) != 2 {
+		t.Fatalf("Unexpected response %+v", body)
+	}
+	if body.Blocks[1].Type != npc.BlockFields || body.Blocks[1].Fields[0].Value != "prod" {
+		t.Errorf("Unexpected fields block %+v", body.Blocks[1])
+	}
+}
+
+// TestAPIChannelStream tests that messages written by a handler are streamed before the final response.
+func TestAPIChannelStream(t *testing.T) {
+	apiChannel := NewAPIChannel(":8086")
+	apiChannel.RegisterContextHandler(func(ctx context.Context, request npc.Request) npc.Response {
+		w := npc.ResponseWriterFrom(ctx)
+		w.Send(npc.Response{Data: "Starting"})
+		w.Update(npc.Response{Data: "Halfway"})
+		return npc.Response{Data: "Done"}
+	})
+	routes := apiChannel.routes()
+	requestBody, _ := json.Marshal(map[string]interface{}{"action": "deploy"})
+
+	req := httptest.NewRequest("POST", "/api/request", bytes.NewBuffer(requestBody))
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Unexpected content type %q", rr.Header().Get("Content-Type"))
+	}
+	var events []streamEvent
+	for _, line := range strings.Split(strings.TrimSpace(rr.Body.String()), "\n") {
+		var event streamEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Failed to decode %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 3 || events[0].Type != "message" || events[1].Type != "update" || events[2].Type != "response" || events[2].Text != "Done" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+
+	req = httptest.NewRequest("POST", "/api/request", bytes.NewBuffer(requestBody))
+	req.Header.Set("Accept", "text/event-stream")
+	rr = httptest.NewRecorder()
+	routes.ServeHTTP(rr, req)
+	if !strings.HasPrefix(rr.Body.String(), "event: message\ndata: {\"type\":\"message\",\"text\":\"Starting\"}\n\n") {
+		t.Errorf("Unexpected event stream %q", rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "event: response\n") {
+		t.Errorf("Expected a final response event in %q", rr.Body.String())
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// Streaming formats, chosen by the client's Accept header.
+const (
+	eventStream = "text/event-stream"    // Server-sent events
+	ndjson      = "application/x-ndjson" // One JSON object per line, sent as chunks
+)
+
+// streamEvent is one message in a streamed response. Type is "message" or "update" for
+// messages the handler writes while running, then "response" or "error" for the final result.
+type streamEvent struct {
+	Type   string      `json:"type"`
+	Text   string      `json:"text,omitempty"`
+	Blocks []npc.Block `json:"blocks,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Status int         `json:"status,omitempty"` // HTTP status equivalent of an error
+}
+
+// streamFormat returns the streaming format the client asked for, or "" for a plain JSON response.
+func streamFormat(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	for _, format := range []string{eventStream, ndjson} {
+		if strings.Contains(accept, format) {
+			return format
+		}
+	}
+	return ""
+}
+
+// streamWriter is the npc.ResponseWriter for a streamed HTTP response.
+type streamWriter struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	format string
+	closed bool
+}
+
+// newStreamWriter starts a streamed response in the given format.
+func newStreamWriter(w http.ResponseWriter, format string) *streamWriter {
+	w.Header().Set("Content-Type", format)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return &streamWriter{w: w, format: format}
+}
+
+// Send writes a message event.
+func (s *streamWriter) Send(response npc.Response) error {
+	return s.write(newStreamEvent("message", response))
+}
+
+// Update writes an update event, which clients apply to the last message.
+func (s *streamWriter) Update(response npc.Response) error {
+	return s.write(newStreamEvent("update", response))
+}
+
+// finish writes the final response and closes the stream.
+func (s *streamWriter) finish(response npc.Response) {
+	s.write(newStreamEvent("response", response))
+
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+}
+
+// write encodes one event in the stream's format and flushes it to the client.
+func (s *streamWriter) write(event streamEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return npc.ErrStreamClosed
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if s.format == eventStream {
+		_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event.Type, data)
+	} else {
+		_, err = fmt.Fprintf(s.w, "%s\n", data)
+	}
+	if err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// newStreamEvent converts a response to an event of the given type. Errors become error events.
+func newStreamEvent(eventType string, response npc.Response) streamEvent {
+	if response.Error != nil {
+		return streamEvent{Type: "error", Error: response.Error.Error(), Status: statusForError(response.Error)}
+	}
+	return streamEvent{
+		Type:   eventType,
+		Text:   response.Data,
+		Blocks: response.Blocks,
+		Data:   response.Payload,
+	}
+}
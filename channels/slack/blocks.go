@@ -0,0 +1,98 @@
+package slack
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/slack-go/slack"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// maxSectionFields is the most fields Slack allows in one section block.
+const maxSectionFields = 10
+
+// buttonValue is the value carried by a Slack button, naming the request to run when it is pressed.
+type buttonValue struct {
+	Action string            `json:"action"`
+	Args   map[string]string `json:"args,omitempty"`
+}
+
+// renderBlocks converts a response's blocks to Slack Block Kit blocks. A summary in Data is
+// shown first as its own section.
+func renderBlocks(response npc.Response) []slack.Block {
+	var blocks []slack.Block
+	if response.Data != "" {
+		blocks = append(blocks, markdownSection(response.Data))
+	}
+
+	for i, block := range response.Blocks {
+		switch block.Type {
+		case npc.BlockHeader:
+			blocks = append(blocks, slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, block.Text, false, false)))
+		case npc.BlockSection:
+			blocks = append(blocks, markdownSection(block.Text))
+		case npc.BlockCode:
+			blocks = append(blocks, markdownSection("```"+block.Text+"```"))
+		case npc.BlockFields:
+			for start := 0; start < len(block.Fields); start += maxSectionFields {
+				end := min(start+maxSectionFields, len(block.Fields))
+				fields := make([]*slack.TextBlockObject, 0, end-start)
+				for _, f := range block.Fields[start:end] {
+					fields = append(fields, slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("*%s*\n%s", f.Label, f.Value), false, false))
+				}
+				blocks = append(blocks, slack.NewSectionBlock(nil, fields, nil))
+			}
+		case npc.BlockList:
+			blocks = append(blocks, markdownSection(listText(block)))
+		case npc.BlockImage:
+			blocks = append(blocks, slack.NewImageBlock(block.ImageURL, block.AltText, "", nil))
+		case npc.BlockButtons:
+			elements := make([]slack.BlockElement, 0, len(block.Buttons))
+			for j, button := range block.Buttons {
+				elements = append(elements, buttonElement(fmt.Sprintf("npc_button_%d_%d", i, j), button))
+			}
+			blocks = append(blocks, slack.NewActionBlock(fmt.Sprintf("npc_buttons_%d", i), elements...))
+		case npc.BlockDivider:
+			blocks = append(blocks, slack.NewDividerBlock())
+		default:
+			if text := block.PlainText(); text != "" {
+				blocks = append(blocks, markdownSection(text))
+			}
+		}
+	}
+	return blocks
+}
+
+// markdownSection returns a section block of mrkdwn text.
+func markdownSection(text string) *slack.SectionBlock {
+	return slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil)
+}
+
+// listText renders a list block as mrkdwn lines.
+func listText(block npc.Block) string {
+	lines := make([]string, len(block.Items))
+	for i, item := range block.Items {
+		if block.Ordered {
+			lines[i] = fmt.Sprintf("%d. %s", i+1, item)
+		} else {
+			lines[i] = "• " + item
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// buttonElement converts a button to a Slack button. Buttons that run an action carry the
+// request to make in their value.
+func buttonElement(actionID string, button npc.Button) *slack.ButtonBlockElement {
+	var value string
+	if button.Action != "" {
+		encoded, _ := json.Marshal(buttonValue{Action: button.Action, Args: button.Args})
+		value = string(encoded)
+	}
+	element := slack.NewButtonBlockElement(actionID, value, slack.NewTextBlockObject(slack.PlainTextType, button.Text, false, false))
+	element.URL = button.URL
+	element.Style = slack.Style(button.Style)
+	return element
+}
@@ -0,0 +1,43 @@
+package slack
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// groupsTTL is how long the workspace's user groups are cached.
+const groupsTTL = 5 * time.Minute
+
+// groupCache holds the user groups each user belongs to.
+type groupCache struct {
+	mu      sync.Mutex
+	members map[string][]string // User ID to group IDs and handles
+	fetched time.Time
+}
+
+// UserGroups returns the IDs and handles of the user groups a user belongs to. The workspace's
+// groups are fetched at most once every few minutes.
+func (sc *SlackChannel) UserGroups(ctx context.Context, user string) ([]string, error) {
+	sc.groups.mu.Lock()
+	defer sc.groups.mu.Unlock()
+
+	if time.Since(sc.groups.fetched) >= groupsTTL {
+		groups, err := sc.Client.GetUserGroupsContext(ctx, slack.GetUserGroupsOptionIncludeUsers(true))
+		if err != nil {
+			// Keep answering from the groups last fetched, if any
+			return sc.groups.members[user], err
+		}
+		members := make(map[string][]string)
+		for _, group := range groups {
+			for _, member := range group.Users {
+				members[member] = append(members[member], group.ID, group.Handle)
+			}
+		}
+		sc.groups.members = members
+		sc.groups.fetched = time.Now()
+	}
+	return sc.groups.members[user], nil
+}
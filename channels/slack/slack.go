@@ -1,8 +1,13 @@
 package slack
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"time"
 
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
@@ -27,28 +32,66 @@ func (rsmc *realSocketModeClient) Events() <-chan socketmode.Event {
 	return rsmc.Client.Events
 }
 
+// unknownAction is the action given to events that are not recognised as commands.
+// Errors for these are not reported back, so ordinary chatter does not get a reply, but
+// responses are, as a message may be the follow-up an action was waiting for.
+const unknownAction = "unknown"
+
+// source is the Source of requests from Slack.
+const source = "Slack"
+
 // SlackChannel is a communication channel for Slack.
 type SlackChannel struct {
-	Client               *slack.Client
-	SocketMode           SocketModeClient
-	requestHandler       func(request npc.Request) npc.Response
+	Client     *slack.Client
+	SocketMode SocketModeClient
+	// Parser turns message text into an action and arguments. NewSlackChannel sets its
+	// Mentions to BotMention, so only messages addressed to the bot are commands; the zero
+	// value treats every message as one.
+	Parser         npc.CommandParser
+	requestHandler npc.RequestHandler
+	groups         groupCache
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-// NewSlackChannel creates a new SlackChannel instance.
+// NewSlackChannel creates a new SlackChannel instance that treats messages mentioning the bot as
+// commands. It returns an error if the bot's user cannot be found.
 func NewSlackChannel(appToken, botToken string) (*SlackChannel, error) {
 	client := slack.New(botToken, slack.OptionAppLevelToken(appToken))
-	socketModeClient := socketmode.New(client)
+	return newSlackChannel(client, &realSocketModeClient{socketmode.New(client)})
+}
 
-	return &SlackChannel{
-		Client:     client,
-		SocketMode: &realSocketModeClient{socketModeClient},
-	}, nil
+// newSlackChannel creates a SlackChannel using the given clients, looking up the bot's mention.
+func newSlackChannel(client *slack.Client, socketMode SocketModeClient) (*SlackChannel, error) {
+	sc := &SlackChannel{Client: client, SocketMode: socketMode}
+	mention, err := sc.BotMention()
+	if err != nil {
+		return nil, fmt.Errorf("finding the Slack bot's user: %w", err)
+	}
+	sc.Parser.Mentions = []string{mention}
+	return sc, nil
 }
 
 // Start starts the Slack communication channel.
 func (sc *SlackChannel) Start() {
+	sc.ctx, sc.cancel = context.WithCancel(context.Background())
+	ctx := sc.ctx
+
 	go func() {
-		for evt := range sc.SocketMode.Events() {
+		events := sc.SocketMode.Events()
+		for {
+			var evt socketmode.Event
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				evt = e
+			}
+
 			switch evt.Type {
 			case socketmode.EventTypeConnecting:
 				fmt.Println("Connecting to Slack...")
@@ -57,7 +100,9 @@ func (sc *SlackChannel) Start() {
 			case socketmode.EventTypeConnected:
 				fmt.Println("Connected to Slack.")
 			case socketmode.EventTypeEventsAPI:
-				sc.handleEvent(evt)
+				sc.handleEvent(ctx, evt)
+			case socketmode.EventTypeInteractive:
+				sc.handleInteraction(ctx, evt)
 			}
 		}
 	}()
@@ -69,10 +114,32 @@ func (sc *SlackChannel) Start() {
 	}()
 }
 
+// BotMention returns the mention of the bot's own user, such as "<@U012AB3CD>", for use in
+// the Parser's Mentions.
+func (sc *SlackChannel) BotMention() (string, error) {
+	auth, err := sc.Client.AuthTest()
+	if err != nil {
+		return "", err
+	}
+	if auth.UserID == "" {
+		return "", errors.New("slack: auth.test returned no user")
+	}
+	return "<@" + auth.UserID + ">", nil
+}
+
+// Name returns "Slack", the Source of the channel's requests.
+func (sc *SlackChannel) Name() string {
+	return source
+}
+
 // Stop stops the Slack communication channel.
 func (sc *SlackChannel) Stop() {
 	// The slack-go library doesn't provide a direct way to stop the socket mode client.
 	// In a real application, you might need to manage the lifecycle more carefully.
+	// Cancelling the channel context stops event handling and any requests still in flight.
+	if sc.cancel != nil {
+		sc.cancel()
+	}
 	fmt.Println("Slack channel stopping...")
 }
 
@@ -84,12 +151,28 @@ func (sc *SlackChannel) SendMessage(channelID string, message string) {
 	}
 }
 
+// SendThreadMessage sends a message to a thread in a Slack channel.
+func (sc *SlackChannel) SendThreadMessage(channelID, threadID, message string) {
+	_, _, err := sc.Client.PostMessage(channelID, slack.MsgOptionText(message, false), slack.MsgOptionTS(threadID))
+	if err != nil {
+		log.Printf("Failed to send message to channel %s: %v", channelID, err)
+	}
+}
+
 // RegisterRequestHandler registers a handler for incoming requests.
 func (sc *SlackChannel) RegisterRequestHandler(handler func(request npc.Request) npc.Response) {
+	sc.RegisterContextHandler(func(ctx context.Context, request npc.Request) npc.Response {
+		return handler(request)
+	})
+}
+
+// RegisterContextHandler registers a context-aware handler for incoming requests.
+// The context is cancelled when the channel is stopped.
+func (sc *SlackChannel) RegisterContextHandler(handler npc.RequestHandler) {
 	sc.requestHandler = handler
 }
 
-func (sc *SlackChannel) handleEvent(evt socketmode.Event) {
+func (sc *SlackChannel) handleEvent(ctx context.Context, evt socketmode.Event) {
 	eventsAPIEvent, ok := evt.Data.(slackevents.EventsAPIEvent)
 	if !ok {
 		return
@@ -99,39 +182,196 @@ func (sc *SlackChannel) handleEvent(evt socketmode.Event) {
 
 	if sc.requestHandler != nil {
 		if messageEvent, ok := eventsAPIEvent.InnerEvent.Data.(slackevents.MessageEvent); ok {
-			action := "unknown" // Default action
+			// Ignore messages from bots, including our own replies
+			if messageEvent.BotID != "" || messageEvent.SubType == "bot_message" {
+				return
+			}
+
+			// Text that is not a command, including chatter that only looks like a malformed
+			// one, such as "don't", is passed on as it is but never answered with an error
+			action := unknownAction // Default action
 			args := make(map[string]string)
-			if messageEvent.Text == "hello" {
-				action = "hello"
-				// Example of adding args from Slack message
-				args["channel_type"] = messageEvent.ChannelType
+			if command, err := sc.Parser.Parse(messageEvent.Text); err == nil && command != nil {
+				action = command.Action
+				args = command.Args
+				args[npc.CommandTextArg] = command.Text
 			}
+			args[npc.ChannelTypeArg] = messageEvent.ChannelType
+			args[npc.TeamIDArg] = eventsAPIEvent.TeamID
 
 			// Construct npc.Request
 			npcRequest := npc.Request{
-				Action:    action,
-				User:      messageEvent.User,
-				ChannelID: messageEvent.Channel,
-				Text:      messageEvent.Text, // Populate Text field
-				Source:    "Slack",           // Set Source
-				AuthMethod: "slack_user",    // Set AuthMethod
-				AuthToken: messageEvent.User, // Set AuthToken
-				Args:      args,
-				RawData:   messageEvent,      // Store the original message event
+				Action:     action,
+				User:       messageEvent.User,
+				ChannelID:  messageEvent.Channel,
+				ThreadID:   messageEvent.ThreadTimeStamp,
+				Text:       messageEvent.Text, // Populate Text field
+				Source:     source,            // Set Source
+				AuthMethod: "slack_user",      // Set AuthMethod
+				AuthToken:  messageEvent.User, // Set AuthToken
+				Args:       args,
+				RawData:    messageEvent, // Store the original message event
 			}
+			npcRequest.ReplyTo = replyAddress(npcRequest)
 
-			sc.requestHandler(npcRequest)
+			// Handlers may stream messages back to the channel before they return
+			writer := sc.newWriter(npcRequest)
+			response := sc.requestHandler(npc.WithResponseWriter(ctx, writer), npcRequest)
+			if !response.Replied {
+				sc.Reply(npcRequest, response)
+			}
 		} else {
 			// For other event types, create a generic request
 			npcRequest := npc.Request{
-				Action:    "unknown", // Default action for non-message events
-				Source:    "Slack",
+				Action:     unknownAction, // Default action for non-message events
+				Source:     source,
 				AuthMethod: "none", // Or appropriate default
-				AuthToken: "",
-				Args:      make(map[string]string), // Initialize empty Args map
-				RawData:   eventsAPIEvent.InnerEvent.Data,
+				AuthToken:  "",
+				Args:       make(map[string]string), // Initialize empty Args map
+				RawData:    eventsAPIEvent.InnerEvent.Data,
 			}
-			sc.requestHandler(npcRequest)
+			sc.requestHandler(ctx, npcRequest)
 		}
 	}
 }
+
+// handleInteraction runs the request behind a button the user pressed on one of our messages.
+func (sc *SlackChannel) handleInteraction(ctx context.Context, evt socketmode.Event) {
+	callback, ok := evt.Data.(slack.InteractionCallback)
+	if !ok {
+		return
+	}
+
+	sc.SocketMode.Ack(*evt.Request)
+
+	if sc.requestHandler == nil || callback.Type != slack.InteractionTypeBlockActions {
+		return
+	}
+	for _, action := range callback.ActionCallback.BlockActions {
+		var button buttonValue
+		if err := json.Unmarshal([]byte(action.Value), &button); err != nil || button.Action == "" {
+			continue // A link button, or one we did not create
+		}
+		args := make(map[string]string, len(button.Args)+1)
+		for k, v := range button.Args {
+			args[k] = v
+		}
+		args[npc.TeamIDArg] = callback.Team.ID
+
+		npcRequest := npc.Request{
+			Action:     button.Action,
+			User:       callback.User.ID,
+			ChannelID:  callback.Channel.ID,
+			ThreadID:   callback.Message.ThreadTimestamp,
+			Source:     source,
+			AuthMethod: "slack_user",
+			AuthToken:  callback.User.ID,
+			Args:       args,
+			RawData:    callback,
+		}
+		npcRequest.ReplyTo = replyAddress(npcRequest)
+		writer := sc.newWriter(npcRequest)
+		if response := sc.requestHandler(npc.WithResponseWriter(ctx, writer), npcRequest); !response.Replied {
+			sc.Reply(npcRequest, response)
+		}
+	}
+}
+
+// Reply posts the response to a request to the channel and thread of its reply address.
+// Errors are shown only to the user who made the request, and not at all for messages that
+// were not commands.
+func (sc *SlackChannel) Reply(request npc.Request, response npc.Response) {
+	to := request.ReplyTo
+	if response.Error != nil {
+		if request.Action != unknownAction {
+			sc.replyError(to.ChannelID, to.ThreadID, to.User, response.Error)
+		}
+		return
+	}
+	sc.postResponse(to.ChannelID, to.ThreadID, response)
+}
+
+// replyAddress returns the address of the channel and thread a request came from.
+func replyAddress(request npc.Request) npc.Address {
+	return npc.Address{Adapter: source, ChannelID: request.ChannelID, ThreadID: request.ThreadID, User: request.User}
+}
+
+// SendResponse posts a response to a Slack channel, rendering its blocks with Block Kit.
+// The plain text of the response is sent too, for notifications and clients without blocks.
+func (sc *SlackChannel) SendResponse(channelID string, response npc.Response) {
+	sc.postResponse(channelID, "", response)
+}
+
+// postResponse posts a response to a channel, in a thread if threadID is set.
+func (sc *SlackChannel) postResponse(channelID, threadID string, response npc.Response) {
+	if response.Text() == "" && len(response.Blocks) == 0 {
+		return
+	}
+	_, _, err := sc.Client.PostMessage(channelID, messageOptions(threadID, response)...)
+	if err != nil {
+		log.Printf("Failed to send message to channel %s: %v", channelID, err)
+	}
+}
+
+// replyError tells the user why their request failed with a message only they can see.
+func (sc *SlackChannel) replyError(channelID, threadID, user string, err error) {
+	if channelID == "" || user == "" {
+		return
+	}
+	options := []slack.MsgOption{slack.MsgOptionText(errorMessage(err), false)}
+	if threadID != "" {
+		options = append(options, slack.MsgOptionTS(threadID))
+	}
+	_, postErr := sc.Client.PostEphemeral(channelID, user, options...)
+	if postErr != nil {
+		log.Printf("Failed to send error reply to channel %s: %v", channelID, postErr)
+	}
+}
+
+// errorMessage phrases an npc error for a Slack user.
+func errorMessage(err error) string {
+	switch npc.KindOf(err) {
+	case npc.ErrUnauthorized:
+		return "Sorry, I couldn't verify who you are."
+	case npc.ErrForbidden:
+		return "Sorry, you're not allowed to do that."
+	case npc.ErrNotFound:
+		return fmt.Sprintf("Sorry, I couldn't find that: %v", err)
+	case npc.ErrInvalidArguments:
+		return fmt.Sprintf("That doesn't look quite right: %v", err)
+	case npc.ErrRateLimited:
+		var limited *npc.RateLimitError
+		if errors.As(err, &limited) && limited.RetryAfter > 0 {
+			return fmt.Sprintf("You're sending requests a little quickly. Please try again in %s.", waitPhrase(limited.RetryAfter))
+		}
+		return "You're sending requests a little quickly. Please try again shortly."
+	case npc.ErrTimeout:
+		return "Sorry, that took too long. Please try again."
+	case npc.ErrUnavailable:
+		return fmt.Sprintf("Sorry, that's unavailable right now: %v", err)
+	case npc.ErrBusy:
+		return "I'm busy with too many of those right now. Please try again shortly."
+	default:
+		var panicked *npc.PanicError
+		if errors.As(err, &panicked) {
+			return fmt.Sprintf("Sorry, something went wrong on my side (reference %s).", panicked.ID)
+		}
+		return "Sorry, something went wrong on my side."
+	}
+}
+
+// waitPhrase describes a wait in words, such as "about 2 minutes".
+func waitPhrase(wait time.Duration) string {
+	switch {
+	case wait <= time.Second:
+		return "a moment"
+	case wait < time.Minute:
+		return fmt.Sprintf("%d seconds", int(math.Ceil(wait.Seconds())))
+	case wait < 90*time.Second:
+		return "about a minute"
+	case wait < time.Hour:
+		return fmt.Sprintf("about %d minutes", int(math.Round(wait.Minutes())))
+	default:
+		return "a while"
+	}
+}
@@ -1,8 +1,14 @@
 package slack
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
@@ -28,12 +34,34 @@ func (m *MockSocketModeClient) Events() <-chan socketmode.Event {
 	return m.EventsChan
 }
 
+// slackCall is a call made to the fake Slack Web API.
+type slackCall struct {
+	Method string
+	Form   url.Values
+}
+
+// fakeSlackAPI starts a stand-in for the Slack Web API and returns a client that talks to it,
+// along with a channel that receives each call made.
+func fakeSlackAPI(t *testing.T) (*slack.Client, <-chan slackCall) {
+	calls := make(chan slackCall, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		select {
+		case calls <- slackCall{Method: strings.TrimPrefix(r.URL.Path, "/"), Form: r.Form}:
+		default:
+		}
+		w.Write([]byte(`{"ok":true,"channel":"C12345","ts":"1700000000.000100","user_id":"UBOT"}`))
+	}))
+	t.Cleanup(server.Close)
+	return slack.New("xoxb-test", slack.OptionAPIURL(server.URL+"/")), calls
+}
+
 // TestSlackChannel tests the SlackChannel.
 func TestSlackChannel(t *testing.T) {
 	var wg sync.WaitGroup
 
 	// Create a mock Slack client and socketmode client
-	client := &slack.Client{}
+	client, _ := fakeSlackAPI(t)
 	mockSocketMode := &MockSocketModeClient{
 		EventsChan: make(chan socketmode.Event, 1),
 	}
@@ -108,3 +136,315 @@ func TestSlackChannel(t *testing.T) {
 		t.Errorf("Expected RawData to be of type slackevents.MessageEvent, got %T", handledRequest.RawData)
 	}
 }
+
+// TestSlackChannelErrorReply tests that failed requests are reported back to the user.
+func TestSlackChannelErrorReply(t *testing.T) {
+	client, calls := fakeSlackAPI(t)
+
+	mockSocketMode := &MockSocketModeClient{
+		EventsChan: make(chan socketmode.Event, 1),
+	}
+	sc := &SlackChannel{
+		Client:     client,
+		SocketMode: mockSocketMode,
+	}
+	sc.RegisterRequestHandler(func(request npc.Request) npc.Response {
+		return npc.Response{Error: npc.ErrForbidden}
+	})
+	sc.Start()
+	defer sc.Stop()
+
+	mockSocketMode.EventsChan <- socketmode.Event{
+		Type: socketmode.EventTypeEventsAPI,
+		Data: slackevents.EventsAPIEvent{
+			InnerEvent: slackevents.EventsAPIInnerEvent{
+				Data: slackevents.MessageEvent{Text: "hello", User: "U12345", Channel: "C12345"},
+			},
+		},
+		Request: &socketmode.Request{},
+	}
+
+	select {
+	case call := <-calls:
+		form := call.Form
+		if call.Method != "chat.postEphemeral" {
+			t.Errorf("Expected an ephemeral reply, got %s", call.Method)
+		}
+		if form.Get("channel") != "C12345" || form.Get("user") != "U12345" {
+			t.Errorf("Expected reply to U12345 in C12345, got %v", form)
+		}
+		if form.Get("text") != errorMessage(npc.ErrForbidden) {
+			t.Errorf("Unexpected reply text %q", form.Get("text"))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for error reply")
+	}
+}
+
+// TestSlackChannelReplied tests that responses the core has already delivered are not posted again.
+func TestSlackChannelReplied(t *testing.T) {
+	client, calls := fakeSlackAPI(t)
+	handled := make(chan npc.Request, 1)
+	mockSocketMode := &MockSocketModeClient{
+		EventsChan: make(chan socketmode.Event, 1),
+	}
+	sc := &SlackChannel{
+		Client:     client,
+		SocketMode: mockSocketMode,
+	}
+	sc.RegisterRequestHandler(func(request npc.Request) npc.Response {
+		handled <- request
+		return npc.Response{Data: "Hello!", Replied: true}
+	})
+	sc.Start()
+	defer sc.Stop()
+
+	mockSocketMode.EventsChan <- socketmode.Event{
+		Type: socketmode.EventTypeEventsAPI,
+		Data: slackevents.EventsAPIEvent{
+			InnerEvent: slackevents.EventsAPIInnerEvent{
+				Data: slackevents.MessageEvent{Text: "hello", User: "U12345", Channel: "C12345", ThreadTimeStamp: "1.2"},
+			},
+		},
+		Request: &socketmode.Request{},
+	}
+
+	select {
+	case request := <-handled:
+		expected := npc.Address{Adapter: "Slack", ChannelID: "C12345", ThreadID: "1.2", User: "U12345"}
+		if request.ReplyTo != expected {
+			t.Errorf("Expected reply address %+v, got %+v", expected, request.ReplyTo)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for request")
+	}
+	select {
+	case call := <-calls:
+		t.Errorf("Expected no reply, got a call to %s", call.Method)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestSlackChannelParsesCommand tests that message text is parsed into an action and args.
+func TestSlackChannelParsesCommand(t *testing.T) {
+	client, _ := fakeSlackAPI(t)
+	handled := make(chan npc.Request, 1)
+	mockSocketMode := &MockSocketModeClient{
+		EventsChan: make(chan socketmode.Event, 1),
+	}
+	sc := &SlackChannel{
+		Client:     client,
+		SocketMode: mockSocketMode,
+		Parser:     npc.CommandParser{Mentions: []string{"<@UBOT>"}},
+	}
+	sc.RegisterRequestHandler(func(request npc.Request) npc.Response {
+		handled <- request
+		return npc.Response{Data: "ok"}
+	})
+	sc.Start()
+	defer sc.Stop()
+
+	mockSocketMode.EventsChan <- socketmode.Event{
+		Type: socketmode.EventTypeEventsAPI,
+		Data: slackevents.EventsAPIEvent{
+			InnerEvent: slackevents.EventsAPIInnerEvent{
+				Data: slackevents.MessageEvent{Text: `<@UBOT> deploy api env=prod --force`, User: "U12345", Channel: "C12345"},
+			},
+		},
+		Request: &socketmode.Request{},
+	}
+
+	select {
+	case request := <-handled:
+		if request.Action != "deploy" {
+			t.Errorf("Expected action 'deploy', got %s", request.Action)
+		}
+		if request.Args["0"] != "api" || request.Args["env"] != "prod" || request.Args["force"] != "true" {
+			t.Errorf("Unexpected args %v", request.Args)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for request")
+	}
+}
+
+// TestNewSlackChannel tests that a new channel treats only messages mentioning the bot as commands.
+func TestNewSlackChannel(t *testing.T) {
+	client, _ := fakeSlackAPI(t)
+	sc, err := newSlackChannel(client, &MockSocketModeClient{})
+	if err != nil {
+		t.Fatalf("newSlackChannel failed: %v", err)
+	}
+	if command, _ := sc.Parser.Parse("lol"); command != nil {
+		t.Errorf("Expected chatter not to be a command, got %+v", command)
+	}
+	if command, _ := sc.Parser.Parse("<@UBOT> deploy"); command == nil || command.Action != "deploy" {
+		t.Errorf("Expected a mention to be a command, got %+v", command)
+	}
+}
+
+// TestSlackChannelChatter tests that messages which do not parse as commands are passed on as
+// unknown and their errors are not reported back.
+func TestSlackChannelChatter(t *testing.T) {
+	client, calls := fakeSlackAPI(t)
+	handled := make(chan npc.Request, 2)
+	mockSocketMode := &MockSocketModeClient{
+		EventsChan: make(chan socketmode.Event, 2),
+	}
+	sc := &SlackChannel{
+		Client:     client,
+		SocketMode: mockSocketMode,
+		Parser:     npc.CommandParser{Mentions: []string{"<@UBOT>"}},
+	}
+	sc.RegisterRequestHandler(func(request npc.Request) npc.Response {
+		handled <- request
+		return npc.Response{Error: npc.ErrNotFound}
+	})
+	sc.Start()
+	defer sc.Stop()
+
+	for _, text := range []string{"good morning", "<@UBOT> don’t deploy"} {
+		mockSocketMode.EventsChan <- socketmode.Event{
+			Type: socketmode.EventTypeEventsAPI,
+			Data: slackevents.EventsAPIEvent{
+				InnerEvent: slackevents.EventsAPIInnerEvent{
+					Data: slackevents.MessageEvent{Text: text, User: "U12345", Channel: "C12345"},
+				},
+			},
+			Request: &socketmode.Request{},
+		}
+		select {
+		case request := <-handled:
+			if request.Action != unknownAction || request.Text != text {
+				t.Errorf("Expected %q to be passed on as unknown, got action %s", text, request.Action)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for request")
+		}
+	}
+	select {
+	case call := <-calls:
+		t.Errorf("Expected no reply, got a call to %s", call.Method)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestSlackChannelBlocks tests that response blocks are posted with Block Kit and a text fallback.
+func TestSlackChannelBlocks(t *testing.T) {
+	client, calls := fakeSlackAPI(t)
+	sc := &SlackChannel{Client: client}
+
+	sc.SendResponse("C12345", npc.Response{
+		Data: "Deployed",
+		Blocks: []npc.Block{
+			npc.Header("Deploy"),
+			npc.Code("", "ok"),
+			npc.Buttons(npc.Button{Text: "Roll back", Action: "rollback", Args: map[string]string{"service": "api"}}),
+		},
+	})
+
+	select {
+	case call := <-calls:
+		if call.Method != "chat.postMessage" {
+			t.Fatalf("Expected chat.postMessage, got %s", call.Method)
+		}
+		if !strings.HasPrefix(call.Form.Get("text"), "Deployed\n\nDeploy") {
+			t.Errorf("Unexpected fallback text %q", call.Form.Get("text"))
+		}
+		var blocks []map[string]interface{}
+		if err := json.Unmarshal([]byte(call.Form.Get("blocks")), &blocks); err != nil {
+			t.Fatalf("Failed to decode blocks: %v", err)
+		}
+		var types []string
+		for _, block := range blocks {
+			types = append(types, block["type"].(string))
+		}
+		if strings.Join(types, ",") != "section,header,section,actions" {
+			t.Errorf("Unexpected block types %v", types)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+}
+
+// TestSlackChannelButton tests that pressing a button runs the request it carries.
+func TestSlackChannelButton(t *testing.T) {
+	client, _ := fakeSlackAPI(t)
+	handled := make(chan npc.Request, 1)
+	mockSocketMode := &MockSocketModeClient{
+		EventsChan: make(chan socketmode.Event, 1),
+	}
+	sc := &SlackChannel{
+		Client:     client,
+		SocketMode: mockSocketMode,
+	}
+	sc.RegisterRequestHandler(func(request npc.Request) npc.Response {
+		handled <- request
+		return npc.Response{Data: "ok"}
+	})
+	sc.Start()
+	defer sc.Stop()
+
+	button := buttonElement("b", npc.Button{Text: "Roll back", Action: "rollback", Args: map[string]string{"service": "api"}})
+	callback := slack.InteractionCallback{
+		Type:    slack.InteractionTypeBlockActions,
+		User:    slack.User{ID: "U12345"},
+		Channel: slack.Channel{GroupConversation: slack.GroupConversation{Conversation: slack.Conversation{ID: "C12345"}}},
+	}
+	callback.ActionCallback.BlockActions = []*slack.BlockAction{{ActionID: "b", Value: button.Value}}
+	mockSocketMode.EventsChan <- socketmode.Event{
+		Type:    socketmode.EventTypeInteractive,
+		Data:    callback,
+		Request: &socketmode.Request{},
+	}
+
+	select {
+	case request := <-handled:
+		if request.Action != "rollback" || request.Args["service"] != "api" {
+			t.Errorf("Unexpected request %+v", request)
+		}
+		if request.User != "U12345" || request.ChannelID != "C12345" {
+			t.Errorf("Expected request from U12345 in C12345, got %s in %s", request.User, request.ChannelID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for request")
+	}
+}
+
+// TestSlackWriter tests that streamed messages are posted and then updated in place.
+func TestSlackWriter(t *testing.T) {
+	client, calls := fakeSlackAPI(t)
+	sc := &SlackChannel{Client: client}
+	w := sc.newWriter(npc.Request{ChannelID: "C12345", User: "U12345"})
+
+	if err := w.Update(npc.Response{Data: "Starting"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := w.Update(npc.Response{Data: "Halfway"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	first, second := <-calls, <-calls
+	if first.Method != "chat.postMessage" || first.Form.Get("text") != "Starting" {
+		t.Errorf("Expected the first update to post a message, got %s %v", first.Method, first.Form)
+	}
+	if second.Method != "chat.update" || second.Form.Get("ts") != "1700000000.000100" || second.Form.Get("text") != "Halfway" {
+		t.Errorf("Expected the second update to edit the message, got %s %v", second.Method, second.Form)
+	}
+}
+
+// TestErrorMessageRateLimited tests that rate limited users are told how long to wait.
+func TestErrorMessageRateLimited(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&npc.RateLimitError{RetryAfter: 12 * time.Second}, "You're sending requests a little quickly. Please try again in 12 seconds."},
+		{&npc.RateLimitError{RetryAfter: 3 * time.Minute}, "You're sending requests a little quickly. Please try again in about 3 minutes."},
+		{npc.ErrRateLimited, "You're sending requests a little quickly. Please try again shortly."},
+	}
+	for _, test := range tests {
+		if got := errorMessage(test.err); got != test.want {
+			t.Errorf("errorMessage(%v) = %q, expected %q", test.err, got, test.want)
+		}
+	}
+}
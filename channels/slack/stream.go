@@ -0,0 +1,69 @@
+package slack
+
+import (
+	"sync"
+
+	"github.com/slack-go/slack"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// slackWriter is the npc.ResponseWriter for a Slack request. Each Send posts a new message
+// and Update edits the last message posted in place.
+type slackWriter struct {
+	sc      *SlackChannel
+	request npc.Request
+
+	mu        sync.Mutex
+	timestamp string // Timestamp of the last message posted, which identifies it for updates
+}
+
+// newWriter returns a writer for streaming responses to a request.
+func (sc *SlackChannel) newWriter(request npc.Request) *slackWriter {
+	return &slackWriter{sc: sc, request: request}
+}
+
+// Send posts a new message. Errors are shown only to the requesting user.
+func (w *slackWriter) Send(response npc.Response) error {
+	if response.Error != nil {
+		w.sc.replyError(w.request.ChannelID, w.request.ThreadID, w.request.User, response.Error)
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, timestamp, err := w.sc.Client.PostMessage(w.request.ChannelID, messageOptions(w.request.ThreadID, response)...)
+	if err != nil {
+		return err
+	}
+	w.timestamp = timestamp
+	return nil
+}
+
+// Update edits the last message posted, or posts a new one if there is none yet.
+func (w *slackWriter) Update(response npc.Response) error {
+	w.mu.Lock()
+	timestamp := w.timestamp
+	w.mu.Unlock()
+
+	if timestamp == "" || response.Error != nil {
+		return w.Send(response)
+	}
+	_, _, _, err := w.sc.Client.UpdateMessage(w.request.ChannelID, timestamp, messageOptions("", response)...)
+	return err
+}
+
+// messageOptions returns the options for posting a response: its plain text, which Slack uses
+// for notifications and clients without blocks, its blocks rendered with Block Kit and, if
+// threadID is set, the thread to post in.
+func messageOptions(threadID string, response npc.Response) []slack.MsgOption {
+	options := []slack.MsgOption{slack.MsgOptionText(response.Text(), false)}
+	if threadID != "" {
+		options = append(options, slack.MsgOptionTS(threadID))
+	}
+	if len(response.Blocks) > 0 {
+		options = append(options, slack.MsgOptionBlocks(renderBlocks(response)...))
+	}
+	return options
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	
@@ -138,7 +139,11 @@ func TestIntegration(t *testing.T) {
 
 	var wg sync.WaitGroup
 	// Create a mock Slack client and socketmode client
-	client := &slack.Client{}
+	slackAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer slackAPI.Close()
+	client := slack.New("xoxb-test", slack.OptionAPIURL(slackAPI.URL+"/"))
 	mockSocketMode := &MockSocketModeClient{
 		EventsChan: make(chan socketmode.Event, 1),
 	}
@@ -0,0 +1,33 @@
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestWriteAtomic tests that a file is replaced, and that a failed write leaves nothing behind.
+func TestWriteAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	for _, data := range []string{"first", "second"} {
+		if err := WriteAtomic(path, []byte(data)); err != nil {
+			t.Fatalf("WriteAtomic failed: %v", err)
+		}
+		if got, _ := os.ReadFile(path); string(got) != data {
+			t.Errorf("Expected %q, got %q", data, got)
+		}
+	}
+
+	// A directory cannot be replaced by a file
+	blocked := filepath.Join(dir, "blocked")
+	os.Mkdir(blocked, 0o700)
+	os.WriteFile(filepath.Join(blocked, "keep"), nil, 0o600)
+	if err := WriteAtomic(blocked, []byte("data")); err == nil {
+		t.Error("Expected an error replacing a directory")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Expected the temporary file to be removed, found %d entries", len(entries))
+	}
+}
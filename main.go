@@ -1,36 +1,122 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/dyluth/npc2/channels/api"
 	"github.com/dyluth/npc2/channels/slack"
 	"github.com/dyluth/npc2/middleware"
 	"github.com/dyluth/npc2/npc"
+	"github.com/dyluth/npc2/state"
 )
 
 func main() {
+	// "npc2 apikey ..." manages the keys in API_KEYS_FILE instead of running the bot
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		os.Exit(manageAPIKeys(os.Args[2:]))
+	}
+
 	// Create a new NPC core
 	npcCore := npc.NewNpc()
 
-	// Get API token from environment variable
-	apiToken := os.Getenv("API_TOKEN")
-	if apiToken == "" {
-		fmt.Println("API_TOKEN must be set.")
+	// Authenticate API requests with the keys in API_KEYS_FILE, reloading it when "npc2 apikey"
+	// changes it, or else the shared API_TOKEN
+	authMiddleware := &middleware.AuthMiddleware{Token: os.Getenv("API_TOKEN"), Actions: npcCore}
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		keys, err := middleware.OpenAPIKeyStore(path)
+		if err != nil {
+			fmt.Printf("Failed to open API keys: %v\n", err)
+			return
+		}
+		authMiddleware.Keys = keys
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go keys.Watch(ctx, 10*time.Second)
+	} else if authMiddleware.Token == "" {
+		fmt.Println("API_TOKEN or API_KEYS_FILE must be set.")
 		return
 	}
-
-	// Create and register authentication middleware
-	authMiddleware := &middleware.AuthMiddleware{Token: apiToken}
+	// Admit Slack users, optionally only from the workspaces in SLACK_WORKSPACES and the users
+	// in SLACK_ALLOWED_USERS
+	authMiddleware.Register("slack_user", &middleware.SlackAuthenticator{
+		Workspaces: splitList(os.Getenv("SLACK_WORKSPACES")),
+		Users:      splitList(os.Getenv("SLACK_ALLOWED_USERS")),
+	})
+	// Let callers without credentials run the actions in ANONYMOUS_ACTIONS, 10 a minute from each
+	// address
+	if actions := splitList(os.Getenv("ANONYMOUS_ACTIONS")); len(actions) > 0 {
+		authMiddleware.Anonymous = &middleware.AnonymousAuthenticator{
+			Actions: actions,
+			Limit:   middleware.NewRateLimitMiddleware(middleware.RateLimit{Limit: 10, Window: time.Minute}, middleware.ByUser),
+		}
+	}
 	npcCore.Use(authMiddleware)
 
+	// Limit what each caller may run if RBAC_POLICY names a policy file, reloading it when it changes
+	var rbacMiddleware *middleware.RBACMiddleware
+	if path := os.Getenv("RBAC_POLICY"); path != "" {
+		var err error
+		if rbacMiddleware, err = middleware.LoadRBACMiddleware(path); err != nil {
+			fmt.Printf("Failed to load RBAC policy: %v\n", err)
+			return
+		}
+		rbacMiddleware.Actions = npcCore
+		npcCore.Use(rbacMiddleware)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go rbacMiddleware.Watch(ctx, 10*time.Second)
+	}
+
 	// Register audit logging middleware
 	auditLogMiddleware := &middleware.AuditLogMiddleware{}
 	npcCore.Use(auditLogMiddleware)
 
+	// Share rate limits, sessions and idempotency keys between replicas if REDIS_ADDR is set
+	var sharedState state.Store = state.NewMemory()
+	var sessionStore npc.SessionStore = npc.NewMemorySessionStore()
+	var rateLimitStore middleware.RateLimitStore = middleware.NewMemoryRateLimitStore()
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		options := state.RedisOptions{Addr: addr, Password: os.Getenv("REDIS_PASSWORD")}
+		if os.Getenv("REDIS_FAIL_OPEN") == "true" {
+			options.Policy = state.FailOpen
+		}
+		redis := state.NewRedis(options)
+		defer redis.Close()
+		sharedState = redis
+		sessionStore = state.NewSessionStore(redis)
+		rateLimitStore = middleware.NewSharedRateLimitStore(redis)
+	}
+
+	// Allow each caller 30 requests a minute on each channel, in bursts of up to 30
+	rateLimitMiddleware := middleware.NewRateLimitMiddleware(middleware.RateLimit{Limit: 30, Window: time.Minute}, middleware.ByUser|middleware.BySource)
+	rateLimitMiddleware.Store = rateLimitStore
+	rateLimitMiddleware.Actions = npcCore
+	npcCore.Use(rateLimitMiddleware)
+
+	// Run retried requests carrying an idempotency key only once
+	npcCore.Use(middleware.NewIdempotencyMiddleware(sharedState))
+
+	// Keep conversation state between requests, in a file if SESSION_FILE is set, even if
+	// REDIS_ADDR is set too
+	if path := os.Getenv("SESSION_FILE"); path != "" {
+		fileStore, err := npc.NewFileSessionStore(path)
+		if err != nil {
+			fmt.Printf("Failed to open session file: %v\n", err)
+			return
+		}
+		if os.Getenv("REDIS_ADDR") != "" {
+			fmt.Printf("Keeping sessions in %s rather than Redis, as SESSION_FILE is set\n", path)
+		}
+		sessionStore = fileStore
+	}
+	npcCore.Use(middleware.NewSessionMiddleware(sessionStore, npcCore))
+
 	// Create and register a simple action
 	helloAction := npc.Action{
 		Name:        "hello",
@@ -39,7 +125,10 @@ func main() {
 			return npc.Response{Data: "Hello, world!", Code: 200}
 		},
 	}
-	npcCore.RegisterAction(helloAction)
+	if err := npcCore.RegisterAction(helloAction); err != nil {
+		fmt.Printf("Failed to register action: %v\n", err)
+		return
+	}
 
 	// Get Slack tokens from environment variables
 	slackAppToken := os.Getenv("SLACK_APP_TOKEN")
@@ -50,19 +139,29 @@ func main() {
 		return
 	}
 
-	// Create and start the Slack channel
+	// Create the Slack channel
 	slackChannel, err := slack.NewSlackChannel(slackAppToken, slackBotToken)
 	if err != nil {
 		fmt.Printf("Failed to create Slack channel: %v\n", err)
 		return
 	}
-	slackChannel.RegisterRequestHandler(npcCore.ProcessRequest)
-	slackChannel.Start()
+	// Treat only messages that mention the bot, or start with SLACK_COMMAND_PREFIX if it is set,
+	// such as "!", as commands
+	slackChannel.Parser.Prefix = os.Getenv("SLACK_COMMAND_PREFIX")
+	if rbacMiddleware != nil {
+		rbacMiddleware.Groups = slackChannel
+	}
+	if err := npcCore.AddChannel(slackChannel); err != nil {
+		fmt.Printf("Failed to add Slack channel: %v\n", err)
+		return
+	}
 
-	// Create and start the API channel
-	apiChannel := api.NewAPIChannel(":8080")
-	apiChannel.RegisterRequestHandler(npcCore.ProcessRequest)
-	apiChannel.Start()
+	// Create the API channel
+	if err := npcCore.AddChannel(api.NewAPIChannel(":8080")); err != nil {
+		fmt.Printf("Failed to add API channel: %v\n", err)
+		return
+	}
+	npcCore.StartAll()
 
 	fmt.Println("NPC is running. Press Ctrl+C to exit.")
 
@@ -72,6 +171,16 @@ func main() {
 	<-sc
 
 	// Stop the channels
-	slackChannel.Stop()
-	apiChannel.Stop()
+	npcCore.StopAll()
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -0,0 +1,344 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dyluth/npc2/internal/fileutil"
+	"github.com/dyluth/npc2/npc"
+)
+
+// apiKeyPrefix starts every API key, so keys are easy to recognise in logs and secret scanners.
+const apiKeyPrefix = "npc_"
+
+// APIKey describes an API key. Only a salted hash of the key is kept; the key itself is shown
+// once, when it is created.
+type APIKey struct {
+	ID    string `json:"id"`   // Identifies this key among the rotations of its name
+	Name  string `json:"name"` // Shared by a key and the keys it was rotated into
+	Owner string `json:"owner"`
+	// Scopes are the actions the key may run, as names or globs such as "build.*". A key
+	// with no scopes may run any action.
+	Scopes   []string  `json:"scopes,omitempty"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"` // Zero if the key does not expire
+	Disabled bool      `json:"disabled,omitempty"`
+	Salt     string    `json:"salt"`
+	Hash     string    `json:"hash"` // Hex SHA-256 of the salt followed by the key's secret
+}
+
+// Active reports whether the key may be used at time now.
+func (k *APIKey) Active(now time.Time) bool {
+	return !k.Disabled && (k.Expires.IsZero() || now.Before(k.Expires))
+}
+
+// allows reports whether the key's scopes include an action.
+func (k *APIKey) allows(action string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range k.Scopes {
+		if ok, _ := path.Match(scope, action); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore keeps API keys in a JSON file. The keys' secrets are long and random, so a
+// single salted SHA-256 hash protects them; a slow password hash is not needed.
+//
+// The keys are read when the store is opened and again by Reload and Watch, so keys created,
+// rotated or disabled by another process, such as "npc2 apikey", take effect without a restart.
+// Changes are written to the file before they take effect, so a change that cannot be saved is
+// not made.
+type APIKeyStore struct {
+	path     string
+	mu       sync.RWMutex
+	keys     []*APIKey // Replaced, never changed in place, so copies stay valid
+	modified time.Time // Modification time of the file the keys were read from
+}
+
+// OpenAPIKeyStore opens the key store in the file at path, which is created when the first key
+// is added.
+func OpenAPIKeyStore(path string) (*APIKeyStore, error) {
+	store := &APIKeyStore{path: path}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Reload reads the keys file again. A missing file holds no keys. If the file cannot be read,
+// the current keys are kept and the error returned.
+func (s *APIKeyStore) Reload() error {
+	var keys []*APIKey
+	var modified time.Time
+	info, err := os.Stat(s.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("reading API keys: %w", err)
+	default:
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("reading API keys: %w", err)
+		}
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return fmt.Errorf("reading API keys from %s: %w", s.path, err)
+		}
+		modified = info.ModTime()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+	s.modified = modified
+	return nil
+}
+
+// Watch reloads the keys file whenever it changes, checking every interval until ctx is done.
+// Errors are logged and the current keys kept. Deleting the file removes every key.
+func (s *APIKeyStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var modified time.Time
+		info, err := os.Stat(s.path)
+		if err == nil {
+			modified = info.ModTime()
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to check API keys %s: %v", s.path, err)
+			continue
+		}
+		s.mu.RLock()
+		changed := !modified.Equal(s.modified)
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := s.Reload(); err != nil {
+			log.Printf("Failed to reload API keys, keeping the current ones: %v", err)
+			continue
+		}
+		log.Printf("Reloaded API keys %s", s.path)
+	}
+}
+
+// Create adds a key and returns its secret, which cannot be recovered later. A zero expires
+// means the key does not expire.
+func (s *APIKeyStore) Create(name, owner string, scopes []string, expires time.Time) (string, error) {
+	if name == "" || owner == "" {
+		return "", errors.New("API keys need a name and an owner")
+	}
+	for _, scope := range scopes {
+		if _, err := path.Match(scope, ""); err != nil {
+			return "", fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range s.keys {
+		if key.Name == name {
+			return "", fmt.Errorf("API key %s already exists; rotate it instead", name)
+		}
+	}
+	key := &APIKey{Name: name, Owner: owner, Scopes: scopes, Created: time.Now(), Expires: expires}
+	secret, err := issue(key)
+	if err != nil {
+		return "", err
+	}
+	return secret, s.write(append(s.copyKeys(), key))
+}
+
+// Rotate replaces the active keys with a name by a new key with the same owner, scopes and
+// expiry, returning its secret. The old keys stay valid for overlap, so clients can switch to
+// the new key without an outage.
+func (s *APIKeyStore) Rotate(name string, overlap time.Duration) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	keys := s.copyKeys()
+	var latest *APIKey
+	for _, key := range keys {
+		if key.Name == name && (latest == nil || key.Created.After(latest.Created)) {
+			latest = key
+		}
+	}
+	if latest == nil {
+		return "", npc.Errorf(npc.ErrNotFound, "API key %s not found", name)
+	}
+
+	key := &APIKey{Name: name, Owner: latest.Owner, Scopes: latest.Scopes, Created: now, Expires: latest.Expires}
+	for _, old := range keys {
+		if old.Name == name && old.Active(now) && (old.Expires.IsZero() || old.Expires.After(now.Add(overlap))) {
+			old.Expires = now.Add(overlap)
+		}
+	}
+	secret, err := issue(key)
+	if err != nil {
+		return "", err
+	}
+	return secret, s.write(append(keys, key))
+}
+
+// SetDisabled disables or re-enables every key with a name.
+func (s *APIKeyStore) SetDisabled(name string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := s.copyKeys()
+	found := false
+	for _, key := range keys {
+		if key.Name == name {
+			key.Disabled = disabled
+			found = true
+		}
+	}
+	if !found {
+		return npc.Errorf(npc.ErrNotFound, "API key %s not found", name)
+	}
+	return s.write(keys)
+}
+
+// Keys lists the keys, sorted by name and then creation.
+func (s *APIKeyStore) Keys() []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]APIKey, len(s.keys))
+	for i, key := range s.keys {
+		keys[i] = *key
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].Created.Before(keys[j].Created)
+	})
+	return keys
+}
+
+// Authenticate returns the active key matching a secret.
+func (s *APIKeyStore) Authenticate(secret string, now time.Time) (*APIKey, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(secret, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(secret, apiKeyPrefix) {
+		return nil, npc.Errorf(npc.ErrUnauthorized, "malformed API key")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.ID != id {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hashSecret(key.Salt, secret)), []byte(key.Hash)) != 1 {
+			break
+		}
+		if !key.Active(now) {
+			return nil, npc.Errorf(npc.ErrUnauthorized, "API key %s is disabled or has expired", key.Name)
+		}
+		found := *key
+		return &found, nil
+	}
+	return nil, npc.Errorf(npc.ErrUnauthorized, "unknown API key")
+}
+
+// active returns a copy of an active key with a name, or nil. Rotations of a key share its
+// scopes.
+func (s *APIKeyStore) active(name string, now time.Time) *APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.Name == name && key.Active(now) {
+			found := *key
+			return &found
+		}
+	}
+	return nil
+}
+
+// copyKeys returns copies of the keys, which can be changed without affecting readers of the
+// current ones. The caller must hold s.mu.
+func (s *APIKeyStore) copyKeys() []*APIKey {
+	keys := make([]*APIKey, len(s.keys))
+	for i, key := range s.keys {
+		copied := *key
+		keys[i] = &copied
+	}
+	return keys
+}
+
+// issue gives a new key an ID, salt and secret, returning the secret.
+func issue(key *APIKey) (string, error) {
+	id, err := randomHex(6)
+	if err != nil {
+		return "", err
+	}
+	random, err := randomHex(24)
+	if err != nil {
+		return "", err
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	secret := apiKeyPrefix + id + "_" + random
+	key.ID, key.Salt, key.Hash = id, salt, hashSecret(salt, secret)
+	return secret, nil
+}
+
+// write replaces the file with keys, without ever leaving it half written, and then makes them
+// the store's keys. If the file cannot be written the store's keys are left as they were. The
+// caller must hold s.mu.
+func (s *APIKeyStore) write(keys []*APIKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fileutil.WriteAtomic(s.path, data); err != nil {
+		return fmt.Errorf("writing API keys: %w", err)
+	}
+
+	s.keys = keys
+	if info, err := os.Stat(s.path); err == nil {
+		s.modified = info.ModTime()
+	}
+	return nil
+}
+
+// hashSecret returns the hex SHA-256 of a salt followed by a secret.
+func hashSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes in hex.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// TestAPIKeyStore tests creating keys, storing only their hashes, and authenticating with them.
+func TestAPIKeyStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	store, err := OpenAPIKeyStore(file)
+	if err != nil {
+		t.Fatalf("OpenAPIKeyStore failed: %v", err)
+	}
+	secret, err := store.Create("ci", "alice", []string{"build.*"}, time.Time{})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := store.Create("ci", "bob", nil, time.Time{}); err == nil {
+		t.Error("Expected an error creating a second key with the same name")
+	}
+
+	data, _ := os.ReadFile(file)
+	if strings.Contains(string(data), strings.SplitN(secret, "_", 3)[2]) {
+		t.Error("Expected the key's secret not to be stored")
+	}
+
+	// Keys survive reopening the store
+	store, err = OpenAPIKeyStore(file)
+	if err != nil {
+		t.Fatalf("OpenAPIKeyStore failed: %v", err)
+	}
+	key, err := store.Authenticate(secret, time.Now())
+	if err != nil || key.Name != "ci" || key.Owner != "alice" {
+		t.Fatalf("Expected the ci key, got %+v %v", key, err)
+	}
+	for _, wrong := range []string{secret + "x", "npc_unknown_secret", "not-a-key"} {
+		if _, err := store.Authenticate(wrong, time.Now()); !errors.Is(err, npc.ErrUnauthorized) {
+			t.Errorf("Expected %q to be refused, got %v", wrong, err)
+		}
+	}
+
+	store.SetDisabled("ci", true)
+	if _, err := store.Authenticate(secret, time.Now()); !errors.Is(err, npc.ErrUnauthorized) {
+		t.Errorf("Expected a disabled key to be refused, got %v", err)
+	}
+	store.SetDisabled("ci", false)
+
+	expiring, _ := store.Create("temp", "bob", nil, time.Now().Add(time.Hour))
+	if _, err := store.Authenticate(expiring, time.Now().Add(2*time.Hour)); !errors.Is(err, npc.ErrUnauthorized) {
+		t.Errorf("Expected an expired key to be refused, got %v", err)
+	}
+}
+
+// TestAPIKeyStoreRotate tests that a rotated key keeps working until the overlap ends.
+func TestAPIKeyStoreRotate(t *testing.T) {
+	store, _ := OpenAPIKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	old, _ := store.Create("ci", "alice", []string{"deploy"}, time.Time{})
+	rotated, err := store.Rotate("ci", time.Hour)
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+
+	now := time.Now()
+	for _, secret := range []string{old, rotated} {
+		if key, err := store.Authenticate(secret, now); err != nil || key.Owner != "alice" {
+			t.Errorf("Expected both keys to work during the overlap, got %+v %v", key, err)
+		}
+	}
+	later := now.Add(2 * time.Hour)
+	if _, err := store.Authenticate(old, later); err == nil {
+		t.Error("Expected the old key to stop working after the overlap")
+	}
+	if key, err := store.Authenticate(rotated, later); err != nil || key.Scopes[0] != "deploy" {
+		t.Errorf("Expected the new key to keep the scopes and keep working, got %+v %v", key, err)
+	}
+	if _, err := store.Rotate("missing", time.Hour); !errors.Is(err, npc.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound rotating a missing key, got %v", err)
+	}
+}
+
+// TestAPIKeyStoreWatch tests that keys changed by another process take effect without a restart.
+func TestAPIKeyStoreWatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	store, _ := OpenAPIKeyStore(file)
+	secret, _ := store.Create("ci", "alice", nil, time.Time{})
+	// Age the file, so the next write changes its modification time however coarse the clock
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(file, past, past)
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Watch(ctx, 5*time.Millisecond)
+
+	other, err := OpenAPIKeyStore(file)
+	if err != nil {
+		t.Fatalf("OpenAPIKeyStore failed: %v", err)
+	}
+	if err := other.SetDisabled("ci", true); err != nil {
+		t.Fatalf("SetDisabled failed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := store.Authenticate(secret, time.Now()); errors.Is(err, npc.ErrUnauthorized) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the disabled key to be refused")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestAPIKeyStoreWriteFailure tests that a change that cannot be saved is not made.
+func TestAPIKeyStoreWriteFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	os.Mkdir(dir, 0o700)
+	store, _ := OpenAPIKeyStore(filepath.Join(dir, "keys.json"))
+	secret, _ := store.Create("ci", "alice", nil, time.Time{})
+	os.RemoveAll(dir)
+
+	if _, err := store.Create("deploy", "bob", nil, time.Time{}); err == nil {
+		t.Error("Expected an error creating a key that cannot be saved")
+	}
+	if err := store.SetDisabled("ci", true); err == nil {
+		t.Error("Expected an error disabling a key when the change cannot be saved")
+	}
+	if _, err := store.Rotate("ci", 0); err == nil {
+		t.Error("Expected an error rotating a key when the change cannot be saved")
+	}
+	if keys := store.Keys(); len(keys) != 1 || keys[0].Disabled {
+		t.Errorf("Expected only the unchanged ci key, got %+v", keys)
+	}
+	if _, err := store.Authenticate(secret, time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("Expected the ci key to keep working, got %v", err)
+	}
+}
+
+// TestAuthMiddlewareKeys tests that requests authenticated by a key run as its owner, within its scopes.
+func TestAuthMiddlewareKeys(t *testing.T) {
+	store, _ := OpenAPIKeyStore(filepath.Join(t.TempDir(), "keys.json"))
+	secret, _ := store.Create("ci", "alice", []string{"build.*"}, time.Time{})
+	m := &AuthMiddleware{Keys: store}
+
+	request := npc.Request{Action: "build.start", AuthMethod: "apikey", AuthToken: secret, User: "spoofed"}
+	if err := m.Execute(&request); err != nil {
+		t.Fatalf("Expected the request to be allowed, got %v", err)
+	}
+	if request.User != "alice" || request.Credential != "ci" {
+		t.Errorf("Expected the request to run as alice with the ci key, got %s %s", request.User, request.Credential)
+	}
+	if err := m.Authorize(request, "deploy"); !errors.Is(err, npc.ErrForbidden) {
+		t.Errorf("Expected deploy to be outside the key's scopes, got %v", err)
+	}
+
+	request = npc.Request{Action: "deploy", AuthMethod: "apikey", AuthToken: secret}
+	if err := m.Execute(&request); !errors.Is(err, npc.ErrForbidden) {
+		t.Errorf("Expected ErrForbidden for an action outside the key's scopes, got %v", err)
+	}
+	request = npc.Request{Action: "build.start", AuthMethod: "apikey", AuthToken: "npc_0_wrong"}
+	if err := m.Execute(&request); !errors.Is(err, npc.ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized for a wrong key, got %v", err)
+	}
+}
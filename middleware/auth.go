@@ -1,20 +1,206 @@
 package middleware
 
 import (
-	"fmt"
+	"context"
+	"path"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/dyluth/npc2/npc"
 )
 
+// IdentityAnonymous is the identity of requests admitted by an AnonymousAuthenticator.
+const IdentityAnonymous = "anonymous"
+
+// IdentitySharedToken is the identity of requests authenticated by the shared API token. Every
+// holder of the token has it, as the token cannot tell them apart.
+const IdentitySharedToken = IdentityAPIKey + "shared"
+
+// Authenticator establishes who sent requests of one AuthMethod. On success it records the
+// caller on the request: its User, Identity and Strength, and its Credential if it has one.
+type Authenticator interface {
+	Authenticate(ctx context.Context, request *npc.Request) error
+}
+
 // AuthMiddleware is a middleware for authenticating requests.
+// Each request is passed to the Authenticator registered for its AuthMethod. Requests that
+// carry no AuthToken, or whose method has no authenticator, are passed to Anonymous instead,
+// and refused with npc.ErrUnauthorized if it is nil.
+//
+// Unless another is registered, "apikey" requests are authenticated by an APIKeyAuthenticator
+// using Token, Keys and Actions.
 type AuthMiddleware struct {
 	Token string
+	Keys  *APIKeyStore
+	// Actions, if set, resolves aliases so that scopes need only name actions.
+	Actions   ActionLookup
+	Anonymous Authenticator
+
+	mu             sync.RWMutex
+	authenticators map[string]Authenticator
+}
+
+// Register sets the authenticator for requests with an AuthMethod, such as "slack_user".
+func (m *AuthMiddleware) Register(method string, authenticator Authenticator) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.authenticators == nil {
+		m.authenticators = make(map[string]Authenticator)
+	}
+	m.authenticators[method] = authenticator
 }
 
 // Execute executes the authentication middleware.
 func (m *AuthMiddleware) Execute(request *npc.Request) error {
-	if request.AuthMethod == "apikey" && request.AuthToken == m.Token {
-		return nil // Authentication successful, continue to next middleware
+	return m.ExecuteContext(context.Background(), request)
+}
+
+// ExecuteContext authenticates the request with the authenticator for its method.
+func (m *AuthMiddleware) ExecuteContext(ctx context.Context, request *npc.Request) error {
+	authenticator := m.authenticator(*request)
+	if authenticator == nil {
+		return npc.ErrUnauthorized
+	}
+	return authenticator.Authenticate(ctx, request)
+}
+
+// Authorize lets the authenticator of a request limit the actions it may run, such as to an
+// API key's scopes, so that help lists only those actions.
+func (m *AuthMiddleware) Authorize(request npc.Request, action string) error {
+	if authorizer, ok := m.authenticator(request).(npc.Authorizer); ok {
+		return authorizer.Authorize(request, action)
+	}
+	return nil
+}
+
+// authenticator returns the authenticator for a request, or nil if there is none.
+func (m *AuthMiddleware) authenticator(request npc.Request) Authenticator {
+	if request.AuthToken != "" && request.Strength != npc.AuthAnonymous {
+		m.mu.RLock()
+		authenticator, ok := m.authenticators[request.AuthMethod]
+		m.mu.RUnlock()
+		if ok {
+			return authenticator
+		}
+		if request.AuthMethod == "apikey" {
+			return &APIKeyAuthenticator{Token: m.Token, Keys: m.Keys, Actions: m.Actions}
+		}
+	}
+	return m.Anonymous
+}
+
+// APIKeyAuthenticator authenticates requests with a shared Token, or with any active key in
+// Keys if it is set. A key's owner becomes the request's User and its name the request's
+// Credential, and the request may only run actions within the key's scopes. Requests with the
+// shared token keep the User they claim, but not as their identity, which is IdentitySharedToken.
+type APIKeyAuthenticator struct {
+	Token string
+	Keys  *APIKeyStore
+	// Actions, if set, resolves aliases so that scopes need only name actions.
+	Actions ActionLookup
+}
+
+// Authenticate checks the request's API key.
+func (a *APIKeyAuthenticator) Authenticate(ctx context.Context, request *npc.Request) error {
+	if a.Keys == nil {
+		if a.Token == "" || request.AuthToken != a.Token {
+			return npc.ErrUnauthorized
+		}
+		request.Identity = IdentitySharedToken
+		request.Strength = npc.AuthShared
+		return nil
+	}
+
+	key, err := a.Keys.Authenticate(request.AuthToken, time.Now())
+	if err != nil {
+		return err
+	}
+	request.User = key.Owner
+	request.Credential = key.Name
+	request.Identity = IdentityAPIKey + key.Name
+	request.Strength = npc.AuthVerified
+	if !key.allows(a.resolve(request.Action)) {
+		return npc.Errorf(npc.ErrForbidden, "API key %s may not run %s", key.Name, request.Action)
+	}
+	return nil
+}
+
+// Authorize reports whether a request authenticated by an API key may run an action.
+func (a *APIKeyAuthenticator) Authorize(request npc.Request, action string) error {
+	if a.Keys == nil || request.Credential == "" {
+		return nil
+	}
+	key := a.Keys.active(request.Credential, time.Now())
+	if key == nil || !key.allows(a.resolve(action)) {
+		return npc.Errorf(npc.ErrForbidden, "API key %s may not run %s", request.Credential, action)
+	}
+	return nil
+}
+
+// resolve returns the name of the action an alias stands for.
+func (a *APIKeyAuthenticator) resolve(action string) string {
+	if a.Actions != nil {
+		if registered, ok := a.Actions.Action(action); ok {
+			return registered.Name
+		}
+	}
+	return action
+}
+
+// SlackAuthenticator admits Slack users, whom Slack itself has authenticated. Workspaces and
+// Users, if set, limit it to those workspace (team) IDs and user IDs.
+type SlackAuthenticator struct {
+	Workspaces []string
+	Users      []string
+}
+
+// Authenticate checks the request's Slack workspace and user against the allowlists.
+func (a *SlackAuthenticator) Authenticate(ctx context.Context, request *npc.Request) error {
+	if request.User == "" {
+		return npc.ErrUnauthorized
+	}
+	if len(a.Workspaces) > 0 && !slices.Contains(a.Workspaces, request.Args[npc.TeamIDArg]) {
+		return npc.Errorf(npc.ErrUnauthorized, "requests from this Slack workspace are not accepted")
+	}
+	if len(a.Users) > 0 && !slices.Contains(a.Users, request.User) {
+		return npc.Errorf(npc.ErrForbidden, "%s is not allowed to use this bot", request.User)
+	}
+	request.Identity = IdentitySlack + request.User
+	request.Strength = npc.AuthVerified
+	return nil
+}
+
+// AnonymousAuthenticator admits requests from callers who have not identified themselves, but
+// only to run Actions, which may be globs such as "status.*". Limit, if set, rate limits them;
+// key it by source rather than user, as anonymous requests have no user.
+type AnonymousAuthenticator struct {
+	Actions []string
+	Limit   *RateLimitMiddleware
+}
+
+// Authenticate admits the request anonymously if its action is allowed.
+func (a *AnonymousAuthenticator) Authenticate(ctx context.Context, request *npc.Request) error {
+	request.User = ""
+	request.Credential = ""
+	request.Identity = IdentityAnonymous
+	request.Strength = npc.AuthAnonymous
+	if err := a.Authorize(*request, request.Action); err != nil {
+		return err
+	}
+	if a.Limit != nil {
+		return a.Limit.ExecuteContext(ctx, request)
+	}
+	return nil
+}
+
+// Authorize reports whether anonymous callers may run an action. They are told to authenticate
+// for anything else.
+func (a *AnonymousAuthenticator) Authorize(request npc.Request, action string) error {
+	for _, pattern := range a.Actions {
+		if ok, _ := path.Match(pattern, action); ok {
+			return nil
+		}
 	}
-	return fmt.Errorf("unauthorized")
+	return npc.Errorf(npc.ErrUnauthorized, "sign in to run %s", action)
 }
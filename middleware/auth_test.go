@@ -1,8 +1,11 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/dyluth/npc2/npc"
 )
@@ -48,3 +51,52 @@ func TestAuthMiddleware(t *testing.T) {
 		t.Errorf("Expected 'unauthorized' error, got %v", err)
 	}
 }
+
+// TestAuthMiddlewareAuthenticators tests that one middleware authenticates requests from every
+// source with the authenticator for their method, recording who sent them.
+func TestAuthMiddlewareAuthenticators(t *testing.T) {
+	m := &AuthMiddleware{Token: "test-token"}
+	m.Register("slack_user", &SlackAuthenticator{Workspaces: []string{"T1"}, Users: []string{"U1", "U2"}})
+	m.Anonymous = &AnonymousAuthenticator{
+		Actions: []string{"help", "status.*"},
+		Limit:   NewRateLimitMiddleware(RateLimit{Limit: 1, Window: time.Minute}, BySource),
+	}
+	ctx := context.Background()
+
+	slack := func(user, team, action string) npc.Request {
+		return npc.Request{Source: "Slack", AuthMethod: "slack_user", AuthToken: user, User: user, Action: action, Args: map[string]string{"team_id": team}}
+	}
+	tests := []struct {
+		name     string
+		request  npc.Request
+		want     error
+		identity string
+		strength npc.AuthStrength
+	}{
+		{"Slack users are verified", slack("U1", "T1", "deploy"), nil, "slack:U1", npc.AuthVerified},
+		{"other workspaces are refused", slack("U1", "T2", "deploy"), npc.ErrUnauthorized, "", npc.AuthNone},
+		{"users not allowed are forbidden", slack("U3", "T1", "deploy"), npc.ErrForbidden, "", npc.AuthNone},
+		{"the shared token is shared", npc.Request{Source: "API", AuthMethod: "apikey", AuthToken: "test-token", User: "ci"}, nil, IdentitySharedToken, npc.AuthShared},
+		{"a wrong token is not anonymous", npc.Request{Source: "API", AuthMethod: "apikey", AuthToken: "wrong", Action: "help"}, npc.ErrUnauthorized, "", npc.AuthNone},
+		{"no token is anonymous", npc.Request{Source: "API", AuthMethod: "apikey", User: "spoofed", Action: "status.api"}, nil, IdentityAnonymous, npc.AuthAnonymous},
+		{"anonymous requests are limited", npc.Request{Source: "API", AuthMethod: "apikey", Action: "help"}, npc.ErrRateLimited, IdentityAnonymous, npc.AuthAnonymous},
+		{"anonymous actions are limited", npc.Request{Source: "Webhook", AuthMethod: "none", Action: "deploy"}, npc.ErrUnauthorized, IdentityAnonymous, npc.AuthAnonymous},
+	}
+	for _, test := range tests {
+		err := m.ExecuteContext(ctx, &test.request)
+		if test.want == nil && err != nil || test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+		if test.request.Identity != test.identity || test.request.Strength != test.strength {
+			t.Errorf("%s: expected %s %s, got %s %s", test.name, test.identity, test.strength, test.request.Identity, test.request.Strength)
+		}
+	}
+
+	anonymous := npc.Request{Source: "API", AuthMethod: "apikey", Strength: npc.AuthAnonymous}
+	if err := m.Authorize(anonymous, "status.db"); err != nil {
+		t.Errorf("Expected anonymous callers to see status.db, got %v", err)
+	}
+	if err := m.Authorize(anonymous, "deploy"); !errors.Is(err, npc.ErrUnauthorized) {
+		t.Errorf("Expected anonymous callers not to see deploy, got %v", err)
+	}
+}
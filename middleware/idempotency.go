@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+	"github.com/dyluth/npc2/state"
+)
+
+// DefaultIdempotencyTTL is how long a request's idempotency key is remembered when no TTL is set.
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// IdempotencyMiddleware runs a request carrying an idempotency key (see npc.IdempotencyArg) at
+// most once. A retry with the same key from the same caller and source gets the response of the
+// first request again, or fails with npc.ErrBusy while the first is still running. Callers are
+// told apart by npc.Request.Caller, so a key belongs to the identity authentication verified
+// rather than the user a request claims. Reusing a key for another action fails with
+// npc.ErrInvalidArguments. Failed requests are forgotten, so they can be retried. Keys are kept
+// in a state.Store, so retries are caught whichever replica they reach.
+type IdempotencyMiddleware struct {
+	Store state.Store
+	TTL   time.Duration
+}
+
+// NewIdempotencyMiddleware creates an IdempotencyMiddleware keeping keys in store.
+func NewIdempotencyMiddleware(store state.Store) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{Store: store, TTL: DefaultIdempotencyTTL}
+}
+
+// idempotentResult is what is stored under an idempotency key.
+type idempotentResult struct {
+	Action  string          `json:"action"`
+	Done    bool            `json:"done"`
+	Data    string          `json:"data,omitempty"`
+	Code    int             `json:"code,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Blocks  []npc.Block     `json:"blocks,omitempty"`
+}
+
+// Handle runs a request unless one with the same idempotency key has already run.
+func (m *IdempotencyMiddleware) Handle(ctx context.Context, request npc.Request, next npc.Next) npc.Response {
+	id := request.Args[npc.IdempotencyArg]
+	if id == "" {
+		return next(ctx, request)
+	}
+	key := "idempotency:" + request.Source + ":" + request.Caller() + ":" + id
+
+	pending, _ := json.Marshal(idempotentResult{Action: request.Action})
+	claimed, err := m.Store.SetNX(ctx, key, pending, m.ttl())
+	if err != nil {
+		return npc.Response{Error: &npc.Error{Kind: npc.ErrInternal, Message: "checking idempotency key", Err: err}}
+	}
+	if !claimed {
+		return m.replay(ctx, key, request.Action)
+	}
+
+	response := next(ctx, request)
+
+	// The request's context may be done by now, but the outcome must still be recorded
+	ctx = context.WithoutCancel(ctx)
+	if response.Error != nil {
+		err = m.Store.Delete(ctx, key)
+	} else {
+		err = m.record(ctx, key, request.Action, response)
+	}
+	if err != nil {
+		log.Printf("Failed to record idempotency key %s: %v", key, err)
+	}
+	return response
+}
+
+// replay returns the response recorded under an idempotency key for action.
+func (m *IdempotencyMiddleware) replay(ctx context.Context, key, action string) npc.Response {
+	data, ok, err := m.Store.Get(ctx, key)
+	if err != nil {
+		return npc.Response{Error: &npc.Error{Kind: npc.ErrInternal, Message: "checking idempotency key", Err: err}}
+	}
+	var result idempotentResult
+	if ok {
+		if err := json.Unmarshal(data, &result); err != nil {
+			return npc.Response{Error: &npc.Error{Kind: npc.ErrInternal, Message: "reading idempotent response", Err: err}}
+		}
+	}
+	if ok && result.Action != action {
+		return npc.Response{Error: npc.Errorf(npc.ErrInvalidArguments, "idempotency key was used for another action")}
+	}
+	if !result.Done {
+		return npc.Response{Error: npc.Errorf(npc.ErrBusy, "a request with this idempotency key is still running")}
+	}
+
+	response := npc.Response{Data: result.Data, Code: result.Code, Blocks: result.Blocks}
+	if result.Payload != nil {
+		response.Payload = result.Payload
+	}
+	return response
+}
+
+// record stores a successful response under its idempotency key.
+func (m *IdempotencyMiddleware) record(ctx context.Context, key, action string, response npc.Response) error {
+	result := idempotentResult{Action: action, Done: true, Data: response.Data, Code: response.Code, Blocks: response.Blocks}
+	if response.Payload != nil {
+		payload, err := json.Marshal(response.Payload)
+		if err != nil {
+			return err
+		}
+		result.Payload = payload
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return m.Store.Set(ctx, key, data, m.ttl())
+}
+
+// ttl returns how long keys are remembered, applying the default.
+func (m *IdempotencyMiddleware) ttl() time.Duration {
+	if m.TTL <= 0 {
+		return DefaultIdempotencyTTL
+	}
+	return m.TTL
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/dyluth/npc2/npc"
+	"github.com/dyluth/npc2/state"
+)
+
+// TestIdempotencyMiddleware tests that a retried request is answered without running it again.
+func TestIdempotencyMiddleware(t *testing.T) {
+	m := NewIdempotencyMiddleware(state.NewMemory())
+	ctx := context.Background()
+
+	runs := 0
+	next := func(ctx context.Context, request npc.Request) npc.Response {
+		runs++
+		return npc.Response{Data: "deployed", Code: 200, Payload: map[string]int{"build": 7}}
+	}
+	request := npc.Request{Source: "API", User: "alice", Identity: "apikey:alice", Strength: npc.AuthVerified, Action: "deploy", Args: map[string]string{npc.IdempotencyArg: "abc"}}
+
+	first := m.Handle(ctx, request, next)
+	retry := m.Handle(ctx, request, next)
+	if runs != 1 {
+		t.Errorf("Expected the action to run once, ran %d times", runs)
+	}
+	payload, _ := retry.Payload.(json.RawMessage)
+	if retry.Data != first.Data || retry.Code != 200 || string(payload) != `{"build":7}` {
+		t.Errorf("Expected the first response to be replayed, got %+v", retry)
+	}
+
+	// Another caller's key is their own, whichever user they claim to be
+	other := request
+	other.Identity = "apikey:bob"
+	m.Handle(ctx, other, next)
+	if runs != 2 {
+		t.Errorf("Expected another caller's request to run, ran %d times", runs)
+	}
+
+	// A key cannot be reused for another action
+	reused := request
+	reused.Action = "rollback"
+	if response := m.Handle(ctx, reused, next); !errors.Is(response.Error, npc.ErrInvalidArguments) || runs != 2 {
+		t.Errorf("Expected ErrInvalidArguments for a key reused for another action, got %v after %d runs", response.Error, runs)
+	}
+}
+
+// TestIdempotencyMiddlewareFailure tests that failed requests can be retried and that a retry of
+// a running request is refused.
+func TestIdempotencyMiddlewareFailure(t *testing.T) {
+	m := NewIdempotencyMiddleware(state.NewMemory())
+	ctx := context.Background()
+	request := npc.Request{Source: "API", User: "alice", Args: map[string]string{npc.IdempotencyArg: "abc"}}
+
+	failing := func(ctx context.Context, request npc.Request) npc.Response {
+		return npc.Response{Error: npc.ErrTimeout}
+	}
+	m.Handle(ctx, request, failing)
+
+	var retried npc.Response
+	response := m.Handle(ctx, request, func(ctx context.Context, r npc.Request) npc.Response {
+		retried = m.Handle(ctx, request, failing)
+		return npc.Response{Data: "ok"}
+	})
+	if response.Data != "ok" {
+		t.Errorf("Expected a failed request to be run again, got %+v", response)
+	}
+	if !errors.Is(retried.Error, npc.ErrBusy) {
+		t.Errorf("Expected ErrBusy for a retry while running, got %v", retried.Error)
+	}
+}
+
+// TestIdempotencyMiddlewareDialog tests that a dialog started with an idempotency key can be
+// answered, and finished, by messages with keys of their own.
+func TestIdempotencyMiddlewareDialog(t *testing.T) {
+	core := npc.NewNpc()
+	core.Use(NewSessionMiddleware(npc.NewMemorySessionStore(), core))
+	core.Use(NewIdempotencyMiddleware(state.NewMemory()))
+	var ran npc.Request
+	core.RegisterAction(npc.Action{Name: "deploy", Handler: func(request npc.Request) npc.Response {
+		ran = request
+		return npc.Response{Data: "deployed " + request.Args["service"] + " to " + request.Args["env"]}
+	}})
+	err := core.RegisterDialog(npc.Dialog{
+		Name:   "wizard",
+		Action: "deploy",
+		Steps:  []npc.Step{{Param: npc.Param{Name: "service"}}, {Param: npc.Param{Name: "env"}}},
+	})
+	if err != nil {
+		t.Fatalf("RegisterDialog failed: %v", err)
+	}
+
+	message := func(action, key, addr string, args map[string]string) npc.Request {
+		args[npc.IdempotencyArg] = key
+		args[npc.RemoteAddrArg] = addr
+		return npc.Request{Source: "API", User: "alice", Identity: "apikey:ci", Strength: npc.AuthVerified, Action: action, Args: args}
+	}
+	if response := core.ProcessRequest(message("wizard", "k1", "192.0.2.1", map[string]string{"service": "api"})); response.Error != nil {
+		t.Fatalf("Expected the dialog to start, got %v", response.Error)
+	}
+	response := core.ProcessRequest(message("prod", "k2", "192.0.2.2", map[string]string{}))
+	if response.Error != nil || response.Data != "deployed api to prod" {
+		t.Fatalf("Expected the dialog to finish, got %+v", response)
+	}
+	if _, ok := ran.Args[npc.IdempotencyArg]; ok || ran.Args[npc.RemoteAddrArg] != "192.0.2.2" {
+		t.Errorf("Expected the action to run with the last message's address and no key, got %v", ran.Args)
+	}
+}
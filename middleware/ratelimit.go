@@ -0,0 +1,308 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+	"github.com/dyluth/npc2/state"
+)
+
+// Algorithm is how a rate limit counts requests.
+type Algorithm int
+
+const (
+	// TokenBucket allows bursts of up to Limit, refilling at Limit per Window.
+	TokenBucket Algorithm = iota
+	// SlidingWindow allows up to Limit in any Window. The count is estimated from the counts
+	// of the current and previous fixed windows, weighting the previous one by how much of it
+	// the sliding window still covers.
+	SlidingWindow
+)
+
+// RateLimit is how much may be spent, in requests or their cost, per Window.
+type RateLimit struct {
+	Algorithm Algorithm
+	Limit     int
+	Window    time.Duration
+}
+
+// Validate checks that the limit can be enforced: its Window must be positive and its Limit not
+// negative.
+func (l RateLimit) Validate() error {
+	if l.Window <= 0 {
+		return fmt.Errorf("rate limit window must be positive, not %s", l.Window)
+	}
+	if l.Limit < 0 {
+		return fmt.Errorf("rate limit must not be negative, not %d", l.Limit)
+	}
+	return nil
+}
+
+// KeyBy chooses which fields of a request it is counted by. Fields combine with |, so
+// ByUser|ByAction limits each user separately for each action.
+//
+// ByUser counts a request by the identity authentication verified for it. The User a request
+// claims is not trusted, and a shared token or no credentials cannot tell callers apart, so other
+// requests are counted by the address they came from, if their channel records it (see
+// npc.RemoteAddrArg), and otherwise all together.
+type KeyBy int
+
+const (
+	ByUser KeyBy = 1 << iota
+	BySource
+	ByAction
+	ByChannel
+)
+
+// RateLimitStore keeps the state of rate limits.
+type RateLimitStore interface {
+	// Take spends cost from the allowance of the limit under key at time now. If too little is
+	// left it spends nothing, reports false and returns how long until enough would be.
+	Take(ctx context.Context, key string, limit RateLimit, cost int, now time.Time) (ok bool, retryAfter time.Duration, err error)
+}
+
+// RateLimitMiddleware refuses requests that exceed a rate limit with an *npc.RateLimitError.
+type RateLimitMiddleware struct {
+	// Name is part of every key, to keep limits that share a store apart.
+	Name string
+	RateLimit
+	// Key is which request fields the limit is counted by, ByUser if zero.
+	Key KeyBy
+	// Costs weighs actions; actions not listed cost 1, and a cost of zero exempts an action.
+	Costs map[string]int
+	Store RateLimitStore
+	// Actions, if set, resolves aliases so that they share their action's cost and count.
+	Actions ActionLookup
+}
+
+// NewRateLimitMiddleware creates a RateLimitMiddleware keeping its counts in memory.
+func NewRateLimitMiddleware(limit RateLimit, key KeyBy) *RateLimitMiddleware {
+	return &RateLimitMiddleware{RateLimit: limit, Key: key, Store: NewMemoryRateLimitStore()}
+}
+
+// ExecuteContext spends the request's cost, refusing it if the limit has been reached. Every
+// request fails with npc.ErrInternal if the limit is invalid.
+func (m *RateLimitMiddleware) ExecuteContext(ctx context.Context, request *npc.Request) error {
+	if err := m.RateLimit.Validate(); err != nil {
+		return &npc.Error{Kind: npc.ErrInternal, Message: "rate limit is misconfigured", Err: err}
+	}
+	action := request.Action
+	if m.Actions != nil {
+		if registered, ok := m.Actions.Action(action); ok {
+			action = registered.Name
+		}
+	}
+	cost := m.cost(action)
+	if cost <= 0 {
+		return nil
+	}
+
+	ok, retryAfter, err := m.Store.Take(ctx, m.key(*request, action), m.RateLimit, cost, time.Now())
+	if err != nil {
+		return &npc.Error{Kind: npc.ErrInternal, Message: "checking rate limit", Err: err}
+	}
+	if !ok {
+		return &npc.RateLimitError{RetryAfter: retryAfter, Limit: m.Limit, Window: m.Window}
+	}
+	return nil
+}
+
+// cost returns the cost of an action.
+func (m *RateLimitMiddleware) cost(action string) int {
+	if cost, ok := m.Costs[action]; ok {
+		return cost
+	}
+	return 1
+}
+
+// key returns the key a request is counted under.
+func (m *RateLimitMiddleware) key(request npc.Request, action string) string {
+	by := m.Key
+	if by == 0 {
+		by = ByUser
+	}
+	parts := []string{"ratelimit", m.Name}
+	if by&ByUser != 0 {
+		parts = append(parts, request.Caller())
+	}
+	if by&BySource != 0 {
+		parts = append(parts, "source="+request.Source)
+	}
+	if by&ByAction != 0 {
+		parts = append(parts, "action="+action)
+	}
+	if by&ByChannel != 0 {
+		parts = append(parts, "channel="+request.ChannelID)
+	}
+	return strings.Join(parts, ":")
+}
+
+// SharedRateLimitStore keeps rate limits in a state.Store, such as state.Redis, so that every
+// replica counts against the same limits.
+type SharedRateLimitStore struct {
+	Store state.Store
+}
+
+// NewSharedRateLimitStore creates a SharedRateLimitStore keeping its counts in store.
+func NewSharedRateLimitStore(store state.Store) *SharedRateLimitStore {
+	return &SharedRateLimitStore{Store: store}
+}
+
+// Take spends cost from the limit under key. Limits expire from the store once they have fully
+// recovered.
+func (s *SharedRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, cost int, now time.Time) (bool, time.Duration, error) {
+	var allowed bool
+	var retryAfter time.Duration
+	err := s.Store.Update(ctx, key, 2*limit.Window, func(value []byte, ok bool) ([]byte, error) {
+		current := newRateState(limit, now)
+		if ok {
+			if err := json.Unmarshal(value, current); err != nil {
+				return nil, err
+			}
+		}
+		allowed, retryAfter = current.take(limit, cost, now)
+		return json.Marshal(current)
+	})
+	return allowed, retryAfter, err
+}
+
+// sweepInterval is how often the memory store forgets limits that have fully recovered.
+const sweepInterval = time.Minute
+
+// MemoryRateLimitStore keeps rate limits in memory. Counts are lost when the process exits and are
+// not shared between processes.
+type MemoryRateLimitStore struct {
+	mu     sync.Mutex
+	limits map[string]*rateState
+	swept  time.Time
+}
+
+// rateState is the state of one limit. It is stored as JSON by SharedRateLimitStore.
+type rateState struct {
+	Tokens   float64       `json:"tokens"`             // Tokens left, for TokenBucket
+	Start    time.Time     `json:"start"`              // Start of the current window, for SlidingWindow
+	Current  int           `json:"current,omitempty"`  // Spent in the current window
+	Previous int           `json:"previous,omitempty"` // Spent in the previous window
+	Updated  time.Time     `json:"updated"`
+	Window   time.Duration `json:"window"`
+}
+
+// newRateState returns the state of a limit nothing has been spent from.
+func newRateState(limit RateLimit, now time.Time) *rateState {
+	return &rateState{Tokens: float64(limit.Limit), Start: now.Truncate(limit.Window), Updated: now}
+}
+
+// NewMemoryRateLimitStore creates an empty MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{limits: make(map[string]*rateState)}
+}
+
+// Take spends cost from the limit under key.
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, cost int, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.swept) >= sweepInterval {
+		s.sweep(now)
+	}
+	current, ok := s.limits[key]
+	if !ok {
+		current = newRateState(limit, now)
+		s.limits[key] = current
+	}
+	allowed, retryAfter := current.take(limit, cost, now)
+	return allowed, retryAfter, nil
+}
+
+// take spends cost from the limit if enough is left, and if not returns how long until it would be.
+func (rs *rateState) take(limit RateLimit, cost int, now time.Time) (bool, time.Duration) {
+	rs.Window = limit.Window
+	var allowed bool
+	var retryAfter time.Duration
+	switch limit.Algorithm {
+	case SlidingWindow:
+		rs.Start, rs.Previous, rs.Current = advanceWindow(rs.Start, rs.Previous, rs.Current, limit.Window, now)
+		allowed, retryAfter = slidingWindow(rs.Previous, rs.Current, now.Sub(rs.Start), limit, cost)
+		if allowed {
+			rs.Current += cost
+		}
+	default:
+		rs.Tokens = refill(rs.Tokens, now.Sub(rs.Updated), limit)
+		allowed, retryAfter = tokenBucket(rs.Tokens, limit, cost)
+		if allowed {
+			rs.Tokens -= float64(cost)
+		}
+	}
+	rs.Updated = now
+	return allowed, retryAfter
+}
+
+// sweep forgets limits untouched for long enough to have fully recovered. The caller must hold s.mu.
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, current := range s.limits {
+		if now.Sub(current.Updated) > 2*current.Window {
+			delete(s.limits, key)
+		}
+	}
+	s.swept = now
+}
+
+// refill adds the tokens earned over elapsed to a bucket, up to the limit.
+func refill(tokens float64, elapsed time.Duration, limit RateLimit) float64 {
+	earned := float64(limit.Limit) * float64(elapsed) / float64(limit.Window)
+	return math.Min(float64(limit.Limit), tokens+earned)
+}
+
+// tokenBucket reports whether a bucket holding tokens can pay cost, and if not how long until
+// it can. A cost above the limit can never be paid, so is told to wait a whole window.
+func tokenBucket(tokens float64, limit RateLimit, cost int) (bool, time.Duration) {
+	if float64(cost) <= tokens {
+		return true, 0
+	}
+	if cost > limit.Limit {
+		return false, limit.Window
+	}
+	missing := float64(cost) - tokens
+	return false, time.Duration(missing * float64(limit.Window) / float64(limit.Limit))
+}
+
+// advanceWindow moves a sliding window's fixed windows on to the one containing now.
+func advanceWindow(start time.Time, previous, current int, window time.Duration, now time.Time) (time.Time, int, int) {
+	periods := now.Sub(start) / window
+	switch {
+	case periods <= 0:
+		return start, previous, current
+	case periods == 1:
+		return start.Add(window), current, 0
+	default:
+		return start.Add(periods * window), 0, 0
+	}
+}
+
+// slidingWindow reports whether cost fits in a sliding window given the amounts spent in the
+// previous and current fixed windows and how far into the current one it is, and if not how
+// long until it would.
+func slidingWindow(previous, current int, elapsed time.Duration, limit RateLimit, cost int) (bool, time.Duration) {
+	w := float64(limit.Window)
+	covered := 1 - float64(elapsed)/w // Share of the previous window still in the sliding window
+	if float64(previous)*covered+float64(current+cost) <= float64(limit.Limit) {
+		return true, 0
+	}
+	if cost > limit.Limit {
+		return false, limit.Window
+	}
+
+	// Wait for enough of the previous window to slide out
+	if spare := limit.Limit - current - cost; spare >= 0 {
+		return false, time.Duration(w*(1-float64(spare)/float64(previous))) - elapsed
+	}
+	// Wait for the next window, where the current one becomes the previous
+	wait := limit.Window - elapsed
+	return false, wait + time.Duration(w*(1-float64(limit.Limit-cost)/float64(current)))
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+	"github.com/dyluth/npc2/state"
+)
+
+// TestMemoryRateLimitStoreTokenBucket tests that a token bucket allows bursts and refills over time.
+func TestMemoryRateLimitStoreTokenBucket(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Algorithm: TokenBucket, Limit: 3, Window: 3 * time.Second}
+	now := time.Now()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := store.Take(ctx, "k", limit, 1, now); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	ok, retryAfter, _ := store.Take(ctx, "k", limit, 1, now)
+	if ok || retryAfter != time.Second {
+		t.Errorf("Expected to be refused for 1s, got %v %s", ok, retryAfter)
+	}
+	if ok, _, _ := store.Take(ctx, "other", limit, 1, now); !ok {
+		t.Error("Expected another key to have its own bucket")
+	}
+
+	if ok, _, _ := store.Take(ctx, "k", limit, 1, now.Add(time.Second)); !ok {
+		t.Error("Expected a token to have been refilled after 1s")
+	}
+	ok, retryAfter, _ = store.Take(ctx, "k", limit, 2, now.Add(2*time.Second))
+	if ok || retryAfter != time.Second {
+		t.Errorf("Expected a cost of 2 to wait for a second token, got %v %s", ok, retryAfter)
+	}
+}
+
+// TestMemoryRateLimitStoreSlidingWindow tests that a sliding window counts the previous window
+// in proportion to how much of it the sliding window still covers.
+func TestMemoryRateLimitStoreSlidingWindow(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	limit := RateLimit{Algorithm: SlidingWindow, Limit: 4, Window: time.Minute}
+	start := time.Now().Truncate(time.Minute)
+	ctx := context.Background()
+
+	if ok, _, _ := store.Take(ctx, "k", limit, 4, start.Add(30*time.Second)); !ok {
+		t.Fatal("Expected the first requests to be allowed")
+	}
+	ok, retryAfter, _ := store.Take(ctx, "k", limit, 1, start.Add(45*time.Second))
+	if ok || retryAfter != 30*time.Second {
+		t.Errorf("Expected to be refused for 30s, got %v %s", ok, retryAfter)
+	}
+
+	// Halfway through the next window, half of the previous one's 4 still count
+	at := start.Add(90 * time.Second)
+	if ok, _, _ := store.Take(ctx, "k", limit, 2, at); !ok {
+		t.Error("Expected 2 to fit beside the 2 still counted")
+	}
+	ok, retryAfter, _ = store.Take(ctx, "k", limit, 1, at)
+	if ok || retryAfter != 15*time.Second {
+		t.Errorf("Expected to wait 15s for another of the previous window to slide out, got %v %s", ok, retryAfter)
+	}
+}
+
+// TestRateLimitMiddleware tests keys, costs and the error returned for refused requests.
+func TestRateLimitMiddleware(t *testing.T) {
+	m := NewRateLimitMiddleware(RateLimit{Limit: 2, Window: time.Minute}, ByUser|ByAction)
+	m.Costs = map[string]int{"deploy": 2, "help": 0}
+	ctx := context.Background()
+
+	deploy := npc.Request{User: "U1", Identity: "slack:U1", Strength: npc.AuthVerified, Action: "deploy"}
+	if err := m.ExecuteContext(ctx, &deploy); err != nil {
+		t.Fatalf("Expected the first deploy to be allowed, got %v", err)
+	}
+	err := m.ExecuteContext(ctx, &deploy)
+	var limited *npc.RateLimitError
+	if !errors.As(err, &limited) || !errors.Is(err, npc.ErrRateLimited) || limited.RetryAfter <= 0 {
+		t.Fatalf("Expected a rate limit error with a retry time, got %v", err)
+	}
+
+	for _, request := range []npc.Request{
+		{User: "U2", Identity: "slack:U2", Strength: npc.AuthVerified, Action: "deploy"},
+		{User: "U1", Identity: "slack:U1", Strength: npc.AuthVerified, Action: "status"},
+		{User: "U1", Identity: "slack:U1", Strength: npc.AuthVerified, Action: "help"},
+		{User: "U1", Identity: "slack:U1", Strength: npc.AuthVerified, Action: "help"},
+		{User: "U1", Identity: "slack:U1", Strength: npc.AuthVerified, Action: "help"},
+	} {
+		if err := m.ExecuteContext(ctx, &request); err != nil {
+			t.Errorf("Expected %s by %s to be allowed, got %v", request.Action, request.User, err)
+		}
+	}
+
+	// Callers sharing a token are counted by address, whatever user they claim
+	shared := func(user, addr string) npc.Request {
+		return npc.Request{User: user, Identity: "apikey:shared", Strength: npc.AuthShared, Action: "deploy",
+			Args: map[string]string{npc.RemoteAddrArg: addr}}
+	}
+	for _, request := range []npc.Request{shared("a", "10.0.0.1"), shared("b", "10.0.0.2")} {
+		if err := m.ExecuteContext(ctx, &request); err != nil {
+			t.Errorf("Expected a deploy from %s to be allowed, got %v", request.Args[npc.RemoteAddrArg], err)
+		}
+	}
+	if request := shared("c", "10.0.0.1"); !errors.Is(m.ExecuteContext(ctx, &request), npc.ErrRateLimited) {
+		t.Error("Expected a new claimed user not to get a new allowance")
+	}
+}
+
+// TestRateLimitMiddlewareInvalid tests that a limit that cannot be enforced is reported rather
+// than dividing by zero.
+func TestRateLimitMiddlewareInvalid(t *testing.T) {
+	for _, limit := range []RateLimit{{Limit: 10}, {Algorithm: SlidingWindow, Limit: 10}, {Limit: -1, Window: time.Minute}} {
+		m := NewRateLimitMiddleware(limit, ByUser)
+		request := npc.Request{Action: "deploy"}
+		if err := m.ExecuteContext(context.Background(), &request); !errors.Is(err, npc.ErrInternal) {
+			t.Errorf("Expected ErrInternal for %+v, got %v", limit, err)
+		}
+	}
+}
+
+// TestSharedRateLimitStore tests that stores sharing state count against the same limit.
+func TestSharedRateLimitStore(t *testing.T) {
+	shared := state.NewMemory()
+	first, second := NewSharedRateLimitStore(shared), NewSharedRateLimitStore(shared)
+	limit := RateLimit{Algorithm: TokenBucket, Limit: 2, Window: time.Minute}
+	now := time.Now()
+	ctx := context.Background()
+
+	for _, store := range []*SharedRateLimitStore{first, second} {
+		if ok, _, err := store.Take(ctx, "k", limit, 1, now); !ok || err != nil {
+			t.Fatalf("Expected a request to be allowed, got %v %v", ok, err)
+		}
+	}
+	ok, retryAfter, _ := first.Take(ctx, "k", limit, 1, now)
+	if ok || retryAfter != 30*time.Second {
+		t.Errorf("Expected the shared bucket to be empty for 30s, got %v %s", ok, retryAfter)
+	}
+}
@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// Identity prefixes used in RBAC policies. An identity is a prefix followed by a name, such as
+// "slack:U012AB3CD" or "apikey:ci".
+const (
+	IdentityAPIKey     = "apikey:"     // An API key's name
+	IdentitySlack      = "slack:"      // A Slack user ID
+	IdentitySlackGroup = "slackgroup:" // A Slack user group ID or handle
+	// Everyone is an identity of every request not admitted anonymously, to grant roles to all.
+	Everyone = "*"
+)
+
+// Policy maps identities to roles, and roles to the actions they may run.
+type Policy struct {
+	// Roles lists what each role grants.
+	Roles map[string][]Grant `json:"roles"`
+	// Members lists the roles of each identity.
+	Members map[string][]string `json:"members"`
+}
+
+// Grant allows actions whose names match any of Actions, which may be globs such as "build.*".
+// Sources and ChannelIDs, if set, limit the grant to requests from those sources and channels.
+type Grant struct {
+	Actions    []string `json:"actions"`
+	Sources    []string `json:"sources,omitempty"`
+	ChannelIDs []string `json:"channel_ids,omitempty"`
+}
+
+// GroupResolver finds the groups a user of a source belongs to. The Slack channel implements it.
+type GroupResolver interface {
+	UserGroups(ctx context.Context, user string) ([]string, error)
+}
+
+// LoadPolicy reads a policy from a JSON file.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy: %w", err)
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("reading policy from %s: %w", file, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", file, err)
+	}
+	return &policy, nil
+}
+
+// Validate checks that every member's roles exist and every action glob is well formed.
+func (p *Policy) Validate() error {
+	for identity, roles := range p.Members {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return fmt.Errorf("%s has unknown role %s", identity, role)
+			}
+		}
+	}
+	for role, grants := range p.Roles {
+		for _, grant := range grants {
+			for _, pattern := range grant.Actions {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("role %s: invalid action pattern %q", role, pattern)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether any of the roles grants a request the action.
+func (p *Policy) allows(roles []string, request npc.Request, action string) bool {
+	for _, role := range roles {
+		for _, grant := range p.Roles[role] {
+			if grant.allows(request, action) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allows reports whether the grant covers a request for the action.
+func (g Grant) allows(request npc.Request, action string) bool {
+	if len(g.Sources) > 0 && !slices.Contains(g.Sources, request.Source) {
+		return false
+	}
+	if len(g.ChannelIDs) > 0 && !slices.Contains(g.ChannelIDs, request.ChannelID) {
+		return false
+	}
+	for _, pattern := range g.Actions {
+		if ok, _ := path.Match(pattern, action); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RBACMiddleware allows each request only the actions its identity's roles grant. Requests
+// that authentication gave no identity are refused with npc.ErrUnauthorized. So are anonymous
+// requests for actions they are not granted, while other requests for such actions are refused
+// with npc.ErrForbidden. Anonymous requests have only the roles of IdentityAnonymous. It is also
+// an npc.Authorizer, so help lists only the actions a caller may run.
+type RBACMiddleware struct {
+	// Groups, if set, finds the Slack user groups of Slack users.
+	Groups GroupResolver
+	// Actions, if set, resolves aliases so that policies need only name actions.
+	Actions ActionLookup
+
+	mu       sync.RWMutex
+	policy   *Policy
+	file     string
+	modified time.Time
+}
+
+// NewRBACMiddleware creates an RBACMiddleware enforcing a policy.
+func NewRBACMiddleware(policy *Policy) (*RBACMiddleware, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &RBACMiddleware{policy: policy}, nil
+}
+
+// LoadRBACMiddleware creates an RBACMiddleware enforcing the policy in a JSON file, which
+// Reload and Watch read again.
+func LoadRBACMiddleware(file string) (*RBACMiddleware, error) {
+	m := &RBACMiddleware{file: file}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetPolicy replaces the policy.
+func (m *RBACMiddleware) SetPolicy(policy *Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policy = policy
+	return nil
+}
+
+// Reload reads the policy file again. If it cannot be read or is invalid, the current policy
+// is kept and the error returned.
+func (m *RBACMiddleware) Reload() error {
+	info, err := os.Stat(m.file)
+	if err != nil {
+		return fmt.Errorf("reading policy: %w", err)
+	}
+	policy, err := LoadPolicy(m.file)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policy = policy
+	m.modified = info.ModTime()
+	return nil
+}
+
+// Watch reloads the policy file whenever it changes, checking every interval until ctx is done.
+// Errors are logged and the current policy kept.
+func (m *RBACMiddleware) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(m.file)
+		if err != nil {
+			log.Printf("Failed to check policy %s: %v", m.file, err)
+			continue
+		}
+		m.mu.RLock()
+		changed := !info.ModTime().Equal(m.modified)
+		m.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := m.Reload(); err != nil {
+			log.Printf("Failed to reload policy, keeping the current one: %v", err)
+			continue
+		}
+		log.Printf("Reloaded policy %s", m.file)
+	}
+}
+
+// ExecuteContext refuses requests for actions the caller's roles do not grant.
+func (m *RBACMiddleware) ExecuteContext(ctx context.Context, request *npc.Request) error {
+	return m.authorize(ctx, *request, request.Action)
+}
+
+// Authorize reports whether a request may run an action.
+func (m *RBACMiddleware) Authorize(request npc.Request, action string) error {
+	return m.authorize(context.Background(), request, action)
+}
+
+// authorize checks the caller's roles for an action.
+func (m *RBACMiddleware) authorize(ctx context.Context, request npc.Request, action string) error {
+	if request.Identity == "" {
+		return npc.ErrUnauthorized
+	}
+	if m.Actions != nil {
+		if registered, ok := m.Actions.Action(action); ok {
+			action = registered.Name
+		}
+	}
+
+	m.mu.RLock()
+	policy := m.policy
+	m.mu.RUnlock()
+
+	var roles []string
+	for _, identity := range m.identities(ctx, request) {
+		roles = append(roles, policy.Members[identity]...)
+	}
+	if policy.allows(roles, request, action) {
+		return nil
+	}
+	if request.Strength == npc.AuthAnonymous {
+		return npc.Errorf(npc.ErrUnauthorized, "sign in to run %s", action)
+	}
+	who := request.User
+	if who == "" {
+		who = request.Identity
+	}
+	return npc.Errorf(npc.ErrForbidden, "%s may not run %s", who, action)
+}
+
+// identities returns the identities of a request's caller: the Identity authentication found,
+// along with Everyone and any Slack user groups. The User a request claims is not trusted, so a
+// request authentication found no identity for has none.
+func (m *RBACMiddleware) identities(ctx context.Context, request npc.Request) []string {
+	identity := request.Identity
+
+	var identities []string
+	if request.Strength != npc.AuthAnonymous {
+		identities = append(identities, Everyone)
+	}
+	if identity != "" {
+		identities = append(identities, identity)
+	}
+	if strings.HasPrefix(identity, IdentitySlack) && m.Groups != nil {
+		user := strings.TrimPrefix(identity, IdentitySlack)
+		groups, err := m.Groups.UserGroups(ctx, user)
+		if err != nil {
+			log.Printf("Failed to find the groups of %s: %v", user, err)
+		}
+		for _, group := range groups {
+			identities = append(identities, IdentitySlackGroup+group)
+		}
+	}
+	return identities
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// testPolicy lets everyone ask for help, deployers deploy from one Slack channel, and admins
+// run anything.
+const testPolicy = `{
+	"roles": {
+		"viewer": [{"actions": ["help", "build.*"]}],
+		"deployer": [{"actions": ["deploy"], "sources": ["Slack"], "channel_ids": ["C-deploys"]}],
+		"admin": [{"actions": ["*"]}]
+	},
+	"members": {
+		"*": ["viewer"],
+		"slack:U-dev": ["deployer"],
+		"slackgroup:S-ops": ["admin"],
+		"apikey:ci": ["deployer", "admin"]
+	}
+}`
+
+// fakeGroups resolves user groups from a map.
+type fakeGroups map[string][]string
+
+// UserGroups returns the user's groups.
+func (g fakeGroups) UserGroups(ctx context.Context, user string) ([]string, error) {
+	return g[user], nil
+}
+
+// writePolicy writes a policy file, giving it a modification time of mod.
+func writePolicy(t *testing.T, file, policy string, mod time.Time) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(policy), 0o600); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	os.Chtimes(file, mod, mod)
+}
+
+// TestRBACMiddleware tests that requests are allowed only what their identities' roles grant.
+func TestRBACMiddleware(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	writePolicy(t, file, testPolicy, time.Now())
+	m, err := LoadRBACMiddleware(file)
+	if err != nil {
+		t.Fatalf("LoadRBACMiddleware failed: %v", err)
+	}
+	m.Groups = fakeGroups{"U-oncall": {"S-ops"}}
+
+	slack := func(user, channel, action string) npc.Request {
+		return npc.Request{Source: "Slack", AuthMethod: "slack_user", User: user, Identity: IdentitySlack + user, Strength: npc.AuthVerified, ChannelID: channel, Action: action}
+	}
+	tests := []struct {
+		name    string
+		request npc.Request
+		want    error
+	}{
+		{"everyone may ask for help", slack("U-anyone", "C1", "help"), nil},
+		{"globs match", slack("U-anyone", "C1", "build.status"), nil},
+		{"ungranted actions are forbidden", slack("U-anyone", "C1", "deploy"), npc.ErrForbidden},
+		{"grants apply in their channel", slack("U-dev", "C-deploys", "deploy"), nil},
+		{"grants do not apply elsewhere", slack("U-dev", "C1", "deploy"), npc.ErrForbidden},
+		{"groups have roles", slack("U-oncall", "C1", "restart"), nil},
+		{"API keys have roles", npc.Request{Source: "API", AuthMethod: "apikey", Identity: "apikey:ci", Action: "restart"}, nil},
+		{"API keys are not Slack users", npc.Request{Source: "API", AuthMethod: "apikey", Identity: "apikey:U-oncall", Action: "restart"}, npc.ErrForbidden},
+		{"claimed users have no roles", npc.Request{Source: "API", AuthMethod: "apikey", User: "ci", Action: "help"}, npc.ErrUnauthorized},
+		{"claimed Slack users have no roles", npc.Request{Source: "Slack", AuthMethod: "slack_user", User: "U-dev", ChannelID: "C-deploys", Action: "deploy"}, npc.ErrUnauthorized},
+		{"anonymous requests are unauthorized", npc.Request{Source: "API", Action: "help"}, npc.ErrUnauthorized},
+	}
+	for _, test := range tests {
+		err := m.ExecuteContext(context.Background(), &test.request)
+		if test.want == nil && err != nil || test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.want, err)
+		}
+	}
+
+	// Help lists only what the caller may run
+	core := npc.NewNpc()
+	core.Use(m)
+	for _, name := range []string{"deploy", "build.status"} {
+		core.RegisterAction(npc.Action{Name: name, Handler: func(npc.Request) npc.Response { return npc.Response{} }})
+	}
+	var names []string
+	for _, info := range core.Catalogue(slack("U-anyone", "C1", "help")) {
+		names = append(names, info.Name)
+	}
+	if len(names) != 2 || names[0] != "build.status" || names[1] != "help" {
+		t.Errorf("Expected the catalogue to hide deploy, got %v", names)
+	}
+}
+
+// TestRBACMiddlewareTriggers tests that free text which fires a trigger is authorized, and seen by
+// later middleware, as a request for the trigger's action.
+func TestRBACMiddlewareTriggers(t *testing.T) {
+	m, err := NewRBACMiddleware(&Policy{
+		Roles:   map[string][]Grant{"builder": {{Actions: []string{"build.*"}}}},
+		Members: map[string][]string{"slack:U-dev": {"builder"}},
+	})
+	if err != nil {
+		t.Fatalf("NewRBACMiddleware failed: %v", err)
+	}
+	auth := &AuthMiddleware{}
+	auth.Register("slack_user", &SlackAuthenticator{})
+
+	core := npc.NewNpc()
+	core.Use(auth)
+	core.Use(m)
+	var audited []string
+	core.Use(npc.WrapFunc(func(ctx context.Context, request npc.Request, next npc.Next) npc.Response {
+		audited = append(audited, request.Action)
+		return next(ctx, request)
+	}))
+	core.RegisterAction(npc.Action{
+		Name:     "build.status",
+		Triggers: []npc.Trigger{{Pattern: `status of build (?P<id>\d+)`}},
+		Handler: func(request npc.Request) npc.Response {
+			return npc.Response{Data: "build " + request.Args["id"] + " passed"}
+		},
+	})
+
+	message := func(user string) npc.Request {
+		text := "what's the status of build 7?"
+		return npc.Request{Action: "what's", Text: text, Source: "Slack", AuthMethod: "slack_user", AuthToken: user, User: user}
+	}
+	if response := core.ProcessRequest(message("U-dev")); response.Data != "build 7 passed" {
+		t.Errorf("Expected the trigger to fire for a builder, got %+v", response)
+	}
+	if response := core.ProcessRequest(message("U-anyone")); !errors.Is(response.Error, npc.ErrForbidden) {
+		t.Errorf("Expected the trigger's action to be forbidden to others, got %+v", response)
+	}
+	if len(audited) != 1 || audited[0] != "build.status" {
+		t.Errorf("Expected later middleware to see build.status, got %v", audited)
+	}
+}
+
+// TestRBACMiddlewareReload tests that a changed policy file is picked up without a restart, and
+// that an invalid one is ignored.
+func TestRBACMiddlewareReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.json")
+	start := time.Now().Add(-time.Hour)
+	writePolicy(t, file, testPolicy, start)
+	m, err := LoadRBACMiddleware(file)
+	if err != nil {
+		t.Fatalf("LoadRBACMiddleware failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Watch(ctx, 5*time.Millisecond)
+
+	request := npc.Request{Source: "API", AuthMethod: "apikey", Identity: "apikey:reporter", Action: "report"}
+	if err := m.ExecuteContext(ctx, &request); !errors.Is(err, npc.ErrForbidden) {
+		t.Fatalf("Expected report to be forbidden at first, got %v", err)
+	}
+
+	writePolicy(t, file, `{"roles": {"reporter": [{"actions": ["report"]}]}, "members": {"apikey:reporter": ["reporter"]}}`, start.Add(time.Minute))
+	deadline := time.Now().Add(time.Second)
+	for m.ExecuteContext(ctx, &request) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the policy to be reloaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	writePolicy(t, file, `{"members": {"apikey:reporter": ["missing"]}}`, start.Add(2*time.Minute))
+	if err := m.Reload(); err == nil {
+		t.Error("Expected an error reloading a policy with an unknown role")
+	}
+	if err := m.ExecuteContext(ctx, &request); err != nil {
+		t.Errorf("Expected the last good policy to be kept, got %v", err)
+	}
+}
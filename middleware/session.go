@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// DefaultSessionTTL is how long a session lasts after its last request when no TTL is set.
+const DefaultSessionTTL = 30 * time.Minute
+
+// ActionLookup finds registered actions. *npc.Npc implements it.
+type ActionLookup interface {
+	Action(name string) (npc.Action, bool)
+}
+
+// SessionMiddleware loads the session of each request's conversation into the request context,
+// where handlers reach it with npc.SessionFrom, and saves it when the request finishes.
+// If the session is waiting for a follow-up message (see npc.Session.Await) and the request is
+// not a command, or is one of the commands the session captures, Route sends the request to the
+// waiting action before any middleware runs, and the wait ends when the request reaches it.
+type SessionMiddleware struct {
+	Store   npc.SessionStore
+	Actions ActionLookup
+	TTL     time.Duration
+}
+
+// NewSessionMiddleware creates a SessionMiddleware keeping sessions in store. Actions is used to
+// tell commands apart from follow-up messages.
+func NewSessionMiddleware(store npc.SessionStore, actions ActionLookup) *SessionMiddleware {
+	return &SessionMiddleware{Store: store, Actions: actions, TTL: DefaultSessionTTL}
+}
+
+// Handle runs the request with its session and saves any changes. A request made while handling
+// another in the same conversation, such as the action a dialog runs when it finishes, shares
+// that request's session, which is saved when it finishes.
+func (m *SessionMiddleware) Handle(ctx context.Context, request npc.Request, next npc.Next) npc.Response {
+	key := request.SessionKey()
+	if session := npc.SessionFrom(ctx); session != nil && session.Key == key {
+		return next(ctx, request)
+	}
+	session, err := m.Store.Load(ctx, key)
+	if err != nil {
+		return npc.Response{Error: &npc.Error{Kind: npc.ErrInternal, Message: "loading session", Err: err}}
+	}
+	if session == nil {
+		session = npc.NewSession(key)
+	}
+	existed := !session.Empty()
+
+	if _, reply := request.Args[npc.ReplyArg]; reply && session.Pending != "" && request.Action == session.Pending {
+		session.Await("")
+	}
+
+	response := next(npc.WithSession(ctx, session), request)
+
+	// The request's context may be done by now, but the session must still be saved
+	ctx = context.WithoutCancel(ctx)
+	if session.Empty() {
+		if existed {
+			err = m.Store.Delete(ctx, key)
+		}
+	} else {
+		session.Expires = time.Now().Add(m.ttl())
+		err = m.Store.Save(ctx, session)
+	}
+	if err != nil {
+		log.Printf("Failed to save session %s: %v", key, err)
+	}
+	return response
+}
+
+// Route sends a follow-up message to the action its conversation is waiting for.
+func (m *SessionMiddleware) Route(ctx context.Context, request *npc.Request) error {
+	session, err := m.Store.Load(ctx, request.SessionKey())
+	if err != nil {
+		return &npc.Error{Kind: npc.ErrInternal, Message: "loading session", Err: err}
+	}
+	if session != nil && session.Pending != "" && (!m.isCommand(request.Action) || slices.Contains(session.Capture, request.Action)) {
+		*request = followUp(*request, session.Pending)
+	}
+	return nil
+}
+
+// isCommand reports whether action names a registered action.
+func (m *SessionMiddleware) isCommand(action string) bool {
+	if m.Actions == nil {
+		return false
+	}
+	_, ok := m.Actions.Action(action)
+	return ok
+}
+
+// ttl returns the session time to live, applying the default.
+func (m *SessionMiddleware) ttl() time.Duration {
+	if m.TTL <= 0 {
+		return DefaultSessionTTL
+	}
+	return m.TTL
+}
+
+// followUp turns a message into a request for the waiting action. The message's text is passed
+// in npc.ReplyArg; any named arguments are kept, but positional ones and the command text, which
+// were parsed for a command the message never was, are dropped.
+func followUp(request npc.Request, action string) npc.Request {
+	args := make(map[string]string, len(request.Args)+1)
+	for k, v := range request.Args {
+		if !isPositional(k) && k != npc.CommandTextArg {
+			args[k] = v
+		}
+	}
+	args[npc.ReplyArg] = replyText(request)
+
+	request.Action = action
+	request.Args = args
+	return request
+}
+
+// replyText recovers the text of a follow-up message: the command text a channel parsed it from,
+// which leaves out the prefix or mention addressing the bot, or else its text. A request that
+// names an action with positional arguments but has no command text, such as an API call, is
+// rebuilt from them.
+func replyText(request npc.Request) string {
+	if text, ok := request.Args[npc.CommandTextArg]; ok {
+		return strings.TrimSpace(text)
+	}
+	words := []string{request.Action}
+	for i := 0; ; i++ {
+		word, ok := request.Args[npc.PositionalArg(i)]
+		if !ok {
+			break
+		}
+		words = append(words, word)
+	}
+	if text := strings.TrimSpace(request.Text); len(words) == 1 && text != "" {
+		return text
+	}
+	return strings.Join(words, " ")
+}
+
+// isPositional reports whether an argument name is that of a positional argument.
+func isPositional(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// TestSessionMiddleware tests that a follow-up message is routed to the action waiting for it.
+func TestSessionMiddleware(t *testing.T) {
+	core := npc.NewNpc()
+	store := npc.NewMemorySessionStore()
+	core.Use(NewSessionMiddleware(store, core))
+	core.RegisterAction(npc.Action{
+		Name: "deploy",
+		ContextHandler: func(ctx context.Context, request npc.Request) npc.Response {
+			session := npc.SessionFrom(ctx)
+			if env := request.Args[npc.ReplyArg]; env != "" {
+				session.Delete("service")
+				return npc.Response{Data: "Deploying to " + env}
+			}
+			session.Set("service", request.Args["0"])
+			session.Await("deploy")
+			return npc.Response{Data: "Which environment?"}
+		},
+	})
+
+	user := npc.Request{Source: "Slack", ChannelID: "C1", User: "U1", Args: map[string]string{}}
+	first := user
+	first.Action, first.Text, first.Args = "deploy", "deploy api", map[string]string{"0": "api"}
+	if response := core.ProcessRequest(first); response.Data != "Which environment?" {
+		t.Fatalf("Unexpected first response %+v", response)
+	}
+
+	session, _ := store.Load(context.Background(), user.SessionKey())
+	if session == nil || session.Get("service") != "api" || session.Pending != "deploy" {
+		t.Fatalf("Expected a saved session waiting for deploy, got %+v", session)
+	}
+
+	// A different user in the same channel has their own conversation
+	other := npc.Request{Action: "prod", Text: "prod", Source: "Slack", ChannelID: "C1", User: "U2"}
+	if response := core.ProcessRequest(other); npc.KindOf(response.Error) != npc.ErrNotFound {
+		t.Errorf("Expected another user's message not to be routed, got %+v", response)
+	}
+
+	// The channel parsed "prod" as a command; the session routes it to deploy instead
+	reply := user
+	reply.Action, reply.Text = "prod", "prod"
+	if response := core.ProcessRequest(reply); response.Data != "Deploying to prod" {
+		t.Fatalf("Unexpected follow-up response %+v", response)
+	}
+
+	if session, _ := store.Load(context.Background(), user.SessionKey()); session != nil {
+		t.Errorf("Expected the finished conversation's session to be deleted, got %+v", session)
+	}
+}
+
+// TestSessionMiddlewareRoutesFirst tests that middleware running before the session middleware
+// sees a follow-up message as a request for the action it is routed to.
+func TestSessionMiddlewareRoutesFirst(t *testing.T) {
+	core := npc.NewNpc()
+	var seen []string
+	core.Use(npc.WrapFunc(func(ctx context.Context, request npc.Request, next npc.Next) npc.Response {
+		seen = append(seen, request.Action)
+		if _, ok := core.Action(request.Action); !ok {
+			return npc.Response{Error: npc.ErrForbidden} // As RBAC would refuse a word it grants nothing for
+		}
+		return next(ctx, request)
+	}))
+	core.Use(NewSessionMiddleware(npc.NewMemorySessionStore(), core))
+	core.RegisterAction(npc.Action{
+		Name: "deploy",
+		ContextHandler: func(ctx context.Context, request npc.Request) npc.Response {
+			if env := request.Args[npc.ReplyArg]; env != "" {
+				return npc.Response{Data: "Deploying to " + env}
+			}
+			npc.SessionFrom(ctx).Await("deploy")
+			return npc.Response{Data: "Which environment?"}
+		},
+	})
+
+	message := func(text string) npc.Response {
+		return core.ProcessRequest(npc.Request{Action: "unknown", Text: text, Source: "Slack", User: "U1"})
+	}
+	core.ProcessRequest(npc.Request{Action: "deploy", Source: "Slack", User: "U1"})
+	if response := message("prod"); response.Data != "Deploying to prod" {
+		t.Fatalf("Unexpected follow-up response %+v", response)
+	}
+	if response := message("prod"); npc.KindOf(response.Error) != npc.ErrForbidden {
+		t.Errorf("Expected the wait to have ended, got %+v", response)
+	}
+	if len(seen) != 3 || seen[1] != "deploy" || seen[2] != "unknown" {
+		t.Errorf("Expected middleware to see deploy, deploy and unknown, got %v", seen)
+	}
+}
+
+// TestSessionMiddlewareDialog tests that a dialog resumes after a restart and that the cancel
+// command is routed to the waiting dialog, and only while it waits.
+func TestSessionMiddlewareDialog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	start := func() *npc.Npc {
+		store, err := npc.NewFileSessionStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		core := npc.NewNpc()
+		core.Use(NewSessionMiddleware(store, core))
+		core.RegisterAction(npc.Action{
+			Name: "deploy",
+			Handler: func(request npc.Request) npc.Response {
+				return npc.Response{Data: "Deploying " + request.Args["service"]}
+			},
+		})
+		core.RegisterDialog(npc.Dialog{
+			Name:   "wizard",
+			Action: "deploy",
+			Steps: []npc.Step{
+				{Param: npc.Param{Name: "service"}, Prompt: "Which service?"},
+				{Param: npc.Param{Name: "env"}, Prompt: "Which environment?"},
+			},
+		})
+		return core
+	}
+	message := func(core *npc.Npc, text string) npc.Response {
+		return core.ProcessRequest(npc.Request{Action: text, Text: text, Source: "Slack", User: "U1", Args: map[string]string{}})
+	}
+
+	core := start()
+	message(core, "wizard")
+	if response := message(core, "api"); response.Data != "Which environment?" {
+		t.Fatalf("Unexpected response %+v", response)
+	}
+
+	core = start()
+	if response := message(core, "cancel"); response.Data != "Cancelled wizard." {
+		t.Errorf("Expected cancel to reach the resumed dialog, got %+v", response)
+	}
+	if response := message(core, "cancel"); npc.KindOf(response.Error) != npc.ErrInvalidArguments {
+		t.Errorf("Expected cancel to ask the job action for a job again, got %+v", response)
+	}
+}
+
+func TestReplyText(t *testing.T) {
+	tests := []struct {
+		request  npc.Request
+		expected string
+	}{
+		{npc.Request{Action: "us", Text: "<@UBOT> us east", Args: map[string]string{"0": "east", npc.CommandTextArg: "us  east"}}, "us  east"},
+		{npc.Request{Action: "unknown", Text: " us east "}, "us east"},
+		{npc.Request{Action: "unknown", Text: "no cancellation"}, "no cancellation"},
+		{npc.Request{Action: "us", Text: "us", Args: map[string]string{"0": "east"}}, "us east"},
+		{npc.Request{Text: "prod"}, "prod"},
+	}
+	for _, test := range tests {
+		if text := replyText(test.request); text != test.expected {
+			t.Errorf("replyText(%+v) = %q, expected %q", test.request, text, test.expected)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package npc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BlockType identifies the kind of content in a Block.
+type BlockType string
+
+// Block types.
+const (
+	BlockHeader  BlockType = "header"
+	BlockSection BlockType = "section"
+	BlockFields  BlockType = "fields"
+	BlockCode    BlockType = "code"
+	BlockList    BlockType = "list"
+	BlockImage   BlockType = "image"
+	BlockButtons BlockType = "buttons"
+	BlockDivider BlockType = "divider"
+)
+
+// Block is one element of a structured response. Which fields are used depends on Type;
+// the constructor functions such as Section and Code build valid blocks. Channels render
+// blocks natively where they can and fall back to the plain text from Response.Text.
+type Block struct {
+	Type     BlockType `json:"type"`
+	Text     string    `json:"text,omitempty"`     // Header, section and code text
+	Language string    `json:"language,omitempty"` // Code language, e.g. "go"
+	Fields   []Field   `json:"fields,omitempty"`
+	Items    []string  `json:"items,omitempty"`
+	Ordered  bool      `json:"ordered,omitempty"` // Whether a list is numbered
+	ImageURL string    `json:"image_url,omitempty"`
+	AltText  string    `json:"alt_text,omitempty"`
+	Buttons  []Button  `json:"buttons,omitempty"`
+}
+
+// Field is a labelled value shown in a Fields block.
+type Field struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// Button offers the user a follow-up. A button either runs Action with Args as a new request
+// from the user who pressed it, or opens URL.
+type Button struct {
+	Text   string            `json:"text"`
+	Action string            `json:"action,omitempty"`
+	Args   map[string]string `json:"args,omitempty"`
+	URL    string            `json:"url,omitempty"`
+	Style  string            `json:"style,omitempty"` // "primary", "danger" or empty
+}
+
+// Header returns a block with a title.
+func Header(text string) Block {
+	return Block{Type: BlockHeader, Text: text}
+}
+
+// Section returns a block of text.
+func Section(text string) Block {
+	return Block{Type: BlockSection, Text: text}
+}
+
+// Fields returns a block of labelled values.
+func Fields(fields ...Field) Block {
+	return Block{Type: BlockFields, Fields: fields}
+}
+
+// Code returns a block of preformatted text.
+func Code(language, code string) Block {
+	return Block{Type: BlockCode, Language: language, Text: code}
+}
+
+// List returns a bulleted list, or a numbered one if ordered is true.
+func List(ordered bool, items ...string) Block {
+	return Block{Type: BlockList, Ordered: ordered, Items: items}
+}
+
+// Image returns a block showing the image at url.
+func Image(url, altText string) Block {
+	return Block{Type: BlockImage, ImageURL: url, AltText: altText}
+}
+
+// Buttons returns a block of buttons.
+func Buttons(buttons ...Button) Block {
+	return Block{Type: BlockButtons, Buttons: buttons}
+}
+
+// Divider returns a block separating the blocks either side of it.
+func Divider() Block {
+	return Block{Type: BlockDivider}
+}
+
+// Text returns the response as plain text: Data alone for plain responses, or Data followed by
+// a plain rendering of the blocks. Channels without rich formatting use it as the fallback.
+func (r Response) Text() string {
+	if len(r.Blocks) == 0 {
+		return r.Data
+	}
+
+	parts := make([]string, 0, len(r.Blocks)+1)
+	if r.Data != "" {
+		parts = append(parts, r.Data)
+	}
+	for _, block := range r.Blocks {
+		if text := block.PlainText(); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// PlainText renders the block as plain text.
+func (b Block) PlainText() string {
+	switch b.Type {
+	case BlockHeader, BlockSection, BlockCode:
+		return b.Text
+	case BlockFields:
+		lines := make([]string, len(b.Fields))
+		for i, f := range b.Fields {
+			lines[i] = f.Label + ": " + f.Value
+		}
+		return strings.Join(lines, "\n")
+	case BlockList:
+		lines := make([]string, len(b.Items))
+		for i, item := range b.Items {
+			if b.Ordered {
+				lines[i] = fmt.Sprintf("%d. %s", i+1, item)
+			} else {
+				lines[i] = "- " + item
+			}
+		}
+		return strings.Join(lines, "\n")
+	case BlockImage:
+		if b.AltText != "" {
+			return b.AltText + ": " + b.ImageURL
+		}
+		return b.ImageURL
+	case BlockButtons:
+		lines := make([]string, len(b.Buttons))
+		for i, button := range b.Buttons {
+			lines[i] = "[" + button.Text + "] " + button.describe()
+		}
+		return strings.Join(lines, "\n")
+	case BlockDivider:
+		return "---"
+	default:
+		return b.Text
+	}
+}
+
+// describe says what pressing the button does, for channels that cannot show buttons.
+func (b Button) describe() string {
+	if b.URL != "" {
+		return b.URL
+	}
+	keys := make([]string, 0, len(b.Args))
+	for k := range b.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{b.Action}
+	for _, k := range keys {
+		v := b.Args[k]
+		if strings.ContainsAny(v, " \t\"'") {
+			v = strconv.Quote(v)
+		}
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,47 @@
+package npc
+
+import "testing"
+
+func TestResponseText(t *testing.T) {
+	plain := Response{Data: "hello"}
+	if plain.Text() != "hello" {
+		t.Errorf("Expected plain data, got %q", plain.Text())
+	}
+
+	rich := Response{
+		Data: "Deployed api",
+		Blocks: []Block{
+			Header("Deploy"),
+			Fields(Field{Label: "Env", Value: "prod"}, Field{Label: "Version", Value: "1.2"}),
+			List(true, "build", "push"),
+			Divider(),
+			Buttons(
+				Button{Text: "Roll back", Action: "rollback", Args: map[string]string{"service": "api", "note": "bad deploy"}},
+				Button{Text: "Logs", URL: "https://example.com/logs"},
+			),
+		},
+	}
+	expected := "Deployed api\n\nDeploy\n\nEnv: prod\nVersion: 1.2\n\n1. build\n2. push\n\n---\n\n" +
+		"[Roll back] rollback note=\"bad deploy\" service=api\n[Logs] https://example.com/logs"
+	if rich.Text() != expected {
+		t.Errorf("Unexpected text:\n%s\nexpected:\n%s", rich.Text(), expected)
+	}
+}
+
+func TestBlockPlainText(t *testing.T) {
+	tests := []struct {
+		block    Block
+		expected string
+	}{
+		{Section("text"), "text"},
+		{Code("go", "x := 1"), "x := 1"},
+		{List(false, "a", "b"), "- a\n- b"},
+		{Image("https://example.com/a.png", "A chart"), "A chart: https://example.com/a.png"},
+		{Image("https://example.com/a.png", ""), "https://example.com/a.png"},
+	}
+	for _, test := range tests {
+		if text := test.block.PlainText(); text != test.expected {
+			t.Errorf("%s block: expected %q, got %q", test.block.Type, test.expected, text)
+		}
+	}
+}
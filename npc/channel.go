@@ -0,0 +1,101 @@
+package npc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Address says where the reply to a request should go: a channel adapter and a place on it.
+type Address struct {
+	Adapter   string `json:"adapter"` // Name of the channel, e.g. "Slack"
+	ChannelID string `json:"channel_id,omitempty"`
+	ThreadID  string `json:"thread_id,omitempty"`
+	User      string `json:"user,omitempty"` // Who private replies, such as errors, are shown to
+}
+
+// Channel is a channel adapter, such as Slack or the REST API, that receives requests for the bot.
+type Channel interface {
+	// Name identifies the channel. Requests it receives use it as their Source.
+	Name() string
+	Start()
+	Stop()
+	RegisterContextHandler(handler RequestHandler)
+}
+
+// Replier is implemented by channels that deliver replies as messages, rather than returning
+// them to a waiting caller as the REST API does.
+type Replier interface {
+	// Reply delivers the response to a request to the request's ReplyTo address.
+	Reply(request Request, response Response)
+}
+
+// AddChannel registers a channel adapter, handing it the bot's requests. Replies are routed to the
+// channel named by each request's ReplyTo address. If the channel is also a Sender it is registered
+// for outbound messages under its name. It returns an error if a channel with the same name, ignoring
+// case, has already been added.
+func (n *Npc) AddChannel(channel Channel) error {
+	n.mu.Lock()
+	for _, existing := range n.channels {
+		if strings.EqualFold(existing.Name(), channel.Name()) {
+			n.mu.Unlock()
+			return fmt.Errorf("channel %s already added", channel.Name())
+		}
+	}
+	n.channels = append(n.channels[:len(n.channels):len(n.channels)], channel)
+	n.mu.Unlock()
+
+	channel.RegisterContextHandler(n.serve)
+	if sender, ok := channel.(Sender); ok {
+		n.RegisterSender(channel.Name(), sender)
+	}
+	return nil
+}
+
+// Channels lists the added channels in the order they were added.
+func (n *Npc) Channels() []Channel {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return append([]Channel(nil), n.channels...)
+}
+
+// StartAll starts every added channel, in the order they were added.
+func (n *Npc) StartAll() {
+	for _, channel := range n.Channels() {
+		channel.Start()
+	}
+}
+
+// StopAll stops every added channel, in the reverse of the order they were added.
+func (n *Npc) StopAll() {
+	channels := n.Channels()
+	for i := len(channels) - 1; i >= 0; i-- {
+		channels[i].Stop()
+	}
+}
+
+// serve is the handler given to added channels. It processes a request and, if the channel named
+// by its reply address delivers replies itself, routes the response there and marks it Replied.
+func (n *Npc) serve(ctx context.Context, request Request) Response {
+	response := n.ProcessRequestContext(ctx, request)
+	if replier, ok := n.channel(request.ReplyTo.Adapter).(Replier); ok {
+		replier.Reply(request, response)
+		response.Replied = true
+	}
+	return response
+}
+
+// channel returns the added channel with the given name, ignoring case, or nil.
+func (n *Npc) channel(name string) Channel {
+	if name == "" {
+		return nil
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, channel := range n.channels {
+		if strings.EqualFold(channel.Name(), name) {
+			return channel
+		}
+	}
+	return nil
+}
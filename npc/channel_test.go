@@ -0,0 +1,81 @@
+package npc
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// mockChannel is a channel adapter that records what the bot does with it.
+type mockChannel struct {
+	name    string
+	events  *[]string // Shared between channels to record the order they start and stop in
+	handler RequestHandler
+
+	mu      sync.Mutex
+	replies []Response
+}
+
+// Name returns the channel's name.
+func (c *mockChannel) Name() string { return c.name }
+
+// Start records that the channel started.
+func (c *mockChannel) Start() { *c.events = append(*c.events, "start "+c.name) }
+
+// Stop records that the channel stopped.
+func (c *mockChannel) Stop() { *c.events = append(*c.events, "stop "+c.name) }
+
+// RegisterContextHandler stores the handler requests are passed to.
+func (c *mockChannel) RegisterContextHandler(handler RequestHandler) { c.handler = handler }
+
+// Reply records a reply.
+func (c *mockChannel) Reply(request Request, response Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replies = append(c.replies, response)
+}
+
+// TestAddChannel tests that replies are routed to the channel named by a request's reply address.
+func TestAddChannel(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{Name: "hello", Handler: func(request Request) Response {
+		return Response{Data: "Hello!"}
+	}})
+
+	var events []string
+	slack := &mockChannel{name: "Slack", events: &events}
+	api := &mockChannel{name: "API", events: &events}
+	for _, channel := range []*mockChannel{slack, api} {
+		if err := npc.AddChannel(channel); err != nil {
+			t.Fatalf("AddChannel failed: %v", err)
+		}
+	}
+	if err := npc.AddChannel(&mockChannel{name: "slack", events: &events}); err == nil {
+		t.Error("Expected an error adding a second channel with the same name")
+	}
+
+	request := Request{Action: "hello", Source: "API", ReplyTo: Address{Adapter: "Slack", ChannelID: "C1"}}
+	response := api.handler(context.Background(), request)
+	if !response.Replied {
+		t.Error("Expected the response to be marked as replied")
+	}
+	if len(slack.replies) != 1 || slack.replies[0].Data != "Hello!" {
+		t.Errorf("Expected one reply through Slack, got %+v", slack.replies)
+	}
+	if len(api.replies) != 0 {
+		t.Errorf("Expected no reply through the API, got %+v", api.replies)
+	}
+
+	// Without a reply address the response is left to the channel that received the request
+	if response := api.handler(context.Background(), Request{Action: "hello", Source: "API"}); response.Replied {
+		t.Error("Expected a request without a reply address not to be replied to")
+	}
+
+	npc.StartAll()
+	npc.StopAll()
+	expected := []string{"start Slack", "start API", "stop API", "stop Slack"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Expected %v, got %v", expected, events)
+	}
+}
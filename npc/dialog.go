@@ -0,0 +1,324 @@
+package npc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultDialogTimeout is how long a dialog waits for each answer when no timeout is set.
+const DefaultDialogTimeout = 10 * time.Minute
+
+// Replies with a special meaning while a dialog is waiting for an answer.
+const (
+	DialogCancel = "cancel" // Abandons the dialog
+	DialogBack   = "back"   // Asks the previous question again
+)
+
+// EndDialog is returned by Step.Next to finish the dialog without asking any more questions.
+const EndDialog = "."
+
+// dialogStateKey is the session value holding the state of the conversation's dialog.
+const dialogStateKey = "npc.dialog"
+
+// Dialog is a command that collects its arguments over several messages, one question at a
+// time, and then runs an action with them. Its state is kept in the conversation's session, so
+// dialogs need the session middleware and survive a restart when sessions are kept in a file.
+//
+// While a dialog is waiting, the conversation's next message answers the question, unless it is
+// another command. DialogCancel abandons the dialog and DialogBack returns to the last question.
+type Dialog struct {
+	Name        string
+	Description string
+	// Steps are the questions, asked in order unless a step's Next says otherwise.
+	// A step whose argument was given when the dialog was started is skipped.
+	Steps []Step
+	// Action is run with the collected arguments once the last step is answered.
+	Action string
+	// Timeout is how long to wait for each answer, DefaultDialogTimeout if zero.
+	Timeout time.Duration
+}
+
+// Step is one question of a dialog. The answer is validated against Param and stored as the
+// argument of the same name.
+type Step struct {
+	Param  Param
+	Prompt string // Question to ask; defaults to one naming the parameter
+	// Next optionally chooses the step to ask next, by its parameter name, given the answer and
+	// every argument collected so far. It returns "" for the following step or EndDialog to finish.
+	Next func(answer string, args map[string]string) string
+}
+
+// DialogPrompt describes a question a dialog is asking, for machine consumers such as the API channel.
+type DialogPrompt struct {
+	Dialog  string    `json:"dialog"`
+	Step    string    `json:"step"`
+	Prompt  string    `json:"prompt"`
+	Type    ParamType `json:"type"`
+	Options []string  `json:"options,omitempty"`
+	Default string    `json:"default,omitempty"`
+	Problem string    `json:"problem,omitempty"` // Why the last answer was rejected
+	Expires time.Time `json:"expires"`
+}
+
+// dialogState is the progress of a dialog, saved in the session between messages.
+type dialogState struct {
+	Dialog  string            `json:"dialog"`
+	Step    int               `json:"step"`
+	History []int             `json:"history,omitempty"` // Steps answered, for going back
+	Args    map[string]string `json:"args"`
+	Expires time.Time         `json:"expires"`
+}
+
+// dialog is a registered dialog along with its compiled steps.
+type dialog struct {
+	Dialog
+	n      *Npc
+	schema *schema // One parameter per step
+}
+
+// RegisterDialog registers a dialog as an action with the dialog's name, replacing any action
+// with that name. It returns an error if the dialog's steps are invalid.
+func (n *Npc) RegisterDialog(d Dialog) error {
+	if d.Action == "" {
+		return fmt.Errorf("dialog %s: no action to run", d.Name)
+	}
+	if len(d.Steps) == 0 {
+		return fmt.Errorf("dialog %s: no steps", d.Name)
+	}
+	params := make([]Param, len(d.Steps))
+	for i, step := range d.Steps {
+		params[i] = step.Param
+	}
+	schema, err := compileSchema(Action{Name: d.Name, Params: params})
+	if err != nil {
+		return err
+	}
+
+	compiled := &dialog{Dialog: d, n: n, schema: schema}
+	return n.RegisterAction(Action{
+		Name:           d.Name,
+		Description:    d.Description,
+		ContextHandler: compiled.handle,
+	})
+}
+
+// handle starts the dialog or, for a follow-up message, takes the answer to its current question.
+func (d *dialog) handle(ctx context.Context, request Request) Response {
+	session := SessionFrom(ctx)
+	if session == nil {
+		return Response{Error: Errorf(ErrInternal, "dialog %s needs sessions to be enabled", d.Name)}
+	}
+
+	reply, answering := request.Args[ReplyArg]
+	if !answering {
+		return d.start(ctx, session, request)
+	}
+
+	state, err := loadDialogState(session)
+	if err != nil {
+		return Response{Error: err}
+	}
+	if state == nil || state.Dialog != d.Name || state.Step < 0 || state.Step >= len(d.Steps) {
+		return Response{Error: Errorf(ErrNotFound, "dialog %s is not in progress", d.Name)}
+	}
+	if time.Now().After(state.Expires) {
+		d.stop(session)
+		return Response{Error: Errorf(ErrTimeout, "dialog %s timed out; start it again with %s", d.Name, d.Name)}
+	}
+	return d.answer(ctx, session, request, state, strings.TrimSpace(reply))
+}
+
+// start begins the dialog. Named arguments given with the command answer their steps in advance;
+// those its channel set, such as an idempotency key, describe only the opening message and are
+// not kept.
+func (d *dialog) start(ctx context.Context, session *Session, request Request) Response {
+	args := namedArgs(request.Args)
+	for _, name := range transportArgs {
+		delete(args, name)
+	}
+	state := &dialogState{Dialog: d.Name, Step: -1, Args: args}
+	return d.advance(ctx, session, request, state, "")
+}
+
+// answer applies a reply to the current question.
+func (d *dialog) answer(ctx context.Context, session *Session, request Request, state *dialogState, reply string) Response {
+	switch strings.ToLower(reply) {
+	case DialogCancel:
+		d.stop(session)
+		return Response{Data: fmt.Sprintf("Cancelled %s.", d.Name)}
+	case DialogBack:
+		if len(state.History) > 0 {
+			state.Step = state.History[len(state.History)-1]
+			state.History = state.History[:len(state.History)-1]
+			delete(state.Args, d.Steps[state.Step].Param.Name)
+		}
+		return d.ask(session, state, "")
+	}
+
+	step := d.Steps[state.Step]
+	if reply == "" {
+		reply = step.Param.Default
+	}
+	if reply == "" {
+		return d.ask(session, state, "An answer is required.")
+	}
+	value, problem := d.schema.check(state.Step, reply)
+	if problem != "" {
+		return d.ask(session, state, "That doesn't look right: "+problem+".")
+	}
+
+	state.Args[step.Param.Name] = value
+	state.History = append(state.History, state.Step)
+	return d.advance(ctx, session, request, state, value)
+}
+
+// advance moves past the current step, answered with value, to the next question that has not
+// been answered in advance. When there is none, the dialog's action is run.
+func (d *dialog) advance(ctx context.Context, session *Session, request Request, state *dialogState, value string) Response {
+	// Steps answered in advance are skipped, so a loop among them would never ask anything
+	for range len(d.Steps) + 1 {
+		next, err := d.next(state, value)
+		if err != nil {
+			d.stop(session)
+			return Response{Error: err}
+		}
+		if next >= len(d.Steps) {
+			d.stop(session)
+			return d.finish(ctx, request, state.Args)
+		}
+		state.Step = next
+		answered, ok := state.Args[d.Steps[next].Param.Name]
+		if !ok {
+			return d.ask(session, state, "")
+		}
+		value = answered
+	}
+	d.stop(session)
+	return Response{Error: Errorf(ErrInternal, "dialog %s: steps loop without asking a question", d.Name)}
+}
+
+// next returns the index of the step after the current one, or len(d.Steps) to finish.
+func (d *dialog) next(state *dialogState, value string) (int, error) {
+	if state.Step < 0 {
+		return 0, nil
+	}
+	choose := d.Steps[state.Step].Next
+	if choose == nil {
+		return state.Step + 1, nil
+	}
+	name := choose(value, state.Args)
+	switch name {
+	case "":
+		return state.Step + 1, nil
+	case EndDialog:
+		return len(d.Steps), nil
+	}
+	for i, step := range d.Steps {
+		if step.Param.Name == name {
+			return i, nil
+		}
+	}
+	return 0, Errorf(ErrInternal, "dialog %s: no step %s", d.Name, name)
+}
+
+// ask saves the dialog's state and asks its current question, after any problem with the last answer.
+func (d *dialog) ask(session *Session, state *dialogState, problem string) Response {
+	state.Expires = time.Now().Add(d.timeout())
+	data, err := json.Marshal(state)
+	if err != nil {
+		return Response{Error: &Error{Kind: ErrInternal, Message: "saving dialog", Err: err}}
+	}
+	session.Set(dialogStateKey, string(data))
+	session.Await(d.Name, DialogCancel, DialogBack)
+
+	step := d.Steps[state.Step]
+	prompt := DialogPrompt{
+		Dialog:  d.Name,
+		Step:    step.Param.Name,
+		Prompt:  step.Prompt,
+		Type:    paramType(step.Param),
+		Options: step.Param.Enum,
+		Default: step.Param.Default,
+		Problem: problem,
+		Expires: state.Expires,
+	}
+	if prompt.Prompt == "" {
+		prompt.Prompt = fmt.Sprintf("What is the %s?", step.Param.Name)
+	}
+	if prompt.Type == TypeBool && len(prompt.Options) == 0 {
+		prompt.Options = []string{"yes", "no"}
+	}
+
+	text := prompt.Prompt
+	if problem != "" {
+		text = problem + "\n" + text
+	}
+	if prompt.Default != "" {
+		text += fmt.Sprintf(" (default %s)", prompt.Default)
+	}
+	return Response{Data: text, Blocks: []Block{Buttons(d.buttons(prompt, len(state.History) > 0)...)}, Payload: prompt}
+}
+
+// buttons returns a button for each of the prompt's options, followed by back and cancel.
+func (d *dialog) buttons(prompt DialogPrompt, canGoBack bool) []Button {
+	reply := func(text, value, style string) Button {
+		return Button{Text: text, Action: d.Name, Args: map[string]string{ReplyArg: value}, Style: style}
+	}
+	buttons := make([]Button, 0, len(prompt.Options)+2)
+	for _, option := range prompt.Options {
+		buttons = append(buttons, reply(option, option, ""))
+	}
+	if canGoBack {
+		buttons = append(buttons, reply("Back", DialogBack, ""))
+	}
+	return append(buttons, reply("Cancel", DialogCancel, "danger"))
+}
+
+// finish runs the dialog's action with the collected arguments through the global middleware.
+// The arguments the channel set on the message that finished the dialog, such as where it came
+// from, go with them, except its idempotency key, which was claimed for the dialog, and its
+// command text.
+func (d *dialog) finish(ctx context.Context, request Request, args map[string]string) Response {
+	final := make(map[string]string, len(args)+len(transportArgs))
+	for k, v := range args {
+		final[k] = v
+	}
+	for _, name := range transportArgs {
+		if value, ok := request.Args[name]; ok && name != IdempotencyArg && name != CommandTextArg {
+			final[name] = value
+		}
+	}
+	request.Action = d.n.resolve(d.Action)
+	request.Args = final
+	return d.n.runGlobal(ctx, request)
+}
+
+// stop ends the dialog, forgetting its state.
+func (d *dialog) stop(session *Session) {
+	session.Delete(dialogStateKey)
+	session.Await("")
+}
+
+// timeout returns the time to wait for an answer, applying the default.
+func (d *dialog) timeout() time.Duration {
+	if d.Timeout <= 0 {
+		return DefaultDialogTimeout
+	}
+	return d.Timeout
+}
+
+// loadDialogState returns the state of the session's dialog, or nil if there is none.
+func loadDialogState(session *Session) (*dialogState, error) {
+	data := session.Get(dialogStateKey)
+	if data == "" {
+		return nil, nil
+	}
+	var state dialogState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil, &Error{Kind: ErrInternal, Message: "reading dialog", Err: err}
+	}
+	return &state, nil
+}
@@ -0,0 +1,158 @@
+package npc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deployDialog returns a dialog that asks for a service, an environment and, for production
+// only, a confirmation, before running the deploy action.
+func deployDialog() Dialog {
+	return Dialog{
+		Name:   "wizard",
+		Action: "deploy",
+		Steps: []Step{
+			{Param: Param{Name: "service", Required: true}, Prompt: "Which service?"},
+			{
+				Param:  Param{Name: "env", Enum: []string{"dev", "prod"}},
+				Prompt: "Which environment?",
+				Next: func(answer string, args map[string]string) string {
+					if answer != "prod" {
+						return EndDialog
+					}
+					return ""
+				},
+			},
+			{Param: Param{Name: "force", Type: TypeBool}, Prompt: "Are you sure?"},
+		},
+	}
+}
+
+// TestDialog tests asking, validating, branching, going back and finishing a dialog.
+func TestDialog(t *testing.T) {
+	npc := NewNpc()
+	var ran Request
+	npc.RegisterAction(deployAction(func(request Request) Response {
+		ran = request
+		return Response{Data: "deployed " + request.Args["service"] + " to " + request.Args["env"]}
+	}))
+	if err := npc.RegisterDialog(deployDialog()); err != nil {
+		t.Fatalf("RegisterDialog failed: %v", err)
+	}
+
+	session := NewSession(SessionKey{Source: "API", User: "alice"})
+	ctx := WithSession(context.Background(), session)
+	reply := func(text string) Response {
+		return npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{ReplyArg: text}})
+	}
+
+	response := npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{}})
+	if response.Data != "Which service?" || session.Pending != "wizard" {
+		t.Fatalf("Unexpected first prompt %+v, session %+v", response, session)
+	}
+	if response = reply("api"); response.Data != "Which environment?" {
+		t.Fatalf("Unexpected second prompt %+v", response)
+	}
+	prompt, _ := response.Payload.(DialogPrompt)
+	if prompt.Step != "env" || len(prompt.Options) != 2 {
+		t.Errorf("Unexpected prompt payload %+v", prompt)
+	}
+
+	response = reply("staging")
+	if prompt, _ := response.Payload.(DialogPrompt); prompt.Step != "env" || prompt.Problem == "" {
+		t.Errorf("Expected an invalid answer to be asked again, got %+v", response)
+	}
+	if response = reply("back"); response.Data != "Which service?" {
+		t.Errorf("Expected back to ask for the service again, got %+v", response)
+	}
+	reply("web")
+	if response = reply("prod"); response.Data != "Are you sure?" {
+		t.Fatalf("Expected prod to ask for confirmation, got %+v", response)
+	}
+	if response = reply("yes"); response.Data != "deployed web to prod" {
+		t.Fatalf("Unexpected final response %+v", response)
+	}
+	if ran.Args["force"] != "true" {
+		t.Errorf("Expected the normalised answer to reach the action, got %v", ran.Args)
+	}
+	if !session.Empty() {
+		t.Errorf("Expected a finished dialog to leave no state, got %+v", session)
+	}
+
+	// Arguments given up front skip their steps, and dev needs no confirmation
+	response = npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{"service": "api", "env": "dev"}})
+	if response.Data != "deployed api to dev" {
+		t.Errorf("Expected the dialog to finish at once, got %+v", response)
+	}
+}
+
+// TestDialogFinishMiddleware tests that the action a dialog finishes with passes through the
+// global middleware.
+func TestDialogFinishMiddleware(t *testing.T) {
+	npc := NewNpc()
+	var seen []string
+	npc.Use(WrapFunc(func(ctx context.Context, request Request, next Next) Response {
+		seen = append(seen, request.Action)
+		if request.Action == "deploy" && request.Args["env"] == "prod" {
+			return Response{Error: ErrForbidden}
+		}
+		return next(ctx, request)
+	}))
+	npc.RegisterAction(deployAction(func(request Request) Response { return Response{Data: "deployed"} }))
+	npc.RegisterDialog(deployDialog())
+	ctx := WithSession(context.Background(), NewSession(SessionKey{Source: "API", User: "alice"}))
+
+	response := npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{"service": "api", "env": "dev"}})
+	if response.Data != "deployed" || strings.Join(seen, ",") != "wizard,deploy" {
+		t.Errorf("Expected middleware to see wizard and then deploy, got %v and %+v", seen, response)
+	}
+	response = npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{"service": "api", "env": "prod", "force": "true"}})
+	if KindOf(response.Error) != ErrForbidden {
+		t.Errorf("Expected middleware to refuse the finished action, got %+v", response)
+	}
+}
+
+func TestDialogCancelAndTimeout(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(deployAction(func(request Request) Response { return Response{Data: "deployed"} }))
+	d := deployDialog()
+	d.Timeout = time.Millisecond
+	npc.RegisterDialog(d)
+
+	session := NewSession(SessionKey{Source: "Slack", User: "U1"})
+	ctx := WithSession(context.Background(), session)
+	npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{}})
+
+	time.Sleep(5 * time.Millisecond)
+	response := npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{ReplyArg: "api"}})
+	if KindOf(response.Error) != ErrTimeout || !session.Empty() {
+		t.Errorf("Expected the dialog to time out, got %+v, session %+v", response, session)
+	}
+
+	npc.RegisterDialog(deployDialog())
+	npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{}})
+	response = npc.ProcessRequestContext(ctx, Request{Action: "wizard", Args: map[string]string{ReplyArg: "Cancel"}})
+	if !strings.HasPrefix(response.Data, "Cancelled") || !session.Empty() {
+		t.Errorf("Expected the dialog to be cancelled, got %+v, session %+v", response, session)
+	}
+
+	if response := npc.ProcessRequest(Request{Action: "wizard"}); KindOf(response.Error) != ErrInternal {
+		t.Errorf("Expected an error without sessions, got %+v", response)
+	}
+}
+
+func TestRegisterDialogErrors(t *testing.T) {
+	npc := NewNpc()
+	dialogs := []Dialog{
+		{Name: "none", Action: "deploy"},
+		{Name: "orphan", Steps: []Step{{Param: Param{Name: "service"}}}},
+		{Name: "dup", Action: "deploy", Steps: []Step{{Param: Param{Name: "a"}}, {Param: Param{Name: "a"}}}},
+	}
+	for _, d := range dialogs {
+		if err := npc.RegisterDialog(d); err == nil {
+			t.Errorf("Expected dialog %s to be rejected", d.Name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package npc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sentinel errors describing why a request failed. Middleware and handlers return them, or
+// errors wrapping them, so that every channel can map a failure to its own conventions.
+var (
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrForbidden        = errors.New("forbidden")
+	ErrNotFound         = errors.New("not found")
+	ErrInvalidArguments = errors.New("invalid arguments")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrTimeout          = errors.New("timeout")
+	ErrUnavailable      = errors.New("unavailable")
+	ErrBusy             = errors.New("busy")
+	ErrInternal         = errors.New("internal error")
+)
+
+// kinds lists the sentinel errors in the order KindOf checks them.
+var kinds = []error{
+	ErrUnauthorized,
+	ErrForbidden,
+	ErrNotFound,
+	ErrInvalidArguments,
+	ErrRateLimited,
+	ErrTimeout,
+	ErrUnavailable,
+	ErrBusy,
+	ErrInternal,
+}
+
+// Error is an error of a known kind with a more specific message.
+// errors.Is reports true for both its Kind and its underlying Err.
+type Error struct {
+	Kind    error  // One of the sentinel errors, e.g. ErrNotFound
+	Message string // Message shown to the caller
+	Err     error  // Optional underlying cause
+}
+
+// Errorf returns an Error of the given kind with a formatted message.
+func Errorf(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+}
+
+// Error returns the message, falling back to the kind's message.
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	return e.Kind.Error()
+}
+
+// Unwrap exposes the kind and the underlying cause to errors.Is and errors.As.
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// RateLimitError reports a request refused for exceeding a rate limit. It wraps ErrRateLimited.
+type RateLimitError struct {
+	RetryAfter time.Duration // How long until the request would be allowed
+	Limit      int           // Requests, or their cost, allowed per Window
+	Window     time.Duration
+}
+
+// Error says how long to wait before trying again.
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit of %d per %s exceeded; try again in %s", e.Limit, e.Window, (e.RetryAfter + time.Second - 1).Truncate(time.Second))
+}
+
+// Unwrap returns ErrRateLimited.
+func (e *RateLimitError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// KindOf returns the sentinel error that err is, or wraps. Errors of no known kind are
+// reported as ErrInternal, and a nil error returns nil.
+func KindOf(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	for _, kind := range kinds {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	return ErrInternal
+}
+
+// contextError converts the error of a finished context into a response error.
+func contextError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Kind: ErrTimeout, Message: "request timed out", Err: err}
+	}
+	return err
+}
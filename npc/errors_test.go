@@ -0,0 +1,65 @@
+package npc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestKindOf tests that errors are classified by the sentinel they wrap.
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{nil, nil},
+		{ErrForbidden, ErrForbidden},
+		{Errorf(ErrNotFound, "action %s not found", "x"), ErrNotFound},
+		{fmt.Errorf("checking token: %w", ErrUnauthorized), ErrUnauthorized},
+		{context.DeadlineExceeded, ErrTimeout},
+		{errors.New("boom"), ErrInternal},
+	}
+
+	for _, test := range tests {
+		if got := KindOf(test.err); got != test.want {
+			t.Errorf("KindOf(%v) = %v, expected %v", test.err, got, test.want)
+		}
+	}
+}
+
+// TestError tests the message and unwrapping of Error.
+func TestError(t *testing.T) {
+	cause := errors.New("cause")
+	err := &Error{Kind: ErrInvalidArguments, Err: cause}
+
+	if err.Error() != "invalid arguments" {
+		t.Errorf("Expected kind message, got %q", err.Error())
+	}
+	if !errors.Is(err, ErrInvalidArguments) || !errors.Is(err, cause) {
+		t.Error("Expected Error to match both its kind and its cause")
+	}
+}
+
+// TestProcessRequestErrors tests that the core reports failures with typed errors.
+func TestProcessRequestErrors(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{
+		Name: "slow",
+		ContextHandler: func(ctx context.Context, request Request) Response {
+			return Response{Data: "slow"}
+		},
+	})
+
+	response := npc.ProcessRequest(Request{Action: "missing"})
+	if !errors.Is(response.Error, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", response.Error)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	response = npc.ProcessRequestContext(ctx, Request{Action: "slow"})
+	if !errors.Is(response.Error, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got %v", response.Error)
+	}
+}
@@ -0,0 +1,81 @@
+package npc
+
+// Scope is a set of actions that share middleware: either a group of actions under a common
+// name prefix, such as every "admin.*" action, or a single action. Scoped middleware runs
+// after the global middleware; group middleware runs outermost group first, then the
+// action's own middleware.
+type Scope struct {
+	n      *Npc
+	key    string // Key of the scope's middleware in Npc.scoped
+	prefix string // Prefix added to action names registered through the scope
+}
+
+// Group returns the scope of every action whose name starts with prefix followed by a dot.
+// Groups nest, so "admin.users.delete" is in both the "admin" and "admin.users" groups.
+func (n *Npc) Group(prefix string) *Scope {
+	return &Scope{n: n, key: prefix + ".*", prefix: prefix + "."}
+}
+
+// ForAction returns the scope of the single named action.
+func (n *Npc) ForAction(name string) *Scope {
+	return &Scope{n: n, key: name}
+}
+
+// Group returns a group nested within this group.
+func (s *Scope) Group(name string) *Scope {
+	return s.n.Group(s.prefix + name)
+}
+
+// RegisterAction registers an action in the scope. For a group, the group's prefix is added to
+// the action's name, so registering "restart" in the "admin" group registers "admin.restart".
+func (s *Scope) RegisterAction(action Action) error {
+	action.Name = s.prefix + action.Name
+	return s.n.RegisterAction(action)
+}
+
+// Use adds a middleware to the end of the scope's chain. See Npc.Use.
+func (s *Scope) Use(middleware interface{}) {
+	s.n.useIn(s.key, middlewareName(middleware), middleware)
+}
+
+// UseNamed adds a middleware to the end of the scope's chain under the given name.
+func (s *Scope) UseNamed(name string, middleware interface{}) {
+	s.n.useIn(s.key, name, middleware)
+}
+
+// RemoveMiddleware removes the first middleware with the given name from the scope.
+func (s *Scope) RemoveMiddleware(name string) bool {
+	return s.n.removeIn(s.key, name)
+}
+
+// MoveMiddleware moves the first middleware with the given name to position index in the scope's chain.
+func (s *Scope) MoveMiddleware(name string, index int) error {
+	return s.n.moveIn(s.key, name, index)
+}
+
+// MiddlewareNames lists the names of the scope's middleware in the order they run.
+func (s *Scope) MiddlewareNames() []string {
+	return s.n.namesIn(s.key)
+}
+
+// scopedMiddleware returns the group and action middleware for an action, in the order it runs.
+// The caller must hold n.mu.
+func (n *Npc) scopedMiddleware(action string) []middlewareEntry {
+	var middleware []middlewareEntry
+	for i, r := range action {
+		if r == '.' {
+			middleware = append(middleware, n.scoped[action[:i]+".*"]...)
+		}
+	}
+	return append(middleware, n.scoped[action]...)
+}
+
+// chainMiddleware returns every middleware that applies to an action: global first, then scoped.
+func (n *Npc) chainMiddleware(action string) []middlewareEntry {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	middleware := make([]middlewareEntry, 0, len(n.middleware))
+	middleware = append(middleware, n.middleware...)
+	return append(middleware, n.scopedMiddleware(action)...)
+}
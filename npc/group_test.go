@@ -0,0 +1,68 @@
+package npc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestScopedMiddleware tests the order in which global, group and action middleware run.
+func TestScopedMiddleware(t *testing.T) {
+	npc := NewNpc()
+	var log []string
+	handler := func(request Request) Response {
+		log = append(log, "action")
+		return Response{}
+	}
+
+	admin := npc.Group("admin")
+	admin.Group("users").RegisterAction(Action{Name: "delete", Handler: handler})
+	npc.RegisterAction(Action{Name: "status", Handler: handler})
+
+	npc.Use(namedMiddleware{name: "global", log: &log})
+	admin.Use(namedMiddleware{name: "admin", log: &log})
+	npc.Group("admin.users").Use(namedMiddleware{name: "users", log: &log})
+	npc.ForAction("admin.users.delete").Use(namedMiddleware{name: "delete", log: &log})
+
+	npc.ProcessRequest(Request{Action: "admin.users.delete"})
+	expected := []string{"global", "admin", "users", "delete", "action"}
+	if !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected %v, got %v", expected, log)
+	}
+
+	log = nil
+	npc.ProcessRequest(Request{Action: "status"})
+	if expected := []string{"global", "action"}; !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected %v, got %v", expected, log)
+	}
+}
+
+// TestScopedMiddlewareCache tests that cached chains see registration changes.
+func TestScopedMiddlewareCache(t *testing.T) {
+	npc := NewNpc()
+	deploy := npc.Group("deploy")
+	deploy.RegisterAction(Action{Name: "api", Handler: func(request Request) Response { return Response{Data: "deployed"} }})
+
+	if response := npc.ProcessRequest(Request{Action: "deploy.api"}); response.Data != "deployed" {
+		t.Fatalf("Expected action to run, got %+v", response)
+	}
+
+	deploy.UseNamed("freeze", denyAuthorizer{action: "deploy.api"})
+	if response := npc.ProcessRequest(Request{Action: "deploy.api"}); !errors.Is(response.Error, ErrForbidden) {
+		t.Errorf("Expected group middleware added later to apply, got %+v", response)
+	}
+	if names := deploy.MiddlewareNames(); !reflect.DeepEqual(names, []string{"freeze"}) {
+		t.Errorf("Unexpected group middleware %v", names)
+	}
+
+	for _, info := range npc.Catalogue(Request{}) {
+		if info.Name == "deploy.api" {
+			t.Error("Expected group authorizer to hide deploy.api")
+		}
+	}
+
+	deploy.RemoveMiddleware("freeze")
+	if response := npc.ProcessRequest(Request{Action: "deploy.api"}); response.Data != "deployed" {
+		t.Errorf("Expected removed middleware to stop applying, got %+v", response)
+	}
+}
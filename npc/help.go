@@ -0,0 +1,171 @@
+package npc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// HelpAction is the name of the built-in action that describes the other actions.
+const HelpAction = "help"
+
+// Authorizer is implemented by middleware that decides which actions a request may run.
+// The help action and Catalogue consult it so callers only see what they are allowed to use.
+type Authorizer interface {
+	Authorize(request Request, action string) error
+}
+
+// ActionInfo describes a registered action for help text and API documentation.
+type ActionInfo struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Usage       string    `json:"usage"`
+	Aliases     []string  `json:"aliases,omitempty"`
+	Triggers    []Trigger `json:"triggers,omitempty"`
+	Params      []Param   `json:"params,omitempty"`
+	Examples    []string  `json:"examples,omitempty"`
+}
+
+// Usage returns a one-line synopsis of the action, e.g. "deploy <service> [env=dev|prod] [--force]".
+func (a Action) Usage() string {
+	parts := []string{a.Name}
+	for _, p := range a.Params {
+		switch {
+		case p.Required:
+			parts = append(parts, "<"+p.Name+">")
+		case p.Type == TypeBool:
+			parts = append(parts, "[--"+p.Name+"]")
+		case len(p.Enum) > 0:
+			parts = append(parts, "["+p.Name+"="+strings.Join(p.Enum, "|")+"]")
+		default:
+			parts = append(parts, "["+p.Name+"=<"+string(paramType(p))+">]")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Info returns the action's description for catalogues.
+func (a Action) Info() ActionInfo {
+	return ActionInfo{
+		Name:        a.Name,
+		Description: a.Description,
+		Usage:       a.Usage(),
+		Aliases:     a.Aliases,
+		Triggers:    a.Triggers,
+		Params:      a.Params,
+		Examples:    a.Examples,
+	}
+}
+
+// Catalogue lists the actions the request is allowed to run, sorted by name.
+func (n *Npc) Catalogue(request Request) []ActionInfo {
+	infos := make([]ActionInfo, 0)
+	for _, action := range n.Actions() {
+		if n.permits(request, action.Name) {
+			infos = append(infos, action.Info())
+		}
+	}
+	return infos
+}
+
+// permits reports whether every Authorizer in the action's chain allows the request to run action.
+func (n *Npc) permits(request Request, action string) bool {
+	for _, m := range n.chainMiddleware(action) {
+		if authorizer, ok := m.value.(Authorizer); ok {
+			if authorizer.Authorize(request, action) != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// helpAction returns the built-in help action.
+func (n *Npc) helpAction() Action {
+	return Action{
+		Name:        HelpAction,
+		Description: "List the available actions, or describe one",
+		Params: []Param{
+			{Name: "action", Help: "The action to describe"},
+		},
+		Examples: []string{"help", "help deploy"},
+		ContextHandler: func(ctx context.Context, request Request) Response {
+			name := request.Args["action"]
+			if name == "" {
+				catalogue := n.Catalogue(request)
+				return Response{Data: formatCatalogue(catalogue), Payload: catalogue}
+			}
+
+			action, ok := n.Action(name)
+			if !ok || !n.permits(request, action.Name) {
+				return Response{Error: Errorf(ErrNotFound, "action %s not found", name)}
+			}
+			info := action.Info()
+			return Response{Data: formatActionInfo(info), Payload: info}
+		},
+	}
+}
+
+// formatCatalogue renders a list of actions as plain text.
+func formatCatalogue(catalogue []ActionInfo) string {
+	var b strings.Builder
+	b.WriteString("Available actions:\n")
+	for _, info := range catalogue {
+		if info.Description != "" {
+			fmt.Fprintf(&b, "  %s - %s\n", info.Name, info.Description)
+		} else {
+			fmt.Fprintf(&b, "  %s\n", info.Name)
+		}
+	}
+	fmt.Fprintf(&b, "Type \"%s <action>\" for details.", HelpAction)
+	return b.String()
+}
+
+// formatActionInfo renders the details of one action as plain text.
+func formatActionInfo(info ActionInfo) string {
+	var b strings.Builder
+	b.WriteString(info.Name)
+	if info.Description != "" {
+		b.WriteString(" - " + info.Description)
+	}
+	b.WriteString("\nUsage: " + info.Usage)
+	if len(info.Aliases) > 0 {
+		b.WriteString("\nAliases: " + strings.Join(info.Aliases, ", "))
+	}
+
+	if len(info.Params) > 0 {
+		b.WriteString("\nArguments:")
+		for _, p := range info.Params {
+			details := []string{string(paramType(p))}
+			if p.Required {
+				details = append(details, "required")
+			}
+			if p.Default != "" {
+				details = append(details, "default "+p.Default)
+			}
+			if len(p.Enum) > 0 {
+				details = append(details, "one of "+strings.Join(p.Enum, ", "))
+			}
+			fmt.Fprintf(&b, "\n  %s (%s)", p.Name, strings.Join(details, ", "))
+			if p.Help != "" {
+				b.WriteString(" - " + p.Help)
+			}
+		}
+	}
+
+	if len(info.Examples) > 0 {
+		b.WriteString("\nExamples:")
+		for _, example := range info.Examples {
+			b.WriteString("\n  " + example)
+		}
+	}
+	return b.String()
+}
+
+// paramType returns the parameter's type, applying the default.
+func paramType(p Param) ParamType {
+	if p.Type == "" {
+		return TypeString
+	}
+	return p.Type
+}
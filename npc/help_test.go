@@ -0,0 +1,67 @@
+package npc
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// denyAuthorizer is middleware that forbids a single action.
+type denyAuthorizer struct {
+	action string
+}
+
+// Execute rejects requests for the denied action.
+func (d denyAuthorizer) Execute(request *Request) error {
+	return d.Authorize(*request, request.Action)
+}
+
+// Authorize forbids the denied action.
+func (d denyAuthorizer) Authorize(request Request, action string) error {
+	if action == d.action {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// TestHelpAction tests the built-in help action and its filtering.
+func TestHelpAction(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(deployAction(func(request Request) Response { return Response{} }))
+	npc.RegisterAction(Action{Name: "admin", Description: "Administer the bot", Handler: func(request Request) Response { return Response{} }})
+	npc.Use(denyAuthorizer{action: "admin"})
+
+	response := npc.ProcessRequest(Request{Action: HelpAction})
+	if response.Error != nil {
+		t.Fatalf("help returned an error: %v", response.Error)
+	}
+	if !strings.Contains(response.Data, "deploy") || strings.Contains(response.Data, "admin") {
+		t.Errorf("Unexpected help text %q", response.Data)
+	}
+	catalogue, ok := response.Payload.([]ActionInfo)
+	if !ok {
+		t.Fatalf("Expected a catalogue payload, got %#v", response.Payload)
+	}
+	var names []string
+	for _, info := range catalogue {
+		names = append(names, info.Name)
+	}
+	if expected := []string{"deploy", HelpAction, CancelAction, JobsAction}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected catalogue %v, got %v", expected, names)
+	}
+
+	response = npc.ProcessRequest(Request{Action: HelpAction, Args: map[string]string{"0": "deploy"}})
+	if response.Error != nil {
+		t.Fatalf("help deploy returned an error: %v", response.Error)
+	}
+	expectedUsage := "Usage: deploy <service> [env=dev|prod] [replicas=<int>] [--force]"
+	if !strings.Contains(response.Data, expectedUsage) {
+		t.Errorf("Expected %q in %q", expectedUsage, response.Data)
+	}
+
+	response = npc.ProcessRequest(Request{Action: HelpAction, Args: map[string]string{"action": "admin"}})
+	if !errors.Is(response.Error, ErrNotFound) {
+		t.Errorf("Expected a forbidden action to be hidden, got %v", response.Error)
+	}
+}
@@ -0,0 +1,368 @@
+package npc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the built-in job actions. They are namespaced, and run by the shorter aliases "jobs"
+// and "cancel". A dialog's "cancel" still reaches the dialog while it is waiting for an answer.
+const (
+	JobsAction   = "job.list"
+	CancelAction = "job.cancel"
+)
+
+// JobStatus is the state of an asynchronous job.
+type JobStatus string
+
+// Job states.
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// Job is a running or finished asynchronous action. Its handler uses it to watch for
+// cancellation and to report progress back to the channel and thread the request came from.
+// Channels that cannot push messages, such as the API, leave their callers to poll the job's
+// status instead.
+type Job struct {
+	id      string
+	request Request
+	ctx     context.Context
+	cancel  context.CancelFunc
+	notify  func(message string)
+
+	mu        sync.Mutex
+	status    JobStatus
+	cancelled bool
+	progress  string
+	result    Response
+	created   time.Time
+	updated   time.Time
+}
+
+// JobInfo is a snapshot of a job's state.
+type JobInfo struct {
+	ID        string    `json:"id"`
+	Action    string    `json:"action"`
+	User      string    `json:"user,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	ChannelID string    `json:"channel_id,omitempty"`
+	Status    JobStatus `json:"status"`
+	Progress  string    `json:"progress,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+}
+
+// ID returns the job's identifier.
+func (j *Job) ID() string {
+	return j.id
+}
+
+// Request returns the request that started the job.
+func (j *Job) Request() Request {
+	return j.request
+}
+
+// Context returns a context that is cancelled when the job is cancelled. It carries the values
+// of the originating request's context but not its deadline, as the job outlives the request.
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// Progress records a progress message and sends it to the originating channel.
+func (j *Job) Progress(message string) {
+	j.mu.Lock()
+	j.progress = message
+	j.updated = time.Now()
+	j.mu.Unlock()
+
+	j.notify(fmt.Sprintf("Job %s (%s): %s", j.id, j.request.Action, message))
+}
+
+// Cancel asks the job to stop by cancelling its context. It reports false if the job had already finished.
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.status != JobRunning {
+		return false
+	}
+	j.cancelled = true
+	j.updated = time.Now()
+	j.cancel()
+	return true
+}
+
+// Status returns the job's current state.
+func (j *Job) Status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Info returns a snapshot of the job's state.
+func (j *Job) Info() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info := JobInfo{
+		ID:        j.id,
+		Action:    j.request.Action,
+		User:      j.request.User,
+		Source:    j.request.Source,
+		ChannelID: j.request.ChannelID,
+		Status:    j.status,
+		Progress:  j.progress,
+		Result:    j.result.Text(),
+		Created:   j.created,
+		Updated:   j.updated,
+	}
+	if j.result.Error != nil {
+		info.Error = j.result.Error.Error()
+	}
+	return info
+}
+
+// finish records the job's result and reports it to the originating channel.
+func (j *Job) finish(response Response) {
+	j.mu.Lock()
+	j.result = response
+	j.updated = time.Now()
+	switch {
+	case j.cancelled:
+		j.status = JobCancelled
+	case response.Error != nil:
+		j.status = JobFailed
+	default:
+		j.status = JobSucceeded
+	}
+	status := j.status
+	j.mu.Unlock()
+	j.cancel()
+
+	switch status {
+	case JobCancelled:
+		j.notify(fmt.Sprintf("Job %s (%s) was cancelled", j.id, j.request.Action))
+	case JobFailed:
+		j.notify(fmt.Sprintf("Job %s (%s) failed: %v", j.id, j.request.Action, response.Error))
+	default:
+		j.notify(fmt.Sprintf("Job %s (%s) succeeded: %s", j.id, j.request.Action, response.Text()))
+	}
+}
+
+// JobStore keeps track of jobs in memory. Finished jobs are forgotten once they are older
+// than Retention.
+type JobStore struct {
+	Retention time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewJobStore creates an empty JobStore that keeps finished jobs for an hour.
+func NewJobStore() *JobStore {
+	return &JobStore{
+		Retention: time.Hour,
+		jobs:      make(map[string]*Job),
+	}
+}
+
+// Add stores a job, forgetting any finished jobs past their retention.
+func (s *JobStore) Add(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-s.Retention)
+	for id, j := range s.jobs {
+		if info := j.Info(); info.Status != JobRunning && info.Updated.Before(cutoff) {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[job.id] = job
+}
+
+// Get returns the job with the given ID.
+func (s *JobStore) Get(id string) (*Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// List returns every job, oldest first.
+func (s *JobStore) List() []*Job {
+	s.mu.Lock()
+	jobs := make([]*Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].created.Before(jobs[j].created) })
+	return jobs
+}
+
+// Jobs returns the store of the bot's asynchronous jobs.
+func (n *Npc) Jobs() *JobStore {
+	return n.jobs
+}
+
+// startJob runs an asynchronous action in the background and returns the job's ID to the caller.
+// done is called when the job finishes.
+func (n *Npc) startJob(ctx context.Context, action Action, request Request, done func()) Response {
+	var jobCtx context.Context
+	var cancel context.CancelFunc
+	if action.Timeout > 0 {
+		jobCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), action.Timeout)
+	} else {
+		jobCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+	}
+	now := time.Now()
+	job := &Job{
+		id:      newID(),
+		request: request,
+		ctx:     jobCtx,
+		cancel:  cancel,
+		status:  JobRunning,
+		created: now,
+		updated: now,
+	}
+	job.notify = func(message string) {
+		n.notify(request, message)
+	}
+	n.jobs.Add(job)
+
+	go func() {
+		defer done()
+		job.finish(n.runJob(action, job))
+	}()
+
+	return Response{
+		Data:    fmt.Sprintf("Started job %s for %s", job.id, action.Name),
+		Code:    202,
+		Payload: job.Info(),
+	}
+}
+
+// runJob runs an asynchronous action's handler, recovering from any panic.
+func (n *Npc) runJob(action Action, job *Job) (response Response) {
+	defer n.recoverPanic(job.request, true, &response)
+	return action.JobHandler(job)
+}
+
+// newID returns a short random identifier for jobs and error reports.
+func newID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// jobActions returns the built-in actions for listing and cancelling jobs.
+func (n *Npc) jobActions() []Action {
+	return []Action{
+		{
+			Name:        JobsAction,
+			Aliases:     []string{"jobs"},
+			Description: "List your jobs, or show the status of one",
+			Params:      []Param{{Name: "id", Help: "The job to show"}},
+			Examples:    []string{"jobs", "jobs 3f2a9c1b7e4d"},
+			Handler: func(request Request) Response {
+				if id := request.Args["id"]; id != "" {
+					job, err := n.ownedJob(request, id)
+					if err != nil {
+						return Response{Error: err}
+					}
+					info := job.Info()
+					return Response{Data: formatJob(info), Payload: info}
+				}
+
+				infos := make([]JobInfo, 0)
+				owner := jobOwner(request)
+				for _, job := range n.jobs.List() {
+					if owner != "" && jobOwner(job.request) == owner {
+						infos = append(infos, job.Info())
+					}
+				}
+				lines := make([]string, len(infos))
+				for i, info := range infos {
+					lines[i] = formatJob(info)
+				}
+				if len(lines) == 0 {
+					lines = append(lines, "You have no jobs.")
+				}
+				return Response{Data: strings.Join(lines, "\n"), Payload: infos}
+			},
+		},
+		{
+			Name:        CancelAction,
+			Aliases:     []string{"cancel"},
+			Description: "Cancel one of your running jobs",
+			Params:      []Param{{Name: "id", Required: true, Help: "The job to cancel"}},
+			Examples:    []string{"cancel 3f2a9c1b7e4d"},
+			Handler: func(request Request) Response {
+				job, err := n.ownedJob(request, request.Args["id"])
+				if err != nil {
+					return Response{Error: err}
+				}
+				if !job.Cancel() {
+					return Response{Error: Errorf(ErrInvalidArguments, "job %s has already finished", job.id)}
+				}
+				return Response{Data: fmt.Sprintf("Cancelling job %s", job.id), Payload: job.Info()}
+			},
+		},
+	}
+}
+
+// ownedJob returns a job started by the requesting caller.
+func (n *Npc) ownedJob(request Request, id string) (*Job, error) {
+	job, ok := n.jobs.Get(id)
+	if owner := jobOwner(request); !ok || owner == "" || jobOwner(job.request) != owner {
+		return nil, Errorf(ErrNotFound, "job %s not found", id)
+	}
+	return job, nil
+}
+
+// jobOwner returns who owns the jobs a request starts: the Identity authentication found for it.
+// Requests nothing authenticated, as when no authentication middleware is in use, are owned by
+// the User they name or else the address they came from. Anonymous requests own no jobs.
+func jobOwner(request Request) string {
+	switch {
+	case request.Strength == AuthAnonymous:
+		return ""
+	case request.Identity != "":
+		return request.Identity
+	case request.Strength != AuthNone:
+		return ""
+	case request.User != "":
+		return "user=" + request.User
+	case request.Args[RemoteAddrArg] != "":
+		return "remote=" + request.Args[RemoteAddrArg]
+	}
+	return ""
+}
+
+// formatJob renders a job's state as one line of text.
+func formatJob(info JobInfo) string {
+	line := fmt.Sprintf("%s %s: %s", info.ID, info.Action, info.Status)
+	switch {
+	case info.Error != "":
+		line += " - " + info.Error
+	case info.Status == JobRunning && info.Progress != "":
+		line += " - " + info.Progress
+	case info.Result != "":
+		line += " - " + info.Result
+	}
+	return line
+}
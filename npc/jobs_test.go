@@ -0,0 +1,174 @@
+package npc
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MockSender records the messages sent through it.
+type MockSender struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+// SendMessage records a message.
+func (m *MockSender) SendMessage(channelID string, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, channelID+": "+message)
+}
+
+// SendThreadMessage records a message along with its thread.
+func (m *MockSender) SendThreadMessage(channelID, threadID, message string) {
+	m.SendMessage(channelID+"/"+threadID, message)
+}
+
+// Messages returns the messages sent so far.
+func (m *MockSender) Messages() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.messages...)
+}
+
+// waitForStatus polls until a job leaves the running state.
+func waitForStatus(t *testing.T, job *Job) JobStatus {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if status := job.Status(); status != JobRunning {
+			return status
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", job.ID())
+	return JobRunning
+}
+
+// TestAsyncAction tests that asynchronous actions return a job ID and report progress and results.
+func TestAsyncAction(t *testing.T) {
+	npc := NewNpc()
+	sender := &MockSender{}
+	npc.RegisterSender("Slack", sender)
+
+	release := make(chan struct{})
+	npc.RegisterAction(Action{
+		Name: "deploy",
+		JobHandler: func(job *Job) Response {
+			job.Progress("halfway")
+			<-release
+			return Response{Data: "deployed " + job.Request().Args["0"]}
+		},
+	})
+
+	response := npc.ProcessRequest(Request{Action: "deploy", Source: "Slack", ChannelID: "C1", ThreadID: "1.2", User: "U1", Identity: "slack:U1", Args: map[string]string{"0": "api"}})
+	if response.Error != nil {
+		t.Fatalf("ProcessRequest() returned an error: %v", response.Error)
+	}
+	info, ok := response.Payload.(JobInfo)
+	if !ok || response.Code != 202 || info.Status != JobRunning {
+		t.Fatalf("Expected a running job, got %+v", response)
+	}
+
+	job, ok := npc.Jobs().Get(info.ID)
+	if !ok {
+		t.Fatalf("Job %s was not stored", info.ID)
+	}
+	close(release)
+	if status := waitForStatus(t, job); status != JobSucceeded {
+		t.Errorf("Expected job to succeed, got %s", status)
+	}
+
+	messages := sender.Messages()
+	if len(messages) != 2 || !strings.Contains(messages[0], "halfway") || !strings.Contains(messages[1], "succeeded: deployed api") {
+		t.Errorf("Unexpected notifications %v", messages)
+	}
+	if !strings.HasPrefix(messages[1], "C1/1.2: ") {
+		t.Errorf("Expected notifications to go to the originating thread, got %v", messages)
+	}
+
+	response = npc.ProcessRequest(Request{Action: JobsAction, User: "U1", Identity: "slack:U1"})
+	if !strings.Contains(response.Data, info.ID+" deploy: succeeded") {
+		t.Errorf("Expected job in listing, got %q", response.Data)
+	}
+	// Jobs belong to the caller's identity, not the user it claims
+	for _, other := range []Request{
+		{Action: JobsAction, User: "U2", Identity: "slack:U2", Args: map[string]string{"0": info.ID}},
+		{Action: JobsAction, User: "U1", Identity: "apikey:shared", Args: map[string]string{"0": info.ID}},
+		{Action: JobsAction, User: "U1", Args: map[string]string{"0": info.ID}},
+	} {
+		if response := npc.ProcessRequest(other); !errors.Is(response.Error, ErrNotFound) {
+			t.Errorf("Expected the job to be hidden from %s %s, got %+v", other.Identity, other.User, response)
+		}
+	}
+}
+
+// TestJobsWithoutAuth tests that, with nothing authenticating requests, jobs belong to the user
+// they name or else the address they came from, and are reached by the short aliases.
+func TestJobsWithoutAuth(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{
+		Name: "wait",
+		JobHandler: func(job *Job) Response {
+			<-job.Context().Done()
+			return Response{Error: job.Context().Err()}
+		},
+	})
+
+	for _, caller := range []Request{{User: "U1"}, {Args: map[string]string{RemoteAddrArg: "192.0.2.1"}}} {
+		start := caller
+		start.Action = "wait"
+		id := npc.ProcessRequest(start).Payload.(JobInfo).ID
+
+		list := caller
+		list.Action = "jobs"
+		if response := npc.ProcessRequest(list); !strings.Contains(response.Data, id+" wait: running") {
+			t.Errorf("Expected the job in the listing for %+v, got %+v", caller, response)
+		}
+		other := Request{Action: "cancel", User: "U2", Args: map[string]string{"0": id}}
+		if response := npc.ProcessRequest(other); !errors.Is(response.Error, ErrNotFound) {
+			t.Errorf("Expected the job to be hidden from another user, got %+v", response)
+		}
+		cancel := caller
+		cancel.Action = "cancel"
+		cancel.Args = map[string]string{"0": id}
+		for k, v := range caller.Args {
+			cancel.Args[k] = v
+		}
+		if response := npc.ProcessRequest(cancel); response.Error != nil {
+			t.Errorf("Expected the job to be cancelled for %+v, got %v", caller, response.Error)
+		}
+	}
+}
+
+// TestCancelJob tests cancelling a running job.
+func TestCancelJob(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{
+		Name: "wait",
+		JobHandler: func(job *Job) Response {
+			<-job.Context().Done()
+			return Response{Error: job.Context().Err()}
+		},
+	})
+
+	response := npc.ProcessRequest(Request{Action: "wait", User: "U1", Identity: "slack:U1"})
+	id := response.Payload.(JobInfo).ID
+
+	response = npc.ProcessRequest(Request{Action: CancelAction, User: "U1", Identity: "slack:U1", Args: map[string]string{"0": id}})
+	if response.Error != nil {
+		t.Fatalf("cancel returned an error: %v", response.Error)
+	}
+
+	job, _ := npc.Jobs().Get(id)
+	if status := waitForStatus(t, job); status != JobCancelled {
+		t.Errorf("Expected job to be cancelled, got %s", status)
+	}
+
+	response = npc.ProcessRequest(Request{Action: CancelAction, User: "U1", Identity: "slack:U1", Args: map[string]string{"0": id}})
+	if !errors.Is(response.Error, ErrInvalidArguments) {
+		t.Errorf("Expected cancelling a finished job to fail, got %+v", response)
+	}
+}
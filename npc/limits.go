@@ -0,0 +1,166 @@
+package npc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Concurrency limits how many executions of an action may run at once. Zero values mean no limit.
+type Concurrency struct {
+	Max     int // Across all users
+	PerUser int // For any one caller, as told apart by Request.Caller
+	// Queue is how long an excess call waits for a free slot before failing with ErrBusy.
+	// Excess calls fail at once if it is zero.
+	Queue time.Duration
+}
+
+// ActionLoad is the number of executions of an action in flight, for monitoring.
+type ActionLoad struct {
+	Action  string `json:"action"`
+	Running int    `json:"running"`
+	Waiting int    `json:"waiting"` // Calls queued for a free slot
+}
+
+// limiter counts the executions of one action and enforces its Concurrency.
+type limiter struct {
+	limits Concurrency
+
+	mu      sync.Mutex
+	running int
+	waiting int
+	users   map[string]int
+	changed chan struct{} // Closed and replaced whenever a slot is freed
+}
+
+// newLimiter creates a limiter enforcing limits.
+func newLimiter(limits Concurrency) *limiter {
+	return &limiter{limits: limits, users: make(map[string]int), changed: make(chan struct{})}
+}
+
+// acquire takes a slot for user, waiting up to the queue time for one to be freed. It returns
+// a function that frees the slot, or an error if no slot became free.
+func (l *limiter) acquire(ctx context.Context, action, user string) (func(), error) {
+	var timeout <-chan time.Time
+	for {
+		l.mu.Lock()
+		if l.fits(user) {
+			l.running++
+			l.users[user]++
+			l.mu.Unlock()
+			return func() { l.release(user) }, nil
+		}
+		if l.limits.Queue <= 0 {
+			l.mu.Unlock()
+			return nil, Errorf(ErrBusy, "too many %s requests are running; try again shortly", action)
+		}
+		if timeout == nil {
+			timer := time.NewTimer(l.limits.Queue)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		changed := l.changed
+		l.waiting++
+		l.mu.Unlock()
+
+		var err error
+		select {
+		case <-changed:
+		case <-timeout:
+			err = Errorf(ErrBusy, "timed out waiting for one of the running %s requests to finish", action)
+		case <-ctx.Done():
+			err = contextError(ctx.Err())
+		}
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fits reports whether another execution for user is within the limits. The caller must hold l.mu.
+func (l *limiter) fits(user string) bool {
+	if l.limits.Max > 0 && l.running >= l.limits.Max {
+		return false
+	}
+	return l.limits.PerUser <= 0 || l.users[user] < l.limits.PerUser
+}
+
+// release frees a slot taken by user and wakes any waiting calls.
+func (l *limiter) release(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.running--
+	if l.users[user]--; l.users[user] <= 0 {
+		delete(l.users, user)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// load returns the limiter's current counts.
+func (l *limiter) load(action string) ActionLoad {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ActionLoad{Action: action, Running: l.running, Waiting: l.waiting}
+}
+
+// InFlight lists how many executions of each action are running or waiting, sorted by action.
+// Actions with none are left out. Asynchronous actions count as running until their job finishes.
+func (n *Npc) InFlight() []ActionLoad {
+	n.mu.RLock()
+	entries := make(map[string]*actionEntry, len(n.actions))
+	for name, entry := range n.actions {
+		entries[name] = entry
+	}
+	n.mu.RUnlock()
+
+	loads := make([]ActionLoad, 0)
+	for name, entry := range entries {
+		if load := entry.limiter.load(name); load.Running > 0 || load.Waiting > 0 {
+			loads = append(loads, load)
+		}
+	}
+	sort.Slice(loads, func(i, j int) bool { return loads[i].Action < loads[j].Action })
+	return loads
+}
+
+// runWithTimeout runs a handler, giving up on it when the action's timeout passes. The handler's
+// context is cancelled then, but a handler that ignores it runs on in the background, and done
+// is called only once it returns.
+func (n *Npc) runWithTimeout(ctx context.Context, action Action, request Request, done func()) Response {
+	ctx, cancel := context.WithTimeout(ctx, action.Timeout)
+	defer cancel()
+
+	result := make(chan Response, 1)
+	go func() {
+		defer done()
+		result <- n.callHandler(ctx, action.handler(), request)
+	}()
+
+	select {
+	case response := <-result:
+		return response
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return Response{Error: &Error{
+				Kind:    ErrTimeout,
+				Message: fmt.Sprintf("action %s timed out after %s", action.Name, action.Timeout),
+				Err:     ctx.Err(),
+			}}
+		}
+		return Response{Error: contextError(ctx.Err())}
+	}
+}
+
+// callHandler runs a handler, recovering from any panic.
+func (n *Npc) callHandler(ctx context.Context, handler RequestHandler, request Request) (response Response) {
+	defer n.recoverPanic(request, true, &response)
+	return handler(ctx, request)
+}
@@ -0,0 +1,112 @@
+package npc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestActionTimeout tests that a handler that overruns its timeout fails with ErrTimeout.
+func TestActionTimeout(t *testing.T) {
+	npc := NewNpc()
+	release := make(chan struct{})
+	npc.RegisterAction(Action{
+		Name:    "stuck",
+		Timeout: 10 * time.Millisecond,
+		Handler: func(request Request) Response {
+			<-release // Ignores its context
+			return Response{Data: "done"}
+		},
+	})
+	npc.RegisterAction(Action{Name: "quick", Timeout: time.Second, Handler: func(request Request) Response { return Response{Data: "done"} }})
+
+	if response := npc.ProcessRequest(Request{Action: "quick"}); response.Data != "done" {
+		t.Errorf("Expected a quick handler to finish, got %+v", response)
+	}
+	response := npc.ProcessRequest(Request{Action: "stuck"})
+	if !errors.Is(response.Error, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got %+v", response)
+	}
+
+	// The abandoned handler still counts as running until it returns
+	if loads := npc.InFlight(); !reflect.DeepEqual(loads, []ActionLoad{{Action: "stuck", Running: 1}}) {
+		t.Errorf("Unexpected in-flight counts %+v", loads)
+	}
+	close(release)
+	for deadline := time.Now().Add(time.Second); len(npc.InFlight()) > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if loads := npc.InFlight(); len(loads) != 0 {
+		t.Errorf("Expected nothing in flight, got %+v", loads)
+	}
+}
+
+// TestConcurrencyLimits tests that excess calls are rejected or queued.
+func TestConcurrencyLimits(t *testing.T) {
+	npc := NewNpc()
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := func(request Request) Response {
+		started <- struct{}{}
+		<-release
+		return Response{Data: "done"}
+	}
+	npc.RegisterAction(Action{Name: "reject", Concurrency: Concurrency{PerUser: 1}, Handler: handler})
+	npc.RegisterAction(Action{Name: "queue", Concurrency: Concurrency{Max: 1, Queue: time.Second}, Handler: handler})
+
+	caller := func(action, identity string) Request {
+		return Request{Action: action, User: "alice", Identity: identity, Strength: AuthVerified}
+	}
+	results := make(chan Response, 4)
+	go func() { results <- npc.ProcessRequest(caller("reject", "slack:alice")) }()
+	<-started
+	if response := npc.ProcessRequest(caller("reject", "slack:alice")); !errors.Is(response.Error, ErrBusy) {
+		t.Errorf("Expected a second call from alice to be rejected, got %+v", response)
+	}
+	// A shared-token caller claiming to be alice does not take her slot, nor get one of its own
+	shared := Request{Action: "reject", User: "alice", Identity: "apikey:shared", Strength: AuthShared, Args: map[string]string{RemoteAddrArg: "192.0.2.1"}}
+	go func() { results <- npc.ProcessRequest(shared) }()
+	<-started
+	shared.User = "mallory"
+	if response := npc.ProcessRequest(shared); !errors.Is(response.Error, ErrBusy) {
+		t.Errorf("Expected a shared-token caller claiming another user to be rejected, got %+v", response)
+	}
+
+	go func() { results <- npc.ProcessRequest(caller("queue", "slack:alice")) }()
+	<-started
+	go func() { results <- npc.ProcessRequest(caller("queue", "slack:bob")) }()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if loads := npc.InFlight(); len(loads) == 2 && loads[0].Waiting == 1 {
+			break
+		}
+	}
+	expected := []ActionLoad{{Action: "queue", Running: 1, Waiting: 1}, {Action: "reject", Running: 2}}
+	if loads := npc.InFlight(); !reflect.DeepEqual(loads, expected) {
+		t.Errorf("Expected in-flight counts %+v, got %+v", expected, loads)
+	}
+
+	close(release)
+	<-started // The queued call runs once a slot is free
+	for range 4 {
+		if response := <-results; response.Data != "done" {
+			t.Errorf("Unexpected response %+v", response)
+		}
+	}
+}
+
+// TestConcurrencyQueueTimeout tests that a queued call gives up when no slot is freed in time.
+func TestConcurrencyQueueTimeout(t *testing.T) {
+	l := newLimiter(Concurrency{Max: 1, Queue: 10 * time.Millisecond})
+	done, err := l.acquire(context.Background(), "deploy", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.acquire(context.Background(), "deploy", "bob"); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy after queueing, got %v", err)
+	}
+	done()
+	if _, err := l.acquire(context.Background(), "deploy", "bob"); err != nil {
+		t.Errorf("Expected a freed slot to be taken, got %v", err)
+	}
+}
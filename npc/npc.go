@@ -1,58 +1,431 @@
 package npc
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
 
 // Middleware defines the interface for middleware components.
 type Middleware interface {
 	Execute(request *Request) error
 }
 
+// ContextMiddleware is implemented by middleware that needs the request context,
+// for example to stop work early when the caller has gone away.
+type ContextMiddleware interface {
+	ExecuteContext(ctx context.Context, request *Request) error
+}
+
+// Next invokes the remainder of the pipeline: any later middleware followed by the action.
+type Next func(ctx context.Context, request Request) Response
+
+// WrapMiddleware is middleware that wraps the rest of the pipeline. Unlike Middleware it runs
+// both before and after the action, so it can inspect or rewrite the Response, time the
+// handler or skip the action entirely by not calling next.
+type WrapMiddleware interface {
+	Handle(ctx context.Context, request Request, next Next) Response
+}
+
+// Router is implemented by global middleware that may send a request to a different action, such
+// as a follow-up message to the action waiting for it. Every Router routes the request, in the
+// order the middleware was added, before any middleware runs, so that authorization, rate limits
+// and audit logs apply to the action that will actually run.
+type Router interface {
+	Route(ctx context.Context, request *Request) error
+}
+
+// WrapFunc is an adapter that allows an ordinary function to be used as WrapMiddleware.
+type WrapFunc func(ctx context.Context, request Request, next Next) Response
+
+// Handle calls f(ctx, request, next).
+func (f WrapFunc) Handle(ctx context.Context, request Request, next Next) Response {
+	return f(ctx, request, next)
+}
+
+// RequestHandler processes a request within a context. Channels hand incoming requests to a RequestHandler.
+type RequestHandler func(ctx context.Context, request Request) Response
+
 // Action defines the structure for bot actions.
 type Action struct {
 	Name        string
 	Description string
-	Handler     func(Request) Response
+	// Aliases are other names that run the action, such as "d" for "deploy".
+	Aliases []string
+	// Triggers let free text that names no action run this one.
+	Triggers []Trigger
+	Handler  func(Request) Response
+	// ContextHandler is used in preference to Handler when set.
+	ContextHandler RequestHandler
+	// Params declares the arguments the action accepts. When set, arguments are validated
+	// and defaults filled in before the handler is called.
+	Params []Param
+	// Examples are sample invocations shown by the help action.
+	Examples []string
+	// JobHandler makes the action asynchronous. When set it is used in preference to the other
+	// handlers: it runs in the background as a Job and the caller immediately receives the job ID.
+	JobHandler func(job *Job) Response
+	// Timeout, if set, is the longest the handler may run before the request fails with ErrTimeout.
+	// A job's context is cancelled once it has run this long.
+	Timeout time.Duration
+	// Concurrency limits how many executions may run at once. Excess calls fail with ErrBusy.
+	Concurrency Concurrency
+}
+
+// actionEntry is a registered action along with its compiled argument schema and the
+// count of its executions.
+type actionEntry struct {
+	action  Action
+	schema  *schema
+	limiter *limiter
+}
+
+// handler returns the action's handler, adapting a context-free Handler where needed.
+func (a Action) handler() RequestHandler {
+	if a.ContextHandler != nil {
+		return a.ContextHandler
+	}
+	if a.Handler == nil {
+		return nil
+	}
+	return func(ctx context.Context, request Request) Response {
+		return a.Handler(request)
+	}
+}
+
+// contextAdapter lets a context-free Middleware take part in a context-aware chain.
+type contextAdapter struct {
+	Middleware
+}
+
+// ExecuteContext calls the wrapped middleware, ignoring the context.
+func (c contextAdapter) ExecuteContext(ctx context.Context, request *Request) error {
+	return c.Execute(request)
 }
 
-// Npc is the core bot engine.
+// wrapAdapter lets before-only middleware take part in a wrap-style chain.
+type wrapAdapter struct {
+	ContextMiddleware
+}
+
+// Handle runs the wrapped middleware and, if it succeeds, the rest of the pipeline
+// with the possibly modified request.
+func (w wrapAdapter) Handle(ctx context.Context, request Request, next Next) Response {
+	if err := w.ExecuteContext(ctx, &request); err != nil {
+		return Response{Error: err} // Stop chain on error
+	}
+	return next(ctx, request)
+}
+
+// Npc is the core bot engine. It is safe for concurrent use: actions and middleware may be
+// registered, replaced or removed while requests are being processed.
 type Npc struct {
-	actions    map[string]Action
-	middleware []Middleware
+	mu         sync.RWMutex
+	actions    map[string]*actionEntry
+	aliases    map[string]string            // Alias to action name
+	triggers   []*trigger                   // In the order they are tried
+	middleware []middlewareEntry            // Global middleware
+	scoped     map[string][]middlewareEntry // Group and action middleware, keyed by scope
+	senders    map[string]Sender            // Keyed by request Source
+	outbound   []OutboundMiddleware
+	channels   []Channel
+	jobs       *JobStore
+	correct    bool // Whether to run the only close match for a mistyped action
+
+	observers   []*observerQueue
+	panicHooks  []func(PanicReport)
+	quarantine  quarantinePolicy
+	panics      map[string][]time.Time // Recent handler panics, keyed by action
+	quarantined map[string]bool        // Actions disabled after repeated panics
+
+	// Resolved chains, rebuilt on first use after any registration change.
+	global Next
+	chains map[string]Next
 }
 
-// NewNpc creates a new Npc instance.
+// NewNpc creates a new Npc instance with the built-in help and job actions registered.
 func NewNpc() *Npc {
-	return &Npc{
-		actions:    make(map[string]Action),
-		middleware: make([]Middleware, 0),
+	n := &Npc{
+		actions:    make(map[string]*actionEntry),
+		aliases:    make(map[string]string),
+		middleware: make([]middlewareEntry, 0),
+		scoped:     make(map[string][]middlewareEntry),
+		chains:     make(map[string]Next),
+		senders:    make(map[string]Sender),
+		jobs:       NewJobStore(),
+
+		panics:      make(map[string][]time.Time),
+		quarantined: make(map[string]bool),
+	}
+	n.RegisterAction(n.helpAction())
+	for _, action := range n.jobActions() {
+		n.RegisterAction(action)
 	}
+	return n
 }
 
-// RegisterAction adds a new action to the bot.
-func (n *Npc) RegisterAction(action Action) {
-	n.actions[action.Name] = action
+// RegisterAction adds a new action to the bot, atomically replacing any action with the same name.
+// It returns an error if the action's parameter or trigger declarations are invalid, if its name
+// or one of its aliases is already used by another action, or if one of its triggers conflicts
+// with another action's.
+func (n *Npc) RegisterAction(action Action) error {
+	schema, err := compileSchema(action)
+	if err != nil {
+		return err
+	}
+	triggers, err := compileTriggers(action)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if owner, ok := n.aliases[action.Name]; ok {
+		return fmt.Errorf("action %s: name is an alias of %s", action.Name, owner)
+	}
+	for _, alias := range action.Aliases {
+		if _, ok := n.actions[alias]; ok && alias != action.Name {
+			return fmt.Errorf("action %s: alias %s is the name of another action", action.Name, alias)
+		}
+		if owner, ok := n.aliases[alias]; ok && owner != action.Name {
+			return fmt.Errorf("action %s: alias %s is already used by %s", action.Name, alias, owner)
+		}
+	}
+	if err := n.checkTriggers(action.Name, triggers); err != nil {
+		return err
+	}
+
+	n.removeAliases(action.Name)
+	for _, alias := range action.Aliases {
+		if alias != action.Name {
+			n.aliases[alias] = action.Name
+		}
+	}
+	n.setTriggers(action.Name, triggers)
+	n.actions[action.Name] = &actionEntry{action: action, schema: schema, limiter: newLimiter(action.Concurrency)}
+	n.invalidate()
+	return nil
 }
 
-// Use adds a new middleware to the pipeline.
-func (n *Npc) Use(middleware Middleware) {
-	n.middleware = append(n.middleware, middleware)
+// resolve returns the name of the action that name is an alias of, or name itself.
+func (n *Npc) resolve(name string) string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if target, ok := n.aliases[name]; ok {
+		return target
+	}
+	return name
+}
+
+// removeAliases forgets the aliases of an action. The caller must hold n.mu.
+func (n *Npc) removeAliases(name string) {
+	if entry, ok := n.actions[name]; ok {
+		for _, alias := range entry.action.Aliases {
+			if n.aliases[alias] == name {
+				delete(n.aliases, alias)
+			}
+		}
+	}
+}
+
+// Use adds a new middleware to the end of the pipeline. The middleware must implement WrapMiddleware,
+// ContextMiddleware or Middleware, and is preferred in that order when it implements several.
+// All forms share one chain and run in the order they were added. The middleware is named by
+// its Name method if it has one, or else by its type; see UseNamed.
+func (n *Npc) Use(middleware interface{}) {
+	n.UseNamed(middlewareName(middleware), middleware)
+}
+
+// toWrapMiddleware converts any supported middleware form into WrapMiddleware.
+func toWrapMiddleware(middleware interface{}) WrapMiddleware {
+	switch m := middleware.(type) {
+	case WrapMiddleware:
+		return m
+	case ContextMiddleware:
+		return wrapAdapter{m}
+	case Middleware:
+		return wrapAdapter{contextAdapter{m}}
+	default:
+		panic(fmt.Sprintf("npc: unsupported middleware type %T", middleware))
+	}
 }
 
 // ProcessRequest processes a request by executing the middleware chain and then the appropriate action.
 func (n *Npc) ProcessRequest(request Request) Response {
-	currentRequest := &request // Pass a pointer to the request
+	return n.ProcessRequestContext(context.Background(), request)
+}
+
+// ProcessRequestContext is like ProcessRequest but carries ctx through every middleware and
+// into the action handler. Processing stops as soon as ctx is cancelled or its deadline passes.
+// Before any middleware runs, global middleware implementing Router may route the request to
+// another action, an alias in request.Action is replaced with the action's name, and a request
+// naming no registered action may be routed by a Trigger or corrected (see SetAutoCorrect).
+//
+// Global middleware runs first. The action's group middleware, outermost group first, and then
+// its own middleware run next.
+//
+// A panic in middleware or a handler is recovered and returned as an ErrInternal error carrying
+// a PanicError; see OnPanic and SetQuarantine.
+func (n *Npc) ProcessRequestContext(ctx context.Context, request Request) (response Response) {
+	// Observers see the action an alias names, but routers see the word the caller used, as a
+	// conversation may capture a word that is also an alias
+	received := request
+	received.Action = n.resolve(request.Action)
+	start := time.Now()
+	n.emit(Event{Type: EventRequestReceived, Request: received, Time: start})
+	defer n.finishRequest(received, start, &response)
+	defer n.recoverPanic(received, false, &response)
+
+	ctx, err := n.route(ctx, &request)
+	if err != nil {
+		return Response{Error: err}
+	}
+	return n.runGlobal(ctx, request)
+}
+
+// route decides which action a request runs before any middleware sees it. Each global Router
+// may change the action, any alias is resolved, and an unknown action may be routed by a trigger
+// or else corrected. Middleware therefore authorizes, limits and logs the action that will run
+// rather than the one the caller named. It returns the context to run the request in.
+func (n *Npc) route(ctx context.Context, request *Request) (context.Context, error) {
+	n.mu.RLock()
+	middleware := n.middleware
+	n.mu.RUnlock()
 
-	for _, m := range n.middleware {
-		err := m.Execute(currentRequest)
-		if err != nil {
-			return Response{Error: err} // Stop chain on error
+	for _, m := range middleware {
+		if router, ok := m.value.(Router); ok {
+			if err := router.Route(ctx, request); err != nil {
+				return ctx, err
+			}
 		}
 	}
+	request.Action = n.resolve(request.Action)
+	if n.routeTrigger(request) {
+		return ctx, nil
+	}
+	return n.autoCorrect(ctx, request), nil
+}
+
+// runGlobal runs a request through the global middleware and then its action.
+func (n *Npc) runGlobal(ctx context.Context, request Request) Response {
+	n.mu.RLock()
+	global := n.global
+	n.mu.RUnlock()
 
-	// After all middleware, execute the action
-	// If the action is not found, return an error response.
-	if action, ok := n.actions[currentRequest.Action]; ok {
-		return action.Handler(*currentRequest) // Pass the dereferenced request to the handler
+	if global == nil {
+		n.mu.Lock()
+		if n.global == nil {
+			n.global = n.buildChain(n.middleware, n.dispatch)
+		}
+		global = n.global
+		n.mu.Unlock()
 	}
-	return Response{Error: fmt.Errorf("action %s not found", currentRequest.Action)}
+	return global(ctx, request)
+}
+
+// dispatch runs the action named by the request through its scoped middleware.
+// It is the innermost step of the global chain.
+func (n *Npc) dispatch(ctx context.Context, request Request) Response {
+	if err := ctx.Err(); err != nil {
+		return Response{Error: contextError(err)}
+	}
+
+	request.Action = n.resolve(request.Action)
+	if n.isQuarantined(request.Action) {
+		return Response{Error: Errorf(ErrUnavailable, "action %s is disabled after repeated failures", request.Action)}
+	}
+	if chain := n.actionChain(request.Action); chain != nil {
+		announceCorrection(ctx, request)
+		return chain(ctx, request)
+	}
+	// If the action is not found, suggest close matches.
+	return n.notFound(ctx, request)
+}
+
+// actionChain returns the cached chain of scoped middleware and handler for an action,
+// resolving it on first use. It returns nil if there is no such action.
+func (n *Npc) actionChain(name string) Next {
+	n.mu.RLock()
+	chain, ok := n.chains[name]
+	n.mu.RUnlock()
+	if ok {
+		return chain
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if chain, ok := n.chains[name]; ok {
+		return chain
+	}
+	entry, ok := n.actions[name]
+	if !ok || (entry.action.handler() == nil && entry.action.JobHandler == nil) {
+		return nil
+	}
+	invoke := func(ctx context.Context, request Request) Response {
+		return n.invoke(ctx, entry, request)
+	}
+	chain = n.buildChain(n.scopedMiddleware(name), func(ctx context.Context, request Request) Response {
+		start := time.Now()
+		n.emit(Event{Type: EventActionStarted, Request: request, Time: start})
+		response := n.callHandler(ctx, invoke, request)
+		n.emit(Event{Type: EventActionCompleted, Request: request, Response: response, Duration: time.Since(start)})
+		return response
+	})
+	n.chains[name] = chain
+	return chain
+}
+
+// invoke validates the request's arguments and, within the action's concurrency limits, runs its
+// handler or starts a job for asynchronous actions.
+func (n *Npc) invoke(ctx context.Context, entry *actionEntry, request Request) Response {
+	caller := request.Caller()
+	args, err := entry.schema.bind(entry.action.Name, request.Args)
+	if err != nil {
+		return Response{Error: err}
+	}
+	request.Args = args
+
+	release, err := entry.limiter.acquire(ctx, entry.action.Name, caller)
+	if err != nil {
+		return Response{Error: err}
+	}
+	switch {
+	case entry.action.JobHandler != nil:
+		return n.startJob(ctx, entry.action, request, release)
+	case entry.action.Timeout > 0:
+		return n.runWithTimeout(ctx, entry.action, request, release)
+	}
+	defer release()
+	return entry.action.handler()(ctx, request)
+}
+
+// buildChain wraps handler in middleware, so that middleware[0] runs first. A middleware that
+// fails the request without calling the rest of the chain is reported to observers as rejecting it.
+func (n *Npc) buildChain(middleware []middlewareEntry, handler Next) Next {
+	next := handler
+	for i := len(middleware) - 1; i >= 0; i-- {
+		m, inner := middleware[i], next
+		next = func(ctx context.Context, request Request) Response {
+			if err := ctx.Err(); err != nil {
+				return Response{Error: contextError(err)}
+			}
+			start, called := time.Now(), false
+			response := m.wrap.Handle(ctx, request, func(ctx context.Context, request Request) Response {
+				called = true
+				return inner(ctx, request)
+			})
+			if !called && response.Error != nil {
+				n.emit(Event{Type: EventMiddlewareRejected, Request: request, Response: response, Middleware: m.name, Duration: time.Since(start)})
+			}
+			return response
+		}
+	}
+	return next
+}
+
+// invalidate discards resolved chains after a registration change. The caller must hold n.mu.
+func (n *Npc) invalidate() {
+	n.global = nil
+	n.chains = make(map[string]Next)
 }
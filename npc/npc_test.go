@@ -1,6 +1,9 @@
 package npc
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -96,3 +99,143 @@ func TestProcessRequest(t *testing.T) {
 	}
 }
 
+
+// ctxKey is used to pass test values through a context.
+type ctxKey struct{}
+
+// MockContextMiddleware is a mock context-aware middleware for testing.
+type MockContextMiddleware struct {
+	seen interface{}
+}
+
+// ExecuteContext records the value stored in the context.
+func (m *MockContextMiddleware) ExecuteContext(ctx context.Context, request *Request) error {
+	m.seen = ctx.Value(ctxKey{})
+	return nil
+}
+
+// TestProcessRequestContext tests that the context reaches middleware and handlers.
+func TestProcessRequestContext(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{
+		Name: "test",
+		ContextHandler: func(ctx context.Context, request Request) Response {
+			return Response{Data: ctx.Value(ctxKey{}).(string)}
+		},
+	})
+
+	contextMiddleware := &MockContextMiddleware{}
+	legacyMiddleware := &MockMiddleware{}
+	npc.Use(contextMiddleware)
+	npc.Use(legacyMiddleware)
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	response := npc.ProcessRequestContext(ctx, Request{Action: "test"})
+
+	if response.Error != nil {
+		t.Fatalf("ProcessRequestContext() returned an error: %v", response.Error)
+	}
+	if response.Data != "value" {
+		t.Errorf("Expected handler to see context value, got %q", response.Data)
+	}
+	if contextMiddleware.seen != "value" {
+		t.Errorf("Expected middleware to see context value, got %v", contextMiddleware.seen)
+	}
+	if !legacyMiddleware.executed {
+		t.Error("ProcessRequestContext() did not execute the legacy middleware")
+	}
+}
+
+// TestProcessRequestContextCancelled tests that a cancelled context stops processing.
+func TestProcessRequestContextCancelled(t *testing.T) {
+	npc := NewNpc()
+	called := false
+	npc.RegisterAction(Action{
+		Name: "test",
+		Handler: func(request Request) Response {
+			called = true
+			return Response{Data: "test"}
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	response := npc.ProcessRequestContext(ctx, Request{Action: "test"})
+	if !errors.Is(response.Error, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", response.Error)
+	}
+	if called {
+		t.Error("Handler was called for a cancelled request")
+	}
+}
+
+// TestUseUnsupportedMiddleware tests that Use rejects values that are not middleware.
+func TestUseUnsupportedMiddleware(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Use() did not panic for an unsupported middleware type")
+		}
+	}()
+	NewNpc().Use("not middleware")
+}
+
+// TestWrapMiddleware tests that wrap-style middleware sees the response and runs in order with other forms.
+func TestWrapMiddleware(t *testing.T) {
+	npc := NewNpc()
+	var order []string
+	npc.RegisterAction(Action{
+		Name: "test",
+		Handler: func(request Request) Response {
+			order = append(order, "action")
+			return Response{Data: "secret " + request.Args["name"]}
+		},
+	})
+
+	npc.Use(WrapFunc(func(ctx context.Context, request Request, next Next) Response {
+		order = append(order, "wrap before")
+		response := next(ctx, request)
+		order = append(order, "wrap after")
+		response.Data = strings.Replace(response.Data, "secret", "[redacted]", 1)
+		return response
+	}))
+	legacyMiddleware := &MockMiddleware{}
+	npc.Use(legacyMiddleware)
+
+	response := npc.ProcessRequest(Request{Action: "test", Args: map[string]string{"name": "bob"}})
+
+	if response.Data != "[redacted] bob" {
+		t.Errorf("Expected rewritten response, got %q", response.Data)
+	}
+	if !legacyMiddleware.executed {
+		t.Error("ProcessRequest() did not execute the legacy middleware")
+	}
+	expected := []string{"wrap before", "action", "wrap after"}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected order %v, got %v", expected, order)
+	}
+}
+
+// TestWrapMiddlewareShortCircuit tests that wrap-style middleware can skip the action.
+func TestWrapMiddlewareShortCircuit(t *testing.T) {
+	npc := NewNpc()
+	called := false
+	npc.RegisterAction(Action{
+		Name: "test",
+		Handler: func(request Request) Response {
+			called = true
+			return Response{Data: "test"}
+		},
+	})
+	npc.Use(WrapFunc(func(ctx context.Context, request Request, next Next) Response {
+		return Response{Data: "cached"}
+	}))
+
+	response := npc.ProcessRequest(Request{Action: "test"})
+	if response.Data != "cached" {
+		t.Errorf("Expected short-circuit response, got %q", response.Data)
+	}
+	if called {
+		t.Error("Handler was called despite middleware not calling next")
+	}
+}
@@ -0,0 +1,155 @@
+package npc
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultObserverBuffer is how many events an observer may fall behind by when no buffer is set.
+const DefaultObserverBuffer = 256
+
+// EventType identifies a point in the life of a request.
+type EventType string
+
+// Event types.
+const (
+	EventRequestReceived    EventType = "request_received"
+	EventMiddlewareRejected EventType = "middleware_rejected"
+	EventActionStarted      EventType = "action_started"
+	EventActionCompleted    EventType = "action_completed"
+	EventRequestCompleted   EventType = "request_completed"
+	EventError              EventType = "error"
+)
+
+// Event describes something that happened while processing a request.
+type Event struct {
+	Type    EventType
+	Request Request
+	// Response is the result so far: the action's response for EventActionCompleted, the
+	// rejection for EventMiddlewareRejected and the final response for EventRequestCompleted
+	// and EventError. It is empty for events before a response exists.
+	Response Response
+	// Middleware names the middleware that rejected the request, for EventMiddlewareRejected.
+	Middleware string
+	Time       time.Time // When the event happened
+	// Duration is how long the middleware, action or whole request took, for events that end one.
+	Duration time.Duration
+}
+
+// Observer receives events about requests, for analytics, alerting and debugging. Any hook may
+// be nil. Hooks are called in the order events happen, but on a goroutine of the observer's own,
+// so a slow observer cannot hold up requests: if it falls more than Buffer events behind, newer
+// events are dropped until it catches up.
+type Observer struct {
+	OnRequestReceived    func(Event)
+	OnMiddlewareRejected func(Event)
+	OnActionStarted      func(Event)
+	OnActionCompleted    func(Event)
+	OnRequestCompleted   func(Event)
+	// OnError is called, after OnRequestCompleted, for every request that ends in an error.
+	OnError func(Event)
+	// Buffer is how many events may wait for the hooks, DefaultObserverBuffer if zero.
+	Buffer int
+}
+
+// observerQueue delivers events to an observer.
+type observerQueue struct {
+	observer Observer
+	events   chan Event
+	dropped  atomic.Int64
+}
+
+// Observe adds an observer and returns a function that removes it. Events already queued for
+// the observer are still delivered after it is removed.
+func (n *Npc) Observe(observer Observer) (remove func()) {
+	size := observer.Buffer
+	if size <= 0 {
+		size = DefaultObserverBuffer
+	}
+	q := &observerQueue{observer: observer, events: make(chan Event, size)}
+	go q.run()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.observers = append(n.observers[:len(n.observers):len(n.observers)], q)
+
+	return func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		for i, current := range n.observers {
+			if current == q {
+				observers := make([]*observerQueue, 0, len(n.observers)-1)
+				observers = append(observers, n.observers[:i]...)
+				n.observers = append(observers, n.observers[i+1:]...)
+				close(q.events)
+				return
+			}
+		}
+	}
+}
+
+// emit queues an event for every observer without waiting for any of them.
+func (n *Npc) emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, q := range n.observers {
+		select {
+		case q.events <- event:
+		default:
+			if q.dropped.Add(1) == 1 {
+				log.Printf("Observer is falling behind; dropping events")
+			}
+		}
+	}
+}
+
+// run calls the observer's hooks for each event until the observer is removed.
+func (q *observerQueue) run() {
+	for event := range q.events {
+		q.deliver(event)
+	}
+}
+
+// deliver calls the hook for an event. A panicking hook is logged and does not stop the observer.
+func (q *observerQueue) deliver(event Event) {
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("Observer panicked handling %s event: %v", event.Type, v)
+		}
+	}()
+
+	var hook func(Event)
+	switch event.Type {
+	case EventRequestReceived:
+		hook = q.observer.OnRequestReceived
+	case EventMiddlewareRejected:
+		hook = q.observer.OnMiddlewareRejected
+	case EventActionStarted:
+		hook = q.observer.OnActionStarted
+	case EventActionCompleted:
+		hook = q.observer.OnActionCompleted
+	case EventRequestCompleted:
+		hook = q.observer.OnRequestCompleted
+	case EventError:
+		hook = q.observer.OnError
+	}
+	if hook != nil {
+		hook(event)
+	}
+}
+
+// finishRequest reports the end of a request to observers. It must be deferred so that it sees
+// the final response.
+func (n *Npc) finishRequest(request Request, start time.Time, response *Response) {
+	event := Event{Type: EventRequestCompleted, Request: request, Response: *response, Duration: time.Since(start)}
+	n.emit(event)
+	if response.Error != nil {
+		event.Type = EventError
+		n.emit(event)
+	}
+}
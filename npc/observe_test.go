@@ -0,0 +1,105 @@
+package npc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// rejectMiddleware is middleware that rejects every request.
+type rejectMiddleware struct{}
+
+// Execute rejects the request.
+func (rejectMiddleware) Execute(request *Request) error {
+	return ErrForbidden
+}
+
+// TestObserver tests that observers receive the events of each request in order.
+func TestObserver(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{Name: "hello", Handler: func(request Request) Response { return Response{Data: "hi"} }})
+	npc.ForAction("secret").UseNamed("guard", rejectMiddleware{})
+	npc.RegisterAction(Action{Name: "secret", Handler: func(request Request) Response { return Response{Data: "secret"} }})
+
+	events := make(chan Event, 20)
+	record := func(event Event) { events <- event }
+	remove := npc.Observe(Observer{
+		OnRequestReceived:    record,
+		OnMiddlewareRejected: record,
+		OnActionStarted:      record,
+		OnActionCompleted:    record,
+		OnRequestCompleted:   record,
+		OnError:              record,
+	})
+
+	receive := func(count int) []Event {
+		var received []Event
+		for range count {
+			select {
+			case event := <-events:
+				received = append(received, event)
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for events, got %+v", received)
+			}
+		}
+		return received
+	}
+	types := func(events []Event) []EventType {
+		types := make([]EventType, len(events))
+		for i, event := range events {
+			types[i] = event.Type
+		}
+		return types
+	}
+
+	npc.ProcessRequest(Request{Action: "hello"})
+	received := receive(4)
+	expected := []EventType{EventRequestReceived, EventActionStarted, EventActionCompleted, EventRequestCompleted}
+	if !reflect.DeepEqual(types(received), expected) {
+		t.Errorf("Expected events %v, got %v", expected, types(received))
+	}
+	if received[2].Response.Data != "hi" || received[3].Duration <= 0 {
+		t.Errorf("Expected the response and timing in the events, got %+v", received)
+	}
+
+	npc.ProcessRequest(Request{Action: "secret"})
+	received = receive(4)
+	expected = []EventType{EventRequestReceived, EventMiddlewareRejected, EventRequestCompleted, EventError}
+	if !reflect.DeepEqual(types(received), expected) {
+		t.Errorf("Expected events %v, got %v", expected, types(received))
+	}
+	if received[1].Middleware != "guard" || !errors.Is(received[3].Response.Error, ErrForbidden) {
+		t.Errorf("Expected the rejecting middleware and error, got %+v", received)
+	}
+
+	remove()
+	npc.ProcessRequest(Request{Action: "hello"})
+	select {
+	case event := <-events:
+		t.Errorf("Expected no events after removing the observer, got %+v", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// TestSlowObserver tests that a slow observer does not hold up requests.
+func TestSlowObserver(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{Name: "hello", Handler: func(request Request) Response { return Response{Data: "hi"} }})
+	block := make(chan struct{})
+	defer close(block)
+	npc.Observe(Observer{OnRequestReceived: func(Event) { <-block }, Buffer: 1})
+
+	done := make(chan struct{})
+	go func() {
+		for range 10 {
+			npc.ProcessRequest(Request{Action: "hello"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Requests were held up by a slow observer")
+	}
+}
@@ -0,0 +1,177 @@
+package npc
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// CommandParser turns chat text into an action name and arguments, so that a command such as
+//
+//	deploy api env=prod --force --note="ship it"
+//
+// means the same thing on every text channel. The first word is the action. Later words are
+// positional arguments, key=value pairs or --flags. Double quotes group words and allow
+// backslash escapes, single quotes group words literally, and a backslash outside quotes
+// escapes the next character. A lone "--" ends flag parsing.
+type CommandParser struct {
+	// Prefix, if set, must start the text for it to be treated as a command, e.g. "!".
+	Prefix string
+	// Mentions are accepted in place of Prefix, e.g. the bot's "<@U123ABC>" Slack mention.
+	Mentions []string
+}
+
+// CommandTextArg is the argument in which text channels pass the text of a command, without the
+// prefix or mention that addressed it to the bot, so that a message parsed as a command can be
+// recovered as it was typed.
+const CommandTextArg = "command_text"
+
+// Command is the result of parsing a message.
+type Command struct {
+	Action string
+	// Text is the command as typed, without the prefix or mention.
+	Text string
+	// Args holds key=value pairs, flags ("true" unless given as --flag=value) and
+	// positional arguments keyed by PositionalArg.
+	Args map[string]string
+}
+
+// PositionalArg returns the Args key used for the i-th (zero based) positional argument.
+func PositionalArg(i int) string {
+	return strconv.Itoa(i)
+}
+
+// smartQuotes normalises the typographic quotes some chat clients substitute while typing.
+var smartQuotes = strings.NewReplacer("\u201c", `"`, "\u201d", `"`, "\u2018", "'", "\u2019", "'")
+
+// token is a word of input along with where its first unquoted '=' was, if any.
+type token struct {
+	text   string
+	equals int
+}
+
+// Parse parses text into a Command. It returns nil when text is not addressed to the bot,
+// because a required prefix or mention is missing, or when it contains no command.
+// Malformed input, such as an unterminated quote, is reported as ErrInvalidArguments.
+func (p CommandParser) Parse(text string) (*Command, error) {
+	text, ok := p.strip(strings.TrimSpace(text))
+	if !ok {
+		return nil, nil
+	}
+
+	tokens, err := tokenize(smartQuotes.Replace(text))
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	command := &Command{Action: tokens[0].text, Text: text, Args: make(map[string]string)}
+	positional, flags := 0, true
+	for _, tok := range tokens[1:] {
+		switch {
+		case flags && tok.text == "--" && tok.equals < 0:
+			flags = false
+		case flags && strings.HasPrefix(tok.text, "--") && len(tok.text) > 2:
+			name, value := tok.text[2:], "true"
+			if tok.equals > 2 {
+				name, value = tok.text[2:tok.equals], tok.text[tok.equals+1:]
+			}
+			command.Args[name] = value
+		case tok.equals > 0 && isArgName(tok.text[:tok.equals]):
+			command.Args[tok.text[:tok.equals]] = tok.text[tok.equals+1:]
+		default:
+			command.Args[PositionalArg(positional)] = tok.text
+			positional++
+		}
+	}
+	return command, nil
+}
+
+// strip removes the prefix or mention from text, reporting whether one was required and found.
+func (p CommandParser) strip(text string) (string, bool) {
+	if p.Prefix == "" && len(p.Mentions) == 0 {
+		return text, true
+	}
+	for _, mention := range p.Mentions {
+		if mention != "" && strings.HasPrefix(text, mention) {
+			return strings.TrimLeft(text[len(mention):], ": \t"), true
+		}
+	}
+	if p.Prefix != "" && strings.HasPrefix(text, p.Prefix) {
+		return text[len(p.Prefix):], true
+	}
+	return "", false
+}
+
+// tokenize splits text into words, honouring quotes and escapes.
+func tokenize(text string) ([]token, error) {
+	var tokens []token
+	var current strings.Builder
+	inToken, equals := false, -1
+	var quote rune
+
+	flush := func() {
+		if inToken {
+			tokens = append(tokens, token{text: current.String(), equals: equals})
+		}
+		current.Reset()
+		inToken, equals = false, -1
+	}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\\' && quote != '\'':
+			if i+1 >= len(runes) {
+				return nil, Errorf(ErrInvalidArguments, "trailing backslash")
+			}
+			i++
+			current.WriteRune(runes[i])
+			inToken = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			if r == '=' && equals < 0 {
+				equals = current.Len()
+			}
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, Errorf(ErrInvalidArguments, "unterminated %c quote", quote)
+	}
+	flush()
+	return tokens, nil
+}
+
+// isArgName reports whether s can be used as the key of a key=value argument.
+func isArgName(s string) bool {
+	for i, r := range s {
+		switch {
+		case unicode.IsLetter(r) || r == '_':
+		case i > 0 && (unicode.IsDigit(r) || r == '-' || r == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,85 @@
+package npc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// TestCommandParserParse tests parsing of actions, positional arguments, pairs and flags.
+func TestCommandParserParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want *Command
+	}{
+		{"", nil},
+		{"hello", &Command{Action: "hello", Text: "hello", Args: map[string]string{}}},
+		{"deploy api env=prod --force", &Command{Action: "deploy", Text: "deploy api env=prod --force", Args: map[string]string{
+			"0": "api", "env": "prod", "force": "true",
+		}}},
+		{`say "hello world" to='the team' --tone=warm`, &Command{Action: "say", Text: `say "hello world" to='the team' --tone=warm`, Args: map[string]string{
+			"0": "hello world", "to": "the team", "tone": "warm",
+		}}},
+		{`echo a\ b "quote \"inside\"" 'back\slash' x\=y`, &Command{Action: "echo", Text: `echo a\ b "quote \"inside\"" 'back\slash' x\=y`, Args: map[string]string{
+			"0": "a b", "1": `quote "inside"`, "2": `back\slash`, "3": "x=y",
+		}}},
+		{`run -- --not-a-flag 1=2`, &Command{Action: "run", Text: `run -- --not-a-flag 1=2`, Args: map[string]string{
+			"0": "--not-a-flag", "1": "1=2",
+		}}},
+		{"say “hi there”", &Command{Action: "say", Text: "say “hi there”", Args: map[string]string{"0": "hi there"}}},
+	}
+
+	for _, test := range tests {
+		got, err := CommandParser{}.Parse(test.text)
+		if err != nil {
+			t.Errorf("Parse(%q) returned an error: %v", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q) = %+v, expected %+v", test.text, got, test.want)
+		}
+	}
+}
+
+// TestCommandParserPrefix tests that a prefix or mention is required when configured.
+func TestCommandParserPrefix(t *testing.T) {
+	parser := CommandParser{Prefix: "!", Mentions: []string{"<@UBOT>"}}
+
+	tests := []struct {
+		text   string
+		action string
+	}{
+		{"!deploy api", "deploy"},
+		{"<@UBOT> deploy api", "deploy"},
+		{"<@UBOT>: deploy api", "deploy"},
+		{"deploy api", ""},
+		{"!", ""},
+	}
+
+	for _, test := range tests {
+		got, err := parser.Parse(test.text)
+		if err != nil {
+			t.Errorf("Parse(%q) returned an error: %v", test.text, err)
+			continue
+		}
+		action := ""
+		if got != nil {
+			action = got.Action
+			if got.Text != "deploy api" {
+				t.Errorf("Parse(%q) text = %q, expected the command without its prefix", test.text, got.Text)
+			}
+		}
+		if action != test.action {
+			t.Errorf("Parse(%q) action = %q, expected %q", test.text, action, test.action)
+		}
+	}
+}
+
+// TestCommandParserMalformed tests that malformed input is reported as invalid arguments.
+func TestCommandParserMalformed(t *testing.T) {
+	for _, text := range []string{`say "unterminated`, `say 'unterminated`, `say trailing\`} {
+		if _, err := (CommandParser{}).Parse(text); !errors.Is(err, ErrInvalidArguments) {
+			t.Errorf("Parse(%q) error = %v, expected ErrInvalidArguments", text, err)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package npc
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// PanicError is the cause of the internal error returned when a handler or middleware panics.
+type PanicError struct {
+	ID    string // Correlation ID, shown to the requester and logged with the stack trace
+	Value interface{}
+	Stack []byte
+}
+
+// Error describes the panic.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic %s: %v", e.ID, e.Value)
+}
+
+// PanicReport describes a recovered panic to the hooks registered with OnPanic.
+type PanicReport struct {
+	ID      string
+	Action  string
+	Request Request
+	Value   interface{}
+	Stack   []byte
+	Time    time.Time
+	// InHandler is true if the action's handler panicked, and false for middleware.
+	InHandler bool
+	// Quarantined is true if this panic caused the action to be disabled.
+	Quarantined bool
+}
+
+// OnPanic adds a hook that is called with every panic recovered while processing a request or
+// running a job, after it has been logged. Hooks run on the goroutine that recovered the panic,
+// before the requester is answered, so should be quick.
+func (n *Npc) OnPanic(hook func(PanicReport)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.panicHooks = append(n.panicHooks[:len(n.panicHooks):len(n.panicHooks)], hook)
+}
+
+// SetQuarantine disables any action whose handler panics the given number of times within window,
+// until it is re-enabled with EnableAction. Requests for a disabled action fail with
+// ErrUnavailable. A count of zero, the default, never disables actions.
+func (n *Npc) SetQuarantine(panics int, window time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.quarantine = quarantinePolicy{panics: panics, window: window}
+}
+
+// EnableAction re-enables an action disabled after repeated panics, reporting whether it was disabled.
+func (n *Npc) EnableAction(name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.panics, name)
+	if !n.quarantined[name] {
+		return false
+	}
+	delete(n.quarantined, name)
+	return true
+}
+
+// Quarantined lists the actions disabled after repeated panics, sorted by name.
+func (n *Npc) Quarantined() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	names := make([]string, 0, len(n.quarantined))
+	for name := range n.quarantined {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quarantinePolicy is when to disable an action that keeps panicking.
+type quarantinePolicy struct {
+	panics int
+	window time.Duration
+}
+
+// isQuarantined reports whether an action has been disabled after repeated panics.
+func (n *Npc) isQuarantined(name string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.quarantined[name]
+}
+
+// recoverPanic turns a panic into an internal error response. It must be deferred directly.
+// inHandler says whether the panic came from an action's handler, which counts towards quarantine.
+func (n *Npc) recoverPanic(request Request, inHandler bool, response *Response) {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	report := PanicReport{
+		ID:        newID(),
+		Action:    request.Action,
+		Request:   request,
+		Value:     value,
+		Stack:     debug.Stack(),
+		Time:      time.Now(),
+		InHandler: inHandler,
+	}
+	log.Printf("Panic %s in %s: %v\n%s", report.ID, report.Action, value, report.Stack)
+
+	n.mu.Lock()
+	if inHandler {
+		report.Quarantined = n.countPanic(report.Action, report.Time)
+	}
+	hooks := n.panicHooks
+	n.mu.Unlock()
+
+	if report.Quarantined {
+		log.Printf("Action %s disabled after repeated panics", report.Action)
+	}
+	for _, hook := range hooks {
+		hook(report)
+	}
+
+	*response = Response{Error: &Error{
+		Kind:    ErrInternal,
+		Message: fmt.Sprintf("internal error (reference %s)", report.ID),
+		Err:     &PanicError{ID: report.ID, Value: value, Stack: report.Stack},
+	}}
+}
+
+// countPanic records a panic in an action's handler, reporting whether it has caused the action
+// to be quarantined. The caller must hold n.mu.
+func (n *Npc) countPanic(action string, now time.Time) bool {
+	if n.quarantine.panics <= 0 || n.quarantined[action] {
+		return false
+	}
+
+	recent := []time.Time{now}
+	for _, t := range n.panics[action] {
+		if now.Sub(t) < n.quarantine.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) < n.quarantine.panics {
+		n.panics[action] = recent
+		return false
+	}
+	delete(n.panics, action)
+	n.quarantined[action] = true
+	return true
+}
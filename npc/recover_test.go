@@ -0,0 +1,91 @@
+package npc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// panicMiddleware is middleware that panics.
+type panicMiddleware struct{}
+
+// Execute panics.
+func (panicMiddleware) Execute(request *Request) error {
+	panic("middleware failed")
+}
+
+// TestPanicRecovery tests that panics become internal errors reported to the panic hooks.
+func TestPanicRecovery(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{Name: "boom", Handler: func(request Request) Response { panic("handler failed") }})
+	var reports []PanicReport
+	npc.OnPanic(func(report PanicReport) { reports = append(reports, report) })
+
+	response := npc.ProcessRequest(Request{Action: "boom"})
+	var panicked *PanicError
+	if !errors.Is(response.Error, ErrInternal) || !errors.As(response.Error, &panicked) {
+		t.Fatalf("Expected an internal error caused by a panic, got %+v", response)
+	}
+	if !strings.Contains(response.Error.Error(), panicked.ID) || len(panicked.Stack) == 0 {
+		t.Errorf("Expected the error to carry the reference and stack, got %v", response.Error)
+	}
+	if len(reports) != 1 || reports[0].ID != panicked.ID || !reports[0].InHandler || reports[0].Value != "handler failed" {
+		t.Errorf("Unexpected panic reports %+v", reports)
+	}
+
+	npc.ForAction("boom").Use(panicMiddleware{})
+	if response := npc.ProcessRequest(Request{Action: "boom"}); !errors.Is(response.Error, ErrInternal) {
+		t.Errorf("Expected a middleware panic to be recovered, got %+v", response)
+	}
+	if len(reports) != 2 || reports[1].InHandler {
+		t.Errorf("Expected the middleware panic to be reported, got %+v", reports)
+	}
+}
+
+// TestQuarantine tests that an action that keeps panicking is disabled until re-enabled.
+func TestQuarantine(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{Name: "boom", Handler: func(request Request) Response { panic("failed") }})
+	npc.SetQuarantine(2, time.Minute)
+
+	npc.ProcessRequest(Request{Action: "boom"})
+	if len(npc.Quarantined()) != 0 {
+		t.Fatal("Expected one panic not to disable the action")
+	}
+	npc.ProcessRequest(Request{Action: "boom"})
+	if names := npc.Quarantined(); !reflect.DeepEqual(names, []string{"boom"}) {
+		t.Fatalf("Expected boom to be disabled, got %v", names)
+	}
+	if response := npc.ProcessRequest(Request{Action: "boom"}); !errors.Is(response.Error, ErrUnavailable) {
+		t.Errorf("Expected a disabled action to be unavailable, got %+v", response)
+	}
+
+	if !npc.EnableAction("boom") || npc.EnableAction("boom") {
+		t.Error("Expected EnableAction to re-enable boom once")
+	}
+	if response := npc.ProcessRequest(Request{Action: "boom"}); !errors.Is(response.Error, ErrInternal) {
+		t.Errorf("Expected a re-enabled action to run, got %+v", response)
+	}
+}
+
+// TestJobPanic tests that a panicking job fails instead of crashing the process.
+func TestJobPanic(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{Name: "boom", JobHandler: func(job *Job) Response { panic("failed") }})
+
+	response := npc.ProcessRequestContext(context.Background(), Request{Action: "boom"})
+	info, _ := response.Payload.(JobInfo)
+	job, ok := npc.Jobs().Get(info.ID)
+	if !ok {
+		t.Fatalf("Expected a job, got %+v", response)
+	}
+	for deadline := time.Now().Add(time.Second); job.Status() == JobRunning && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if job.Status() != JobFailed {
+		t.Errorf("Expected the job to fail, got %s", job.Status())
+	}
+}
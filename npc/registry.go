@@ -0,0 +1,188 @@
+package npc
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Named is implemented by middleware that chooses its own name in the pipeline.
+type Named interface {
+	Name() string
+}
+
+// middlewareEntry is a middleware in the pipeline, along with its name and the value passed to Use.
+type middlewareEntry struct {
+	name  string
+	value interface{}
+	wrap  WrapMiddleware
+}
+
+// middlewareName returns the name Use gives to a middleware.
+func middlewareName(middleware interface{}) string {
+	if named, ok := middleware.(Named); ok {
+		return named.Name()
+	}
+	return fmt.Sprintf("%T", middleware)
+}
+
+// UseNamed adds a new middleware to the end of the pipeline under the given name.
+// The name is used to remove or move the middleware later.
+func (n *Npc) UseNamed(name string, middleware interface{}) {
+	n.useIn(globalScope, name, middleware)
+}
+
+// RemoveMiddleware removes the first middleware with the given name, reporting whether one was found.
+func (n *Npc) RemoveMiddleware(name string) bool {
+	return n.removeIn(globalScope, name)
+}
+
+// MoveMiddleware moves the first middleware with the given name to position index in the pipeline,
+// where 0 is the first middleware to run.
+func (n *Npc) MoveMiddleware(name string, index int) error {
+	return n.moveIn(globalScope, name, index)
+}
+
+// MiddlewareNames lists the names of the middleware in the order they run.
+func (n *Npc) MiddlewareNames() []string {
+	return n.namesIn(globalScope)
+}
+
+// globalScope is the scope key of middleware that applies to every request.
+const globalScope = ""
+
+// middlewareIn returns the middleware of a scope. The caller must hold n.mu.
+func (n *Npc) middlewareIn(scope string) []middlewareEntry {
+	if scope == globalScope {
+		return n.middleware
+	}
+	return n.scoped[scope]
+}
+
+// setMiddlewareIn replaces the middleware of a scope. The caller must hold n.mu.
+func (n *Npc) setMiddlewareIn(scope string, middleware []middlewareEntry) {
+	if scope == globalScope {
+		n.middleware = middleware
+	} else if len(middleware) == 0 {
+		delete(n.scoped, scope)
+	} else {
+		n.scoped[scope] = middleware
+	}
+	n.invalidate()
+}
+
+// useIn adds a named middleware to the end of a scope.
+func (n *Npc) useIn(scope, name string, middleware interface{}) {
+	entry := middlewareEntry{name: name, value: middleware, wrap: toWrapMiddleware(middleware)}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// Middleware lists are copied on write so requests already running keep a consistent chain.
+	current := n.middlewareIn(scope)
+	n.setMiddlewareIn(scope, append(current[:len(current):len(current)], entry))
+}
+
+// removeIn removes the first middleware with the given name from a scope.
+func (n *Npc) removeIn(scope, name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	current := n.middlewareIn(scope)
+	i := middlewareIndex(current, name)
+	if i < 0 {
+		return false
+	}
+	middleware := make([]middlewareEntry, 0, len(current)-1)
+	middleware = append(middleware, current[:i]...)
+	n.setMiddlewareIn(scope, append(middleware, current[i+1:]...))
+	return true
+}
+
+// moveIn moves the first middleware with the given name within a scope.
+func (n *Npc) moveIn(scope, name string, index int) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	current := n.middlewareIn(scope)
+	i := middlewareIndex(current, name)
+	if i < 0 {
+		return Errorf(ErrNotFound, "middleware %s not found", name)
+	}
+	if index < 0 || index >= len(current) {
+		return fmt.Errorf("middleware position %d out of range", index)
+	}
+
+	entry := current[i]
+	middleware := make([]middlewareEntry, 0, len(current))
+	middleware = append(middleware, current[:i]...)
+	middleware = append(middleware, current[i+1:]...)
+	middleware = append(middleware[:index], append([]middlewareEntry{entry}, middleware[index:]...)...)
+	n.setMiddlewareIn(scope, middleware)
+	return nil
+}
+
+// namesIn lists the names of the middleware in a scope.
+func (n *Npc) namesIn(scope string) []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	current := n.middlewareIn(scope)
+	names := make([]string, len(current))
+	for i, entry := range current {
+		names[i] = entry.name
+	}
+	return names
+}
+
+// middlewareIndex returns the position of the first middleware with the given name, or -1.
+func middlewareIndex(middleware []middlewareEntry, name string) int {
+	for i, entry := range middleware {
+		if entry.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// UnregisterAction removes an action, reporting whether it was registered.
+// Requests already running the action are not affected.
+func (n *Npc) UnregisterAction(name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.actions[name]; !ok {
+		return false
+	}
+	n.removeAliases(name)
+	n.setTriggers(name, nil)
+	delete(n.actions, name)
+	n.invalidate()
+	return true
+}
+
+// Action returns the registered action with the given name or alias.
+func (n *Npc) Action(name string) (Action, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if target, ok := n.aliases[name]; ok {
+		name = target
+	}
+	entry, ok := n.actions[name]
+	if !ok {
+		return Action{}, false
+	}
+	return entry.action, true
+}
+
+// Actions lists the registered actions sorted by name.
+func (n *Npc) Actions() []Action {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	actions := make([]Action, 0, len(n.actions))
+	for _, entry := range n.actions {
+		actions = append(actions, entry.action)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Name < actions[j].Name })
+	return actions
+}
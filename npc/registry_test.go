@@ -0,0 +1,114 @@
+package npc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// namedMiddleware is middleware that records its name when it runs.
+type namedMiddleware struct {
+	name string
+	log  *[]string
+}
+
+// Name returns the middleware's name.
+func (m namedMiddleware) Name() string {
+	return m.name
+}
+
+// Execute records that the middleware ran.
+func (m namedMiddleware) Execute(request *Request) error {
+	*m.log = append(*m.log, m.name)
+	return nil
+}
+
+// TestMiddlewareRegistry tests naming, removing and moving middleware.
+func TestMiddlewareRegistry(t *testing.T) {
+	npc := NewNpc()
+	var log []string
+	npc.Use(namedMiddleware{name: "auth", log: &log})
+	npc.Use(namedMiddleware{name: "audit", log: &log})
+	npc.UseNamed("limit", namedMiddleware{name: "limit", log: &log})
+	npc.Use(&MockMiddleware{})
+
+	expected := []string{"auth", "audit", "limit", "*npc.MockMiddleware"}
+	if names := npc.MiddlewareNames(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected middleware %v, got %v", expected, names)
+	}
+
+	if err := npc.MoveMiddleware("limit", 0); err != nil {
+		t.Fatalf("MoveMiddleware() returned an error: %v", err)
+	}
+	if !npc.RemoveMiddleware("audit") {
+		t.Error("RemoveMiddleware() did not find audit")
+	}
+	if npc.RemoveMiddleware("audit") {
+		t.Error("RemoveMiddleware() removed audit twice")
+	}
+	if err := npc.MoveMiddleware("missing", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound moving missing middleware, got %v", err)
+	}
+
+	npc.ProcessRequest(Request{Action: HelpAction})
+	if expected := []string{"limit", "auth"}; !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected middleware to run as %v, got %v", expected, log)
+	}
+}
+
+// TestActionRegistry tests replacing, listing and unregistering actions.
+func TestActionRegistry(t *testing.T) {
+	npc := NewNpc()
+	npc.RegisterAction(Action{Name: "test", Handler: func(request Request) Response { return Response{Data: "v1"} }})
+	npc.RegisterAction(Action{Name: "test", Handler: func(request Request) Response { return Response{Data: "v2"} }})
+
+	if response := npc.ProcessRequest(Request{Action: "test"}); response.Data != "v2" {
+		t.Errorf("Expected replaced action to run, got %q", response.Data)
+	}
+
+	var names []string
+	for _, action := range npc.Actions() {
+		names = append(names, action.Name)
+	}
+	if expected := []string{HelpAction, CancelAction, JobsAction, "test"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected actions %v, got %v", expected, names)
+	}
+
+	if !npc.UnregisterAction("test") {
+		t.Error("UnregisterAction() did not find the action")
+	}
+	if _, ok := npc.Action("test"); ok {
+		t.Error("Action() still returned an unregistered action")
+	}
+	if response := npc.ProcessRequest(Request{Action: "test"}); !errors.Is(response.Error, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after unregistering, got %v", response.Error)
+	}
+}
+
+// TestRegistryConcurrency exercises registration while requests are processed.
+// It is most useful when run with -race.
+func TestRegistryConcurrency(t *testing.T) {
+	npc := NewNpc()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("action%d", i)
+			npc.RegisterAction(Action{Name: name, Handler: func(request Request) Response { return Response{} }})
+			npc.UseNamed(name, WrapFunc(func(ctx context.Context, request Request, next Next) Response {
+				return next(ctx, request)
+			}))
+			npc.UnregisterAction(name)
+			npc.RemoveMiddleware(name)
+		}(i)
+		go func() {
+			defer wg.Done()
+			npc.ProcessRequest(Request{Action: HelpAction})
+		}()
+	}
+	wg.Wait()
+}
@@ -1,14 +1,81 @@
 package npc
 
+import "fmt"
+
+// IdempotencyArg is the argument holding a client's key for a request it may retry, so that
+// a retry is not run twice. The API channel sets it from the Idempotency-Key header.
+const IdempotencyArg = "idempotency_key"
+
+// RemoteAddrArg is the argument holding the network address a request came from, for channels
+// that know it, such as the API. Channels set it themselves, replacing any value a client sent.
+const RemoteAddrArg = "remote_addr"
+
+// Arguments the Slack channel sets to say where a message was sent.
+const (
+	TeamIDArg      = "team_id"      // The workspace
+	ChannelTypeArg = "channel_type" // The kind of conversation, such as "im" or "channel"
+)
+
+// transportArgs are the arguments channels set to describe how one message arrived, as opposed
+// to those its sender gave.
+var transportArgs = []string{IdempotencyArg, RemoteAddrArg, CommandTextArg, TeamIDArg, ChannelTypeArg}
+
 // Request encapsulates a standardized incoming request.
 type Request struct {
-	Action    string
-	User      string
-	ChannelID string
-	Text      string      // Textual representation of the payload
-	Source    string      // e.g., "API", "Slack"
-	AuthMethod string     // e.g., "apikey", "slack_user"
-	AuthToken string      // The actual token or user ID
-	Args      map[string]string // Arbitrary key-value arguments
-	RawData   interface{}
+	Action     string
+	User       string
+	ChannelID  string
+	ThreadID   string            // Thread within the channel, if the channel has threads
+	Text       string            // Textual representation of the payload
+	Source     string            // e.g., "API", "Slack"
+	AuthMethod string            // e.g., "apikey", "slack_user"
+	AuthToken  string            // The actual token or user ID
+	Credential string            // Name of the credential that authenticated the request, such as an API key's
+	Identity   string            // Who authentication found the caller to be, e.g. "apikey:ci" or "slack:U012AB3CD"
+	Strength   AuthStrength      // How strongly authentication established the Identity
+	Args       map[string]string // Arbitrary key-value arguments
+	ReplyTo    Address           // Where the response should be delivered
+	RawData    interface{}
+}
+
+// Caller returns a key telling apart who sent a request, for limits and other state kept per
+// caller: the identity authentication verified, or else the address the request came from, if
+// its channel records it. The User a request claims is not trusted, so requests with neither
+// share one key.
+func (r Request) Caller() string {
+	if r.Strength == AuthVerified && r.Identity != "" {
+		return "user=" + r.Identity
+	}
+	if addr := r.Args[RemoteAddrArg]; addr != "" {
+		return "remote=" + addr
+	}
+	return "unverified"
+}
+
+// AuthStrength is how strongly authentication established who sent a request. Stronger
+// methods have greater values.
+type AuthStrength int
+
+// Authentication strengths.
+const (
+	AuthNone      AuthStrength = iota // Not authenticated
+	AuthAnonymous                     // Admitted without knowing who sent it
+	AuthShared                        // Proven to know a secret shared by many callers
+	AuthVerified                      // Proven to be a particular user or key
+)
+
+// String returns the name of the strength.
+func (s AuthStrength) String() string {
+	switch s {
+	case AuthNone:
+		return "none"
+	case AuthAnonymous:
+		return "anonymous"
+	case AuthShared:
+		return "shared"
+	case AuthVerified:
+		return "verified"
+	default:
+		return fmt.Sprintf("AuthStrength(%d)", int(s))
+	}
 }
@@ -5,4 +5,12 @@ type Response struct {
 	Data  string
 	Error error
 	Code  int
+	// Payload is optional structured data for machine consumers such as the API channel.
+	Payload interface{}
+	// Blocks optionally give the response rich structure, such as fields, code and buttons.
+	// Data, when set alongside blocks, is a short summary.
+	Blocks []Block
+	// Replied is set once the core has delivered the response to the request's ReplyTo address,
+	// so the channel must not deliver it again.
+	Replied bool
 }
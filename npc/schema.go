@@ -0,0 +1,207 @@
+package npc
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParamType is the type of value an action parameter accepts.
+type ParamType string
+
+// Supported parameter types.
+const (
+	TypeString   ParamType = "string"
+	TypeInt      ParamType = "int"
+	TypeFloat    ParamType = "float"
+	TypeBool     ParamType = "bool"
+	TypeDuration ParamType = "duration"
+)
+
+// Param declares an argument accepted by an Action. Positional arguments from a
+// CommandParser are bound to parameters in declaration order, skipping any given by name.
+type Param struct {
+	Name     string    `json:"name"`
+	Type     ParamType `json:"type,omitempty"` // Defaults to TypeString
+	Required bool      `json:"required,omitempty"`
+	Default  string    `json:"default,omitempty"` // Used when the argument is missing
+	Enum     []string  `json:"enum,omitempty"`    // If set, the value must be one of these
+	Pattern  string    `json:"pattern,omitempty"` // If set, a regular expression the whole value must match
+	Help     string    `json:"help,omitempty"`
+}
+
+// ArgProblem describes one invalid argument.
+type ArgProblem struct {
+	Arg     string
+	Message string
+}
+
+// ValidationError reports every problem found with a request's arguments.
+// It wraps ErrInvalidArguments.
+type ValidationError struct {
+	Action   string
+	Problems []ArgProblem
+}
+
+// Error lists every problem.
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.Arg + ": " + p.Message
+	}
+	return fmt.Sprintf("invalid arguments for %s: %s", e.Action, strings.Join(problems, "; "))
+}
+
+// Unwrap returns ErrInvalidArguments.
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidArguments
+}
+
+// schema is the compiled form of an action's parameters.
+type schema struct {
+	params   []Param
+	patterns []*regexp.Regexp
+}
+
+// compileSchema checks an action's parameter declarations and compiles their patterns.
+func compileSchema(action Action) (*schema, error) {
+	s := &schema{params: action.Params, patterns: make([]*regexp.Regexp, len(action.Params))}
+	seen := make(map[string]bool)
+	for i, p := range action.Params {
+		if !isArgName(p.Name) {
+			return nil, fmt.Errorf("action %s: invalid parameter name %q", action.Name, p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("action %s: duplicate parameter %s", action.Name, p.Name)
+		}
+		seen[p.Name] = true
+
+		switch p.Type {
+		case "", TypeString, TypeInt, TypeFloat, TypeBool, TypeDuration:
+		default:
+			return nil, fmt.Errorf("action %s: parameter %s has unknown type %s", action.Name, p.Name, p.Type)
+		}
+
+		if p.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("action %s: parameter %s: %w", action.Name, p.Name, err)
+			}
+			s.patterns[i] = re
+		}
+		if p.Default != "" {
+			if _, msg := s.check(i, p.Default); msg != "" {
+				return nil, fmt.Errorf("action %s: parameter %s: default %s", action.Name, p.Name, msg)
+			}
+		}
+	}
+	return s, nil
+}
+
+// bind validates args against the schema and returns a copy with positional arguments
+// bound to their parameters, values normalised and defaults filled in.
+func (s *schema) bind(action string, args map[string]string) (map[string]string, error) {
+	bound := make(map[string]string, len(args))
+	positional := make(map[string]bool)
+	for k, v := range args {
+		if _, err := strconv.Atoi(k); err == nil {
+			positional[k] = true
+			continue
+		}
+		bound[k] = v
+	}
+
+	if len(s.params) == 0 {
+		for k := range positional {
+			bound[k] = args[k]
+		}
+		return bound, nil
+	}
+
+	next := 0
+	for _, p := range s.params {
+		if _, ok := bound[p.Name]; ok {
+			continue
+		}
+		key := PositionalArg(next)
+		if !positional[key] {
+			break
+		}
+		bound[p.Name] = args[key]
+		delete(positional, key)
+		next++
+	}
+
+	var problems []ArgProblem
+	for k := range positional {
+		problems = append(problems, ArgProblem{Arg: k, Message: fmt.Sprintf("unexpected argument %q", args[k])})
+	}
+	for i, p := range s.params {
+		value, ok := bound[p.Name]
+		if !ok || value == "" {
+			switch {
+			case p.Default != "":
+				value = p.Default
+			case p.Required:
+				problems = append(problems, ArgProblem{Arg: p.Name, Message: "is required"})
+				continue
+			default:
+				continue
+			}
+		}
+		normalised, msg := s.check(i, value)
+		if msg != "" {
+			problems = append(problems, ArgProblem{Arg: p.Name, Message: msg})
+			continue
+		}
+		bound[p.Name] = normalised
+	}
+
+	if len(problems) > 0 {
+		slices.SortFunc(problems, func(a, b ArgProblem) int { return strings.Compare(a.Arg, b.Arg) })
+		return nil, &ValidationError{Action: action, Problems: problems}
+	}
+	return bound, nil
+}
+
+// check validates a value for the i-th parameter, returning its normalised form or a problem.
+func (s *schema) check(i int, value string) (string, string) {
+	p := s.params[i]
+	switch p.Type {
+	case "", TypeString:
+	case TypeInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Sprintf("%q is not a whole number", value)
+		}
+		value = strconv.FormatInt(n, 10)
+	case TypeFloat:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "", fmt.Sprintf("%q is not a number", value)
+		}
+	case TypeBool:
+		switch strings.ToLower(value) {
+		case "true", "yes", "y", "on", "1":
+			value = "true"
+		case "false", "no", "n", "off", "0":
+			value = "false"
+		default:
+			return "", fmt.Sprintf("%q is not true or false", value)
+		}
+	case TypeDuration:
+		if _, err := time.ParseDuration(value); err != nil {
+			return "", fmt.Sprintf("%q is not a duration such as 30s or 5m", value)
+		}
+	}
+
+	if len(p.Enum) > 0 && !slices.Contains(p.Enum, value) {
+		return "", fmt.Sprintf("%q must be one of %s", value, strings.Join(p.Enum, ", "))
+	}
+	if re := s.patterns[i]; re != nil && !re.MatchString(value) {
+		return "", fmt.Sprintf("%q does not match %s", value, p.Pattern)
+	}
+	return value, ""
+}
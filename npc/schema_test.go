@@ -0,0 +1,102 @@
+package npc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// deployAction returns an action with a representative parameter schema.
+func deployAction(handler func(Request) Response) Action {
+	return Action{
+		Name: "deploy",
+		Params: []Param{
+			{Name: "service", Required: true, Pattern: "[a-z]+"},
+			{Name: "env", Default: "dev", Enum: []string{"dev", "prod"}},
+			{Name: "replicas", Type: TypeInt},
+			{Name: "force", Type: TypeBool},
+		},
+		Handler: handler,
+	}
+}
+
+// TestActionParams tests that arguments are bound, normalised and defaulted before the handler runs.
+func TestActionParams(t *testing.T) {
+	npc := NewNpc()
+	var got map[string]string
+	err := npc.RegisterAction(deployAction(func(request Request) Response {
+		got = request.Args
+		return Response{Data: "ok"}
+	}))
+	if err != nil {
+		t.Fatalf("RegisterAction() returned an error: %v", err)
+	}
+
+	response := npc.ProcessRequest(Request{
+		Action: "deploy",
+		Args:   map[string]string{"0": "api", "replicas": "03", "force": "yes", "channel_type": "im"},
+	})
+	if response.Error != nil {
+		t.Fatalf("ProcessRequest() returned an error: %v", response.Error)
+	}
+
+	expected := map[string]string{"service": "api", "env": "dev", "replicas": "3", "force": "true", "channel_type": "im"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected args %v, got %v", expected, got)
+	}
+}
+
+// TestActionParamsInvalid tests that every problem is reported in one error.
+func TestActionParamsInvalid(t *testing.T) {
+	npc := NewNpc()
+	called := false
+	npc.RegisterAction(deployAction(func(request Request) Response {
+		called = true
+		return Response{}
+	}))
+
+	response := npc.ProcessRequest(Request{
+		Action: "deploy",
+		Args:   map[string]string{"env": "qa", "replicas": "many", "force": "maybe"},
+	})
+	if called {
+		t.Error("Handler was called with invalid arguments")
+	}
+	if !errors.Is(response.Error, ErrInvalidArguments) {
+		t.Fatalf("Expected ErrInvalidArguments, got %v", response.Error)
+	}
+
+	var validationErr *ValidationError
+	if !errors.As(response.Error, &validationErr) {
+		t.Fatalf("Expected a *ValidationError, got %T", response.Error)
+	}
+	var args []string
+	for _, problem := range validationErr.Problems {
+		args = append(args, problem.Arg)
+	}
+	expected := []string{"env", "force", "replicas", "service"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected problems with %v, got %v", expected, validationErr.Problems)
+	}
+
+	response = npc.ProcessRequest(Request{Action: "deploy", Args: map[string]string{"0": "api", "1": "extra"}})
+	if !errors.Is(response.Error, ErrInvalidArguments) {
+		t.Errorf("Expected unexpected positional argument to be rejected, got %v", response.Error)
+	}
+}
+
+// TestRegisterActionInvalidSchema tests that bad parameter declarations are rejected.
+func TestRegisterActionInvalidSchema(t *testing.T) {
+	tests := []Param{
+		{Name: ""},
+		{Name: "x", Type: "uuid"},
+		{Name: "x", Pattern: "("},
+		{Name: "x", Type: TypeInt, Default: "ten"},
+	}
+
+	for _, param := range tests {
+		if err := NewNpc().RegisterAction(Action{Name: "test", Params: []Param{param}}); err == nil {
+			t.Errorf("Expected RegisterAction() to reject %+v", param)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package npc
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// Sender delivers text messages to a destination, such as a Slack channel ID, on a channel adapter.
+type Sender interface {
+	SendMessage(channelID string, message string)
+}
+
+// ThreadSender is implemented by senders that can deliver a message within a thread.
+type ThreadSender interface {
+	SendThreadMessage(channelID, threadID, message string)
+}
+
+// Outbound is a message the bot sends on its own initiative, rather than in reply to a request.
+type Outbound struct {
+	Adapter     string // Source name the adapter's sender is registered under, e.g. "Slack"
+	Destination string // Where the adapter delivers it, e.g. a Slack channel
+	Thread      string // Thread within the destination, if the adapter has threads
+	Text        string
+}
+
+// SendNext delivers an outbound message through the rest of the outbound chain.
+type SendNext func(ctx context.Context, message Outbound) error
+
+// OutboundMiddleware wraps the delivery of outbound messages, for example to audit or redact them.
+// It may change the message before calling next, or stop it by returning an error without
+// calling next.
+type OutboundMiddleware interface {
+	HandleOutbound(ctx context.Context, message Outbound, next SendNext) error
+}
+
+// OutboundFunc is an adapter that allows an ordinary function to be used as OutboundMiddleware.
+type OutboundFunc func(ctx context.Context, message Outbound, next SendNext) error
+
+// HandleOutbound calls f(ctx, message, next).
+func (f OutboundFunc) HandleOutbound(ctx context.Context, message Outbound, next SendNext) error {
+	return f(ctx, message, next)
+}
+
+// RegisterSender registers the adapter that delivers messages for requests from the given Source,
+// e.g. "Slack". It is used to report job progress and results back to where the request came from,
+// and to deliver messages passed to Send.
+func (n *Npc) RegisterSender(source string, sender Sender) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.senders[source] = sender
+}
+
+// UseOutbound adds a middleware to the end of the outbound chain, which every message sent by
+// Send, and every job report, passes through.
+func (n *Npc) UseOutbound(middleware OutboundMiddleware) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.outbound = append(n.outbound[:len(n.outbound):len(n.outbound)], middleware)
+}
+
+// Send delivers a message to a target naming an adapter and a destination on it, such as
+// "slack:#ops" or "webhook:deploys". The adapter is the source a Sender was registered under,
+// ignoring case. Unknown adapters are reported as ErrNotFound.
+func (n *Npc) Send(target, message string) error {
+	return n.SendContext(context.Background(), target, message)
+}
+
+// SendContext is like Send but passes ctx through the outbound middleware.
+func (n *Npc) SendContext(ctx context.Context, target, message string) error {
+	adapter, destination, ok := strings.Cut(target, ":")
+	if !ok || adapter == "" || destination == "" {
+		return Errorf(ErrInvalidArguments, "invalid target %q; expected adapter:destination", target)
+	}
+	return n.deliver(ctx, Outbound{Adapter: adapter, Destination: destination, Text: message})
+}
+
+// deliver passes a message through the outbound middleware to its adapter's sender.
+func (n *Npc) deliver(ctx context.Context, message Outbound) error {
+	n.mu.RLock()
+	middleware := n.outbound
+	n.mu.RUnlock()
+
+	next := func(ctx context.Context, message Outbound) error {
+		sender, ok := n.sender(message.Adapter)
+		if !ok {
+			return Errorf(ErrNotFound, "no adapter %s to send messages", message.Adapter)
+		}
+		if threaded, ok := sender.(ThreadSender); ok && message.Thread != "" {
+			threaded.SendThreadMessage(message.Destination, message.Thread, message.Text)
+			return nil
+		}
+		sender.SendMessage(message.Destination, message.Text)
+		return nil
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		m, inner := middleware[i], next
+		next = func(ctx context.Context, message Outbound) error {
+			return m.HandleOutbound(ctx, message, inner)
+		}
+	}
+	return next(ctx, message)
+}
+
+// sender returns the sender registered for an adapter, ignoring case.
+func (n *Npc) sender(adapter string) (Sender, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if sender, ok := n.senders[adapter]; ok {
+		return sender, true
+	}
+	for source, sender := range n.senders {
+		if strings.EqualFold(source, adapter) {
+			return sender, true
+		}
+	}
+	return nil, false
+}
+
+// notify sends a message to a request's reply address, or back to the channel and thread it came
+// from, if that adapter has a sender.
+func (n *Npc) notify(request Request, message string) {
+	to := request.ReplyTo
+	if to.Adapter == "" {
+		to = Address{Adapter: request.Source, ChannelID: request.ChannelID, ThreadID: request.ThreadID}
+	}
+	if to.ChannelID == "" {
+		log.Printf("No destination for message to %s: %s", to.Adapter, message)
+		return
+	}
+	err := n.deliver(context.Background(), Outbound{Adapter: to.Adapter, Destination: to.ChannelID, Thread: to.ThreadID, Text: message})
+	if err != nil {
+		log.Printf("Failed to send message to %s: %v: %s", to.Adapter, err, message)
+	}
+}
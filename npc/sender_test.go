@@ -0,0 +1,43 @@
+package npc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSend tests that outbound messages reach the named adapter through the outbound middleware.
+func TestSend(t *testing.T) {
+	npc := NewNpc()
+	slack := &MockSender{}
+	npc.RegisterSender("Slack", slack)
+
+	var audited []Outbound
+	npc.UseOutbound(OutboundFunc(func(ctx context.Context, message Outbound, next SendNext) error {
+		audited = append(audited, message)
+		return next(ctx, message)
+	}))
+	npc.UseOutbound(OutboundFunc(func(ctx context.Context, message Outbound, next SendNext) error {
+		message.Text = strings.ReplaceAll(message.Text, "hunter2", "[redacted]")
+		return next(ctx, message)
+	}))
+
+	if err := npc.Send("slack:#ops", "password is hunter2"); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if expected := []string{"#ops: password is [redacted]"}; !reflect.DeepEqual(slack.Messages(), expected) {
+		t.Errorf("Expected %v, got %v", expected, slack.Messages())
+	}
+	if len(audited) != 1 || audited[0].Adapter != "slack" || audited[0].Destination != "#ops" {
+		t.Errorf("Expected the message to be audited, got %+v", audited)
+	}
+
+	if err := npc.Send("webhook:deploys", "hello"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown adapter, got %v", err)
+	}
+	if err := npc.Send("#ops", "hello"); !errors.Is(err, ErrInvalidArguments) {
+		t.Errorf("Expected ErrInvalidArguments for a target without an adapter, got %v", err)
+	}
+}
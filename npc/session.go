@@ -0,0 +1,116 @@
+package npc
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReplyArg is the argument holding the text of a follow-up message routed to an action
+// that was waiting for it. See Session.Await.
+const ReplyArg = "reply"
+
+// SessionKey identifies a conversation: one user talking to the bot in one channel and thread.
+type SessionKey struct {
+	Source    string `json:"source"`
+	ChannelID string `json:"channel_id,omitempty"`
+	User      string `json:"user"`
+	Thread    string `json:"thread,omitempty"`
+}
+
+// String returns the key as a single string, for stores that index sessions by name.
+func (k SessionKey) String() string {
+	return fmt.Sprintf("%s/%s/%s/%s", k.Source, k.ChannelID, k.User, k.Thread)
+}
+
+// SessionKey returns the key of the conversation the request belongs to.
+func (r Request) SessionKey() SessionKey {
+	return SessionKey{Source: r.Source, ChannelID: r.ChannelID, User: r.User, Thread: r.ThreadID}
+}
+
+// Session holds state that lasts across the requests of a conversation. Handlers read and
+// change the session of the current request through SessionFrom; changes are saved when the
+// request finishes. Concurrent requests in one conversation each see their own copy, and the
+// last to finish wins.
+type Session struct {
+	Key     SessionKey        `json:"key"`
+	Values  map[string]string `json:"values,omitempty"`
+	Pending string            `json:"pending,omitempty"` // Action waiting for the next message
+	Capture []string          `json:"capture,omitempty"` // Commands also routed to the pending action
+	Expires time.Time         `json:"expires"`
+}
+
+// NewSession returns an empty session for the given conversation.
+func NewSession(key SessionKey) *Session {
+	return &Session{Key: key, Values: make(map[string]string)}
+}
+
+// Get returns a session value, or "" if it is not set.
+func (s *Session) Get(name string) string {
+	return s.Values[name]
+}
+
+// Set stores a session value.
+func (s *Session) Set(name, value string) {
+	if s.Values == nil {
+		s.Values = make(map[string]string)
+	}
+	s.Values[name] = value
+}
+
+// Delete removes a session value.
+func (s *Session) Delete(name string) {
+	delete(s.Values, name)
+}
+
+// Await routes the conversation's next message to action, unless that message is itself a
+// command, such as answering "prod" to "which environment?". Commands listed in capture are
+// routed to the action too. The message's text is passed to the action in the ReplyArg
+// argument. Waiting ends when the message arrives; Await with no action stops it sooner.
+func (s *Session) Await(action string, capture ...string) {
+	s.Pending = action
+	s.Capture = capture
+	if action == "" {
+		s.Capture = nil
+	}
+}
+
+// Clear removes every value and stops waiting for a follow-up.
+func (s *Session) Clear() {
+	s.Values = make(map[string]string)
+	s.Await("")
+}
+
+// Empty reports whether the session holds no state, so need not be kept.
+func (s *Session) Empty() bool {
+	return len(s.Values) == 0 && s.Pending == ""
+}
+
+// Expired reports whether the session's time to live has passed.
+func (s *Session) Expired(now time.Time) bool {
+	return !s.Expires.IsZero() && now.After(s.Expires)
+}
+
+// clone returns a copy of the session that shares no state with it.
+func (s *Session) clone() *Session {
+	c := *s
+	c.Capture = append([]string(nil), s.Capture...)
+	c.Values = make(map[string]string, len(s.Values))
+	for k, v := range s.Values {
+		c.Values[k] = v
+	}
+	return &c
+}
+
+type sessionKey struct{}
+
+// WithSession returns a context carrying the session of the request being handled.
+func WithSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFrom returns the session carried by ctx, or nil if sessions are not enabled.
+func SessionFrom(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
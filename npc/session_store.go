@@ -0,0 +1,152 @@
+package npc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dyluth/npc2/internal/fileutil"
+)
+
+// SessionStore keeps sessions between requests.
+type SessionStore interface {
+	// Load returns the session with the given key, or nil if there is none or it has expired.
+	Load(ctx context.Context, key SessionKey) (*Session, error)
+	// Save stores a session, replacing any with the same key.
+	Save(ctx context.Context, session *Session) error
+	// Delete removes a session. Deleting a missing session is not an error.
+	Delete(ctx context.Context, key SessionKey) error
+}
+
+// MemorySessionStore keeps sessions in memory. Sessions are lost when the process exits.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewMemorySessionStore creates an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*Session)}
+}
+
+// Load returns a copy of the stored session.
+func (s *MemorySessionStore) Load(ctx context.Context, key SessionKey) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[key.String()]
+	if !ok {
+		return nil, nil
+	}
+	if session.Expired(time.Now()) {
+		delete(s.sessions, key.String())
+		return nil, nil
+	}
+	return session.clone(), nil
+}
+
+// Save stores a copy of the session, forgetting any sessions that have expired.
+func (s *MemorySessionStore) Save(ctx context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(time.Now())
+	s.sessions[session.Key.String()] = session.clone()
+	return nil
+}
+
+// Delete removes a session.
+func (s *MemorySessionStore) Delete(ctx context.Context, key SessionKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, key.String())
+	return nil
+}
+
+// prune removes expired sessions. The caller must hold s.mu.
+func (s *MemorySessionStore) prune(now time.Time) {
+	for name, session := range s.sessions {
+		if session.Expired(now) {
+			delete(s.sessions, name)
+		}
+	}
+}
+
+// FileSessionStore keeps sessions in memory and writes them to a JSON file on every change,
+// so conversations survive a restart.
+type FileSessionStore struct {
+	path   string
+	memory *MemorySessionStore
+	mu     sync.Mutex // Serialises changes so the file is written in the order they are made
+}
+
+// NewFileSessionStore creates a FileSessionStore backed by the file at path, loading any
+// sessions already saved there.
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	store := &FileSessionStore{path: path, memory: NewMemorySessionStore()}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading sessions: %w", err)
+	}
+	var sessions []*Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("reading sessions from %s: %w", path, err)
+	}
+	for _, session := range sessions {
+		store.memory.sessions[session.Key.String()] = session
+	}
+	return store, nil
+}
+
+// Load returns a copy of the stored session.
+func (s *FileSessionStore) Load(ctx context.Context, key SessionKey) (*Session, error) {
+	return s.memory.Load(ctx, key)
+}
+
+// Save stores a session and writes the sessions to the file.
+func (s *FileSessionStore) Save(ctx context.Context, session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memory.Save(ctx, session)
+	return s.write()
+}
+
+// Delete removes a session and writes the sessions to the file.
+func (s *FileSessionStore) Delete(ctx context.Context, key SessionKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memory.Delete(ctx, key)
+	return s.write()
+}
+
+// write replaces the file with the current sessions. The file is written under a temporary
+// name and then renamed, so a crash never leaves it half written. The caller must hold s.mu.
+func (s *FileSessionStore) write() error {
+	s.memory.mu.Lock()
+	defer s.memory.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(s.memory.sessions))
+	for _, session := range s.memory.sessions {
+		sessions = append(sessions, session)
+	}
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := fileutil.WriteAtomic(s.path, data); err != nil {
+		return fmt.Errorf("writing sessions: %w", err)
+	}
+	return nil
+}
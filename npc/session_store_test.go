@@ -0,0 +1,69 @@
+package npc
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemorySessionStore()
+	key := SessionKey{Source: "API", User: "alice"}
+
+	if session, err := store.Load(ctx, key); session != nil || err != nil {
+		t.Fatalf("Expected no session, got %+v, %v", session, err)
+	}
+
+	session := NewSession(key)
+	session.Set("env", "prod")
+	session.Expires = time.Now().Add(time.Hour)
+	store.Save(ctx, session)
+	session.Set("env", "dev")
+
+	loaded, _ := store.Load(ctx, key)
+	if loaded == nil || loaded.Get("env") != "prod" {
+		t.Fatalf("Expected the saved copy, got %+v", loaded)
+	}
+
+	loaded.Expires = time.Now().Add(-time.Second)
+	store.Save(ctx, loaded)
+	if session, _ := store.Load(ctx, key); session != nil {
+		t.Errorf("Expected an expired session to be gone, got %+v", session)
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	key := SessionKey{Source: "Slack", ChannelID: "C1", User: "U1"}
+
+	store, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	session := NewSession(key)
+	session.Set("env", "prod")
+	session.Await("deploy")
+	session.Expires = time.Now().Add(time.Hour)
+	if err := store.Save(ctx, session); err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+
+	// A new store, as after a restart, sees the saved session
+	store, err = NewFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	loaded, _ := store.Load(ctx, key)
+	if loaded == nil || loaded.Get("env") != "prod" || loaded.Pending != "deploy" {
+		t.Fatalf("Expected the session to survive a restart, got %+v", loaded)
+	}
+
+	store.Delete(ctx, key)
+	store, _ = NewFileSessionStore(path)
+	if loaded, _ := store.Load(ctx, key); loaded != nil {
+		t.Errorf("Expected the deleted session to be gone, got %+v", loaded)
+	}
+}
@@ -0,0 +1,40 @@
+package npc
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	request := Request{Source: "Slack", ChannelID: "C1", User: "U1", ThreadID: "123.456"}
+	key := request.SessionKey()
+	if key.String() != "Slack/C1/U1/123.456" {
+		t.Errorf("Unexpected key %q", key.String())
+	}
+
+	session := NewSession(key)
+	if !session.Empty() {
+		t.Error("Expected a new session to be empty")
+	}
+	session.Set("env", "prod")
+	session.Await("deploy")
+	if session.Get("env") != "prod" || session.Pending != "deploy" || session.Empty() {
+		t.Errorf("Unexpected session %+v", session)
+	}
+	session.Await("wizard", "cancel")
+	if len(session.Capture) != 1 || session.clone().Capture[0] != "cancel" {
+		t.Errorf("Expected the captured command to be kept, got %+v", session)
+	}
+	session.Clear()
+	if !session.Empty() || session.Capture != nil {
+		t.Errorf("Expected a cleared session to be empty, got %+v", session)
+	}
+
+	ctx := WithSession(context.Background(), session)
+	if SessionFrom(ctx) != session {
+		t.Error("Expected the session from the context")
+	}
+	if SessionFrom(context.Background()) != nil {
+		t.Error("Expected no session without the middleware")
+	}
+}
@@ -0,0 +1,41 @@
+package npc
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrStreamClosed is returned when a handler writes to a stream whose request has already been answered.
+var ErrStreamClosed = errors.New("response stream closed")
+
+// ResponseWriter lets a handler send messages to the requester while it is still running,
+// such as "starting…", partial output or progress. The handler's returned Response is still
+// the final result. Channels provide a writer in the request's context; see ResponseWriterFrom.
+type ResponseWriter interface {
+	// Send delivers a new message.
+	Send(response Response) error
+	// Update replaces the last message sent, where the channel supports it, or sends a new one.
+	Update(response Response) error
+}
+
+type responseWriterKey struct{}
+
+// WithResponseWriter returns a context carrying the writer for streaming responses to a request.
+func WithResponseWriter(ctx context.Context, w ResponseWriter) context.Context {
+	return context.WithValue(ctx, responseWriterKey{}, w)
+}
+
+// ResponseWriterFrom returns the response writer carried by ctx. If the channel does not
+// support streaming, the writer discards messages, so handlers can always write to it.
+func ResponseWriterFrom(ctx context.Context) ResponseWriter {
+	if w, ok := ctx.Value(responseWriterKey{}).(ResponseWriter); ok {
+		return w
+	}
+	return discardWriter{}
+}
+
+// discardWriter is the ResponseWriter for channels that do not stream.
+type discardWriter struct{}
+
+func (discardWriter) Send(Response) error   { return nil }
+func (discardWriter) Update(Response) error { return nil }
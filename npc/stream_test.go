@@ -0,0 +1,47 @@
+package npc
+
+import (
+	"context"
+	"testing"
+)
+
+// recordingWriter is a ResponseWriter that records what it is sent.
+type recordingWriter struct {
+	messages []string
+}
+
+func (w *recordingWriter) Send(response Response) error {
+	w.messages = append(w.messages, "send: "+response.Text())
+	return nil
+}
+
+func (w *recordingWriter) Update(response Response) error {
+	w.messages = append(w.messages, "update: "+response.Text())
+	return nil
+}
+
+func TestResponseWriterFrom(t *testing.T) {
+	if err := ResponseWriterFrom(context.Background()).Send(Response{Data: "dropped"}); err != nil {
+		t.Errorf("Expected the default writer to discard messages, got %v", err)
+	}
+
+	n := NewNpc()
+	n.RegisterAction(Action{
+		Name: "deploy",
+		ContextHandler: func(ctx context.Context, request Request) Response {
+			w := ResponseWriterFrom(ctx)
+			w.Send(Response{Data: "Starting"})
+			w.Update(Response{Data: "Halfway"})
+			return Response{Data: "Done"}
+		},
+	})
+
+	writer := &recordingWriter{}
+	response := n.ProcessRequestContext(WithResponseWriter(context.Background(), writer), Request{Action: "deploy"})
+	if response.Data != "Done" {
+		t.Errorf("Expected final response 'Done', got %q", response.Data)
+	}
+	if len(writer.messages) != 2 || writer.messages[0] != "send: Starting" || writer.messages[1] != "update: Halfway" {
+		t.Errorf("Unexpected streamed messages %v", writer.messages)
+	}
+}
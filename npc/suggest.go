@@ -0,0 +1,193 @@
+package npc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is the most close matches offered for an unknown action.
+const maxSuggestions = 3
+
+// NotFoundError reports a request for an action that is not registered, along with the
+// registered actions it most closely matches. It wraps ErrNotFound.
+type NotFoundError struct {
+	Action      string
+	Suggestions []string // Closest first
+}
+
+// Error names the missing action and any suggestions.
+func (e *NotFoundError) Error() string {
+	msg := fmt.Sprintf("action %s not found", e.Action)
+	switch len(e.Suggestions) {
+	case 0:
+		return msg
+	case 1:
+		return fmt.Sprintf("%s; did you mean %s?", msg, e.Suggestions[0])
+	default:
+		last := len(e.Suggestions) - 1
+		return fmt.Sprintf("%s; did you mean %s or %s?", msg, strings.Join(e.Suggestions[:last], ", "), e.Suggestions[last])
+	}
+}
+
+// Unwrap returns ErrNotFound.
+func (e *NotFoundError) Unwrap() error {
+	return ErrNotFound
+}
+
+// SetAutoCorrect chooses whether a request for an unknown action runs the registered action it
+// matches when there is exactly one match within a single typing mistake, such as "deplyo" for
+// "deploy". The requester is told which action ran through the request's ResponseWriter. It is
+// off by default, in which case close matches are only suggested.
+func (n *Npc) SetAutoCorrect(enabled bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.correct = enabled
+}
+
+// suggestion is a registered action that closely matches an unknown one.
+type suggestion struct {
+	action   string
+	distance int  // Edits between the typed name and the action's name or alias
+	prefix   bool // Whether the typed name only matched as a prefix
+}
+
+// correction is a mistyped action that was replaced with the action it closely matches.
+type correction struct {
+	typed, action string
+}
+
+// correctionKey is the context key under which a request's correction is recorded.
+type correctionKey struct{}
+
+// autoCorrect replaces an unknown action with the only registered action within a single typing
+// mistake of it, if auto-correction is enabled, and returns a context recording the correction.
+// As no middleware has run yet, every action is a candidate, not only those the request may run;
+// the middleware then authorizes the corrected action.
+func (n *Npc) autoCorrect(ctx context.Context, request *Request) context.Context {
+	n.mu.RLock()
+	correct := n.correct
+	n.mu.RUnlock()
+	if !correct {
+		return ctx
+	}
+	if _, ok := n.Action(request.Action); ok {
+		return ctx
+	}
+	matches := n.closeMatches(request.Action)
+	if len(matches) != 1 || matches[0].prefix || matches[0].distance > 1 {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, correctionKey{}, correction{typed: request.Action, action: matches[0].action})
+	request.Action = matches[0].action
+	return ctx
+}
+
+// announceCorrection tells the requester which action is running in place of the one they typed,
+// if it was corrected.
+func announceCorrection(ctx context.Context, request Request) {
+	if c, ok := ctx.Value(correctionKey{}).(correction); ok && c.action == request.Action {
+		ResponseWriterFrom(ctx).Send(Response{Data: fmt.Sprintf("Running %s, the closest match to %s.", c.action, c.typed)})
+	}
+}
+
+// notFound answers a request for an unknown action with the closest matches.
+func (n *Npc) notFound(ctx context.Context, request Request) Response {
+	suggestions := n.suggest(request)
+	names := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		names[i] = s.action
+	}
+	return Response{Error: &NotFoundError{Action: request.Action, Suggestions: names}}
+}
+
+// suggest returns the actions the request may run whose name or alias is within a few typing
+// mistakes of the requested action, or starts with it, closest first.
+func (n *Npc) suggest(request Request) []suggestion {
+	var suggestions []suggestion
+	for _, s := range n.closeMatches(request.Action) {
+		if n.permits(request, s.action) {
+			suggestions = append(suggestions, s)
+		}
+	}
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	return suggestions
+}
+
+// closeMatches returns every action whose name or alias is within a few typing mistakes of
+// typed, or starts with it, closest first.
+func (n *Npc) closeMatches(typed string) []suggestion {
+	typed = strings.ToLower(typed)
+	if typed == "" {
+		return nil
+	}
+	limit := max(1, min(3, len([]rune(typed))/3))
+
+	best := make(map[string]suggestion)
+	for _, action := range n.Actions() {
+		for _, name := range append([]string{action.Name}, action.Aliases...) {
+			candidate := strings.ToLower(name)
+			s := suggestion{action: action.Name, distance: editDistance(typed, candidate)}
+			if s.distance > limit {
+				if len([]rune(typed)) < 2 || !strings.HasPrefix(candidate, typed) {
+					continue
+				}
+				s.prefix = true
+			}
+			if current, ok := best[action.Name]; !ok || s.better(current) {
+				best[action.Name] = s
+			}
+		}
+	}
+
+	matches := make([]suggestion, 0, len(best))
+	for _, s := range best {
+		matches = append(matches, s)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.better(b) || b.better(a) {
+			return a.better(b)
+		}
+		return a.action < b.action
+	})
+	return matches
+}
+
+// better reports whether s is a closer match than t. Near misses beat prefix matches.
+func (s suggestion) better(t suggestion) bool {
+	if s.prefix != t.prefix {
+		return !s.prefix
+	}
+	return s.distance < t.distance
+}
+
+// editDistance returns the number of single-character insertions, deletions, substitutions and
+// transpositions of adjacent characters needed to turn a into b.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	// rows[k][j] is the distance between the first i-2+k runes of s and the first j of t
+	rows := [3][]int{make([]int, len(t)+1), make([]int, len(t)+1), make([]int, len(t)+1)}
+	for j := range rows[2] {
+		rows[2][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		rows[0], rows[1], rows[2] = rows[1], rows[2], rows[0]
+		prev, cur := rows[1], rows[2]
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				cur[j] = min(cur[j], rows[0][j-2]+1)
+			}
+		}
+	}
+	return rows[2][len(t)]
+}
@@ -0,0 +1,135 @@
+package npc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"deploy", "deploy", 0},
+		{"deplyo", "deploy", 1},
+		{"depoy", "deploy", 1},
+		{"deplooy", "deploy", 1},
+		{"daploy", "deploy", 1},
+		{"status", "stats", 1},
+		{"", "help", 4},
+		{"kitten", "sitting", 3},
+	}
+	for _, test := range tests {
+		if d := editDistance(test.a, test.b); d != test.expected {
+			t.Errorf("editDistance(%q, %q) = %d, expected %d", test.a, test.b, d, test.expected)
+		}
+	}
+}
+
+// TestSuggestions tests that an unknown action suggests the close matches the request may run.
+func TestSuggestions(t *testing.T) {
+	npc := NewNpc()
+	handler := func(request Request) Response { return Response{Data: request.Action} }
+	npc.RegisterAction(Action{Name: "deploy", Handler: handler})
+	npc.RegisterAction(Action{Name: "destroy", Handler: handler})
+	npc.RegisterAction(Action{Name: "status", Aliases: []string{"st"}, Handler: handler})
+	npc.RegisterAction(Action{Name: "statistics", Handler: handler})
+	npc.Use(denyAuthorizer{action: "destroy"})
+
+	tests := []struct {
+		action   string
+		expected []string
+	}{
+		{"deplyo", []string{"deploy"}},
+		{"DEPLOY", []string{"deploy"}},
+		{"desroy", []string{"deploy"}}, // destroy is forbidden
+		{"stat", []string{"status", "statistics"}},
+		{"sx", []string{"status"}},
+		{"xyzzy", nil},
+	}
+	for _, test := range tests {
+		response := npc.ProcessRequest(Request{Action: test.action})
+		var notFound *NotFoundError
+		if !errors.As(response.Error, &notFound) || !errors.Is(response.Error, ErrNotFound) {
+			t.Errorf("%s: expected a NotFoundError, got %+v", test.action, response)
+			continue
+		}
+		if len(notFound.Suggestions) != len(test.expected) || (len(test.expected) > 0 && !reflect.DeepEqual(notFound.Suggestions, test.expected)) {
+			t.Errorf("%s: expected suggestions %v, got %v", test.action, test.expected, notFound.Suggestions)
+		}
+	}
+
+	err := &NotFoundError{Action: "stat", Suggestions: []string{"status", "statistics", "stats"}}
+	if expected := "action stat not found; did you mean status, statistics or stats?"; err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+}
+
+// TestAutoCorrect tests that a single close match runs when auto-correction is enabled.
+func TestAutoCorrect(t *testing.T) {
+	npc := NewNpc()
+	handler := func(request Request) Response { return Response{Data: "ran " + request.Action} }
+	npc.RegisterAction(Action{Name: "deploy", Handler: handler})
+	npc.RegisterAction(Action{Name: "status", Handler: handler})
+	npc.RegisterAction(Action{Name: "stats", Handler: handler})
+
+	if response := npc.ProcessRequest(Request{Action: "deplyo"}); response.Error == nil {
+		t.Errorf("Expected no correction by default, got %+v", response)
+	}
+
+	npc.SetAutoCorrect(true)
+	writer := &recordingWriter{}
+	ctx := WithResponseWriter(context.Background(), writer)
+	if response := npc.ProcessRequestContext(ctx, Request{Action: "deplyo"}); response.Data != "ran deploy" {
+		t.Errorf("Expected deploy to run, got %+v", response)
+	}
+	if len(writer.messages) != 1 {
+		t.Errorf("Expected the requester to be told of the correction, got %v", writer.messages)
+	}
+
+	// The correction is made before middleware runs, so it authorizes the corrected action
+	npc.Use(denyAuthorizer{action: "deploy"})
+	if response := npc.ProcessRequest(Request{Action: "deplyo"}); !errors.Is(response.Error, ErrForbidden) {
+		t.Errorf("Expected the corrected action to be refused, got %+v", response)
+	}
+
+	// "stat" is close to both status and stats, so neither is run
+	if response := npc.ProcessRequest(Request{Action: "stat"}); !errors.Is(response.Error, ErrNotFound) {
+		t.Errorf("Expected an ambiguous typo not to run, got %+v", response)
+	}
+}
+
+// TestActionAliases tests that aliases run their action and cannot clash with other actions.
+func TestActionAliases(t *testing.T) {
+	npc := NewNpc()
+	handler := func(request Request) Response { return Response{Data: "ran " + request.Action} }
+	if err := npc.RegisterAction(Action{Name: "deploy", Aliases: []string{"d", "ship"}, Handler: handler}); err != nil {
+		t.Fatalf("RegisterAction failed: %v", err)
+	}
+
+	if response := npc.ProcessRequest(Request{Action: "ship"}); response.Data != "ran deploy" {
+		t.Errorf("Expected the alias to run deploy, got %+v", response)
+	}
+	if action, ok := npc.Action("d"); !ok || action.Name != "deploy" {
+		t.Errorf("Expected Action to find deploy by alias, got %+v", action)
+	}
+
+	if err := npc.RegisterAction(Action{Name: "delete", Aliases: []string{"d"}, Handler: handler}); err == nil {
+		t.Error("Expected a clashing alias to be rejected")
+	}
+	if err := npc.RegisterAction(Action{Name: "ship", Handler: handler}); err == nil {
+		t.Error("Expected a name clashing with an alias to be rejected")
+	}
+
+	// Replacing the action replaces its aliases
+	npc.RegisterAction(Action{Name: "deploy", Aliases: []string{"d"}, Handler: handler})
+	if _, ok := npc.Action("ship"); ok {
+		t.Error("Expected the dropped alias to be forgotten")
+	}
+	npc.UnregisterAction("deploy")
+	if _, ok := npc.Action("d"); ok {
+		t.Error("Expected the unregistered action's aliases to be forgotten")
+	}
+}
@@ -0,0 +1,209 @@
+package npc
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Trigger lets free text run an action, such as "what's the status of build 123" running
+// "build.status" with id=123. Triggers are tried only when a request does not name a registered
+// action, highest Priority first. A trigger fires when its Pattern matches somewhere in the
+// request's text, or when every one of its Keywords appears as a word in the text. A caller who
+// may not run the action of the trigger that fires is refused rather than offered a later trigger.
+type Trigger struct {
+	// Pattern is a regular expression. Its named groups become arguments, so
+	// `build (?P<id>\d+)` passes id. Add (?i) to ignore case.
+	Pattern string `json:"pattern,omitempty"`
+	// Keywords are words that must all appear in the text, in any order and any case.
+	Keywords []string `json:"keywords,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	// Sources and ChannelIDs, if set, limit the trigger to requests from those sources, such
+	// as "Slack", and channels.
+	Sources    []string `json:"sources,omitempty"`
+	ChannelIDs []string `json:"channel_ids,omitempty"`
+}
+
+// trigger is a compiled Trigger of a registered action.
+type trigger struct {
+	Trigger
+	action   string
+	pattern  *regexp.Regexp
+	keywords []string // Lower case and sorted
+}
+
+// compileTriggers checks an action's trigger declarations and compiles their patterns.
+func compileTriggers(action Action) ([]*trigger, error) {
+	triggers := make([]*trigger, len(action.Triggers))
+	for i, t := range action.Triggers {
+		if t.Pattern == "" && len(t.Keywords) == 0 {
+			return nil, fmt.Errorf("action %s: trigger %d has no pattern or keywords", action.Name, i)
+		}
+		compiled := &trigger{Trigger: t, action: action.Name}
+		if t.Pattern != "" {
+			re, err := regexp.Compile(t.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("action %s: trigger %d: %w", action.Name, i, err)
+			}
+			for _, name := range re.SubexpNames()[1:] {
+				if name != "" && !isArgName(name) {
+					return nil, fmt.Errorf("action %s: trigger %d: invalid argument name %q", action.Name, i, name)
+				}
+			}
+			compiled.pattern = re
+		}
+		for _, keyword := range t.Keywords {
+			compiled.keywords = append(compiled.keywords, strings.ToLower(keyword))
+		}
+		sort.Strings(compiled.keywords)
+		triggers[i] = compiled
+	}
+	return triggers, nil
+}
+
+// conflicts reports whether t and u would fire on exactly the same requests with the same
+// priority, so which of them runs could not be told from their declarations. Triggers whose
+// patterns differ but can match the same text are not detected.
+func (t *trigger) conflicts(u *trigger) bool {
+	return t.Priority == u.Priority &&
+		t.Pattern == u.Pattern &&
+		slices.Equal(t.keywords, u.keywords) &&
+		overlap(t.Sources, u.Sources) &&
+		overlap(t.ChannelIDs, u.ChannelIDs)
+}
+
+// overlap reports whether two scopes have a value in common. An empty scope includes everything.
+func overlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, v := range a {
+		if slices.Contains(b, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// before reports whether t should be tried before u: higher priority first, then patterns
+// before keywords, then more keywords first, then by action name.
+func (t *trigger) before(u *trigger) bool {
+	switch {
+	case t.Priority != u.Priority:
+		return t.Priority > u.Priority
+	case (t.pattern != nil) != (u.pattern != nil):
+		return t.pattern != nil
+	case len(t.keywords) != len(u.keywords):
+		return len(t.keywords) > len(u.keywords)
+	default:
+		return t.action < u.action
+	}
+}
+
+// match reports whether the trigger fires for the request, returning the arguments it captured.
+func (t *trigger) match(request Request, words map[string]bool) (map[string]string, bool) {
+	if len(t.Sources) > 0 && !slices.Contains(t.Sources, request.Source) {
+		return nil, false
+	}
+	if len(t.ChannelIDs) > 0 && !slices.Contains(t.ChannelIDs, request.ChannelID) {
+		return nil, false
+	}
+	for _, keyword := range t.keywords {
+		if !words[keyword] {
+			return nil, false
+		}
+	}
+
+	args := make(map[string]string)
+	if t.pattern != nil {
+		groups := t.pattern.FindStringSubmatch(request.Text)
+		if groups == nil {
+			return nil, false
+		}
+		for i, name := range t.pattern.SubexpNames() {
+			if name != "" && groups[i] != "" {
+				args[name] = groups[i]
+			}
+		}
+	}
+	return args, true
+}
+
+// setTriggers replaces the triggers of an action, keeping every trigger in the order they are
+// tried. The caller must hold n.mu.
+func (n *Npc) setTriggers(action string, triggers []*trigger) {
+	all := make([]*trigger, 0, len(n.triggers)+len(triggers))
+	for _, t := range n.triggers {
+		if t.action != action {
+			all = append(all, t)
+		}
+	}
+	all = append(all, triggers...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].before(all[j]) })
+	n.triggers = all
+}
+
+// checkTriggers returns an error if any of an action's triggers conflicts with one of another
+// action's. The caller must hold n.mu.
+func (n *Npc) checkTriggers(action string, triggers []*trigger) error {
+	for _, t := range triggers {
+		for _, other := range n.triggers {
+			if other.action != action && t.conflicts(other) {
+				return fmt.Errorf("action %s: trigger conflicts with one of %s", action, other.action)
+			}
+		}
+	}
+	return nil
+}
+
+// routeTrigger routes a request naming no registered action to the action of the first trigger
+// that fires for it, reporting whether one did.
+func (n *Npc) routeTrigger(request *Request) bool {
+	n.mu.RLock()
+	triggers := n.triggers
+	n.mu.RUnlock()
+	if len(triggers) == 0 || request.Text == "" {
+		return false
+	}
+	if _, ok := n.Action(request.Action); ok {
+		return false
+	}
+
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(request.Text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\'' && r != '-'
+	}) {
+		words[word] = true
+	}
+
+	for _, t := range triggers {
+		captured, ok := t.match(*request, words)
+		if !ok {
+			continue
+		}
+		// Positional arguments were parsed for a command the text never was
+		args := namedArgs(request.Args)
+		for k, v := range captured {
+			args[k] = v
+		}
+		request.Action = t.action
+		request.Args = args
+		return true
+	}
+	return false
+}
+
+// namedArgs returns a copy of args without the positional arguments.
+func namedArgs(args map[string]string) map[string]string {
+	named := make(map[string]string, len(args))
+	for k, v := range args {
+		if _, err := strconv.Atoi(k); err != nil {
+			named[k] = v
+		}
+	}
+	return named
+}
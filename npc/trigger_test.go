@@ -0,0 +1,81 @@
+package npc
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestTriggers tests that free text runs the action of the first trigger that fires.
+func TestTriggers(t *testing.T) {
+	npc := NewNpc()
+	handler := func(request Request) Response { return Response{Data: request.Action + " " + request.Args["id"]} }
+	npc.RegisterAction(Action{
+		Name:     "build.status",
+		Params:   []Param{{Name: "id", Type: TypeInt}},
+		Triggers: []Trigger{{Pattern: `(?i)status of build (?P<id>\d+)`}},
+		Handler:  handler,
+	})
+	npc.RegisterAction(Action{
+		Name:     "build.latest",
+		Triggers: []Trigger{{Keywords: []string{"latest", "build"}}},
+		Handler:  handler,
+	})
+	npc.RegisterAction(Action{
+		Name:     "oncall",
+		Triggers: []Trigger{{Keywords: []string{"build"}, Priority: -1}, {Keywords: []string{"pager"}, Sources: []string{"Slack"}}},
+		Handler:  handler,
+	})
+
+	tests := []struct {
+		request  Request
+		expected string
+	}{
+		{Request{Action: "what's", Text: "what's the Status of build 123?", Args: map[string]string{"0": "the"}}, "build.status 123"},
+		{Request{Action: "show", Text: "show me the latest BUILD"}, "build.latest "},
+		{Request{Action: "who", Text: "who broke the build"}, "oncall "},
+		{Request{Action: "pager", Text: "pager", Source: "Slack"}, "oncall "},
+	}
+	for _, test := range tests {
+		if response := npc.ProcessRequest(test.request); response.Data != test.expected {
+			t.Errorf("%q: expected %q, got %+v", test.request.Text, test.expected, response)
+		}
+	}
+
+	// Out of scope, so nothing fires
+	if response := npc.ProcessRequest(Request{Action: "pager", Text: "pager", Source: "API"}); !errors.Is(response.Error, ErrNotFound) {
+		t.Errorf("Expected a trigger scoped to Slack not to fire for the API, got %+v", response)
+	}
+
+	npc.UnregisterAction("oncall")
+	if response := npc.ProcessRequest(Request{Action: "who", Text: "who broke the build"}); !errors.Is(response.Error, ErrNotFound) {
+		t.Errorf("Expected an unregistered action's triggers to be removed, got %+v", response)
+	}
+}
+
+func TestTriggerErrors(t *testing.T) {
+	npc := NewNpc()
+	handler := func(request Request) Response { return Response{} }
+	npc.RegisterAction(Action{Name: "deploy", Triggers: []Trigger{{Keywords: []string{"Ship", "it"}, Sources: []string{"Slack"}}}, Handler: handler})
+
+	actions := []Action{
+		{Name: "empty", Triggers: []Trigger{{}}},
+		{Name: "bad", Triggers: []Trigger{{Pattern: "("}}},
+		{Name: "badgroup", Triggers: []Trigger{{Pattern: `(?P<1st>\d)`}}},
+		{Name: "clash", Triggers: []Trigger{{Keywords: []string{"it", "ship"}}}},
+	}
+	for _, action := range actions {
+		action.Handler = handler
+		if err := npc.RegisterAction(action); err == nil {
+			t.Errorf("Expected action %s to be rejected", action.Name)
+		}
+	}
+
+	// The same keywords are allowed at another priority or in another scope
+	if err := npc.RegisterAction(Action{Name: "other", Triggers: []Trigger{{Keywords: []string{"ship", "it"}, Sources: []string{"API"}}}, Handler: handler}); err != nil {
+		t.Errorf("Expected a trigger in another scope to be allowed, got %v", err)
+	}
+	// Replacing an action does not conflict with its own triggers
+	if err := npc.RegisterAction(Action{Name: "deploy", Triggers: []Trigger{{Keywords: []string{"ship", "it"}, Sources: []string{"Slack"}}}, Handler: handler}); err != nil {
+		t.Errorf("Expected the replacement to be allowed, got %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+package state
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// Defaults for RedisOptions fields left zero.
+const (
+	DefaultPoolSize    = 8
+	DefaultDialTimeout = 2 * time.Second
+	DefaultTimeout     = time.Second
+)
+
+// Policy is what a Redis store does when the server cannot be reached.
+type Policy int
+
+const (
+	// FailClosed returns errors wrapping npc.ErrUnavailable, so requests that need shared
+	// state are refused.
+	FailClosed Policy = iota
+	// FailOpen carries on as though the store were empty: reads find nothing, writes are
+	// dropped, SetNX succeeds and counters start from zero. Rate limits then allow every
+	// request and sessions are forgotten until the server is back.
+	FailOpen
+)
+
+// RedisOptions configures a Redis store.
+type RedisOptions struct {
+	Addr     string // host:port
+	Password string // Sent with AUTH if set
+	DB       int    // Selected if not zero
+	// PoolSize is how many idle connections are kept for reuse, DefaultPoolSize if zero.
+	// Busy periods may open more, which are closed once they are no longer needed.
+	PoolSize    int
+	DialTimeout time.Duration // DefaultDialTimeout if zero
+	// Timeout bounds each command, DefaultTimeout if zero. A sooner context deadline wins.
+	Timeout time.Duration
+	Policy  Policy
+}
+
+// Redis is a Store kept on a server speaking the Redis protocol, such as Redis or Valkey, so
+// that it is shared by every replica using the same server.
+type Redis struct {
+	options RedisOptions
+	idle    chan *redisConn
+	closed  atomic.Bool
+	failing atomic.Bool // Whether the last attempt to reach the server failed
+}
+
+// redisConn is a connection to the server.
+type redisConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	broken bool // Whether a command failed part way, leaving the connection unusable
+}
+
+// NewRedis creates a Redis store. Connections are made when they are first needed.
+func NewRedis(options RedisOptions) *Redis {
+	if options.PoolSize <= 0 {
+		options.PoolSize = DefaultPoolSize
+	}
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = DefaultDialTimeout
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+	return &Redis{options: options, idle: make(chan *redisConn, options.PoolSize)}
+}
+
+// Close closes the idle connections. Connections in use are closed when they are released.
+func (s *Redis) Close() error {
+	s.closed.Store(true)
+	for {
+		select {
+		case c := <-s.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Ping checks that the server can be reached, regardless of the policy.
+func (s *Redis) Ping(ctx context.Context) error {
+	_, err := s.do(ctx, "PING")
+	return err
+}
+
+// Get returns the value of a key.
+func (s *Redis) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := s.do(ctx, "GET", key)
+	if err != nil {
+		_, err = s.fallback(err)
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	return value, ok, nil
+}
+
+// Set sets the value of a key.
+func (s *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := s.do(ctx, setCommand(key, value, ttl)...)
+	if err != nil {
+		_, err = s.fallback(err)
+	}
+	return err
+}
+
+// SetNX sets the value of a key if it is not already set.
+func (s *Redis) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	reply, err := s.do(ctx, append(setCommand(key, value, ttl), "NX")...)
+	if err != nil {
+		return s.fallback(err)
+	}
+	return reply != nil, nil
+}
+
+// Delete removes a key.
+func (s *Redis) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DEL", key)
+	if err != nil {
+		_, err = s.fallback(err)
+	}
+	return err
+}
+
+// IncrBy adds delta to a counter, setting its expiry when it is created. The counter is created
+// with its expiry and incremented in one transaction, so that a failure between the two cannot
+// leave a counter that never expires.
+func (s *Redis) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	commands := [][]string{{"INCRBY", key, strconv.FormatInt(delta, 10)}}
+	if ttl > 0 {
+		commands = append([][]string{append(setCommand(key, []byte("0"), ttl), "NX")}, commands...)
+	}
+	replies, err := s.multi(ctx, commands...)
+	if err != nil {
+		_, err = s.fallback(err)
+		return delta, err
+	}
+	reply := replies[len(replies)-1]
+	if redisErr, ok := reply.(RedisError); ok {
+		return 0, redisErr
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCRBY reply %v", reply)
+	}
+	return count, nil
+}
+
+// Update replaces the value of a key in a transaction that is retried if the key changes
+// before it commits.
+func (s *Redis) Update(ctx context.Context, key string, ttl time.Duration, update func(value []byte, ok bool) ([]byte, error)) error {
+	c, err := s.conn(ctx)
+	if err != nil {
+		if open, err := s.fallback(err); !open {
+			return err
+		}
+		_, err = update(nil, false)
+		return err
+	}
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		committed, err := s.tryUpdate(ctx, c, key, ttl, update)
+		if err != nil {
+			if isNetworkError(err) {
+				s.release(c, err)
+				if open, err := s.fallback(err); !open {
+					return err
+				}
+				_, err = update(nil, false)
+				return err
+			}
+			// The connection may still be watching the key or inside a transaction
+			c.conn.Close()
+			return err
+		}
+		if committed {
+			s.release(c, nil)
+			return nil
+		}
+	}
+	s.release(c, nil)
+	return ErrConflict
+}
+
+// tryUpdate makes one attempt at an update, reporting whether it committed.
+func (s *Redis) tryUpdate(ctx context.Context, c *redisConn, key string, ttl time.Duration, update func([]byte, bool) ([]byte, error)) (bool, error) {
+	if _, err := s.exchange(ctx, c, "WATCH", key); err != nil {
+		return false, err
+	}
+	reply, err := s.exchange(ctx, c, "GET", key)
+	if err != nil {
+		return false, err
+	}
+	current, ok := reply.([]byte)
+	value, err := update(current, ok)
+	if err != nil {
+		if _, unwatchErr := s.exchange(ctx, c, "UNWATCH"); unwatchErr != nil {
+			return false, unwatchErr
+		}
+		return false, err
+	}
+	if _, err := s.exchange(ctx, c, "MULTI"); err != nil {
+		return false, err
+	}
+	if _, err := s.exchange(ctx, c, setCommand(key, value, ttl)...); err != nil {
+		return false, err
+	}
+	reply, err = s.exchange(ctx, c, "EXEC")
+	if err != nil {
+		return false, err
+	}
+	// EXEC replies with a null array when a watched key changed
+	return reply != nil, nil
+}
+
+// setCommand returns the arguments of a SET command.
+func setCommand(key string, value []byte, ttl time.Duration) []string {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	}
+	return args
+}
+
+// do sends a command on a pooled connection and returns its reply.
+func (s *Redis) do(ctx context.Context, args ...string) (interface{}, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := s.exchange(ctx, c, args...)
+	s.release(c, err)
+	return reply, err
+}
+
+// multi runs commands in a transaction on a pooled connection and returns their replies, which
+// include the error replies of commands that failed.
+func (s *Redis) multi(ctx context.Context, commands ...[]string) ([]interface{}, error) {
+	c, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := s.transaction(ctx, c, commands)
+	if err != nil && !isNetworkError(err) {
+		// The connection may still be inside the transaction
+		c.broken = true
+	}
+	s.release(c, err)
+	return replies, err
+}
+
+// transaction sends MULTI, the commands and EXEC, returning the replies of the commands.
+func (s *Redis) transaction(ctx context.Context, c *redisConn, commands [][]string) ([]interface{}, error) {
+	if _, err := s.exchange(ctx, c, "MULTI"); err != nil {
+		return nil, err
+	}
+	for _, command := range commands {
+		if _, err := s.exchange(ctx, c, command...); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.exchange(ctx, c, "EXEC")
+	if err != nil {
+		return nil, err
+	}
+	replies, ok := reply.([]interface{})
+	if !ok || len(replies) != len(commands) {
+		return nil, fmt.Errorf("redis: unexpected EXEC reply %v", reply)
+	}
+	return replies, nil
+}
+
+// exchange sends a command and reads its reply, within the command timeout. A request whose
+// context is done is not sent, and a failure caused by the context ending returns the context's
+// error, as the server was not at fault.
+func (s *Redis) exchange(ctx context.Context, c *redisConn, args ...string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(s.options.Timeout)
+	d, ctxDeadline := ctx.Deadline()
+	if ctxDeadline = ctxDeadline && d.Before(deadline); ctxDeadline {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	reply, err := c.roundTrip(args)
+	if err != nil {
+		c.broken = true
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		// The connection's deadline may pass a moment before the context notices its own
+		if ctxDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, s.unreachable(err)
+	}
+	s.reachable()
+	if redisErr, ok := reply.(RedisError); ok {
+		return nil, redisErr
+	}
+	return reply, nil
+}
+
+// roundTrip writes a command and reads its reply.
+func (c *redisConn) roundTrip(args []string) (interface{}, error) {
+	if err := writeCommand(c.w, args...); err != nil {
+		return nil, err
+	}
+	return readReply(c.r)
+}
+
+// conn takes an idle connection from the pool, or opens a new one.
+func (s *Redis) conn(ctx context.Context) (*redisConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, s.options.DialTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, "tcp", s.options.Addr)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, s.unreachable(err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if s.options.Password != "" {
+		if _, err := s.exchange(ctx, c, "AUTH", s.options.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.options.DB != 0 {
+		if _, err := s.exchange(ctx, c, "SELECT", strconv.Itoa(s.options.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// release returns a connection to the pool, or closes it if it failed or the pool is full.
+func (s *Redis) release(c *redisConn, err error) {
+	if c.broken || isNetworkError(err) || s.closed.Load() {
+		c.conn.Close()
+		return
+	}
+	select {
+	case s.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// unreachableError is a failure to reach the server, as opposed to an error reply from it.
+type unreachableError struct {
+	err error
+}
+
+// Error describes the failure.
+func (e *unreachableError) Error() string {
+	return "redis unreachable: " + e.err.Error()
+}
+
+// Unwrap returns the underlying failure.
+func (e *unreachableError) Unwrap() error {
+	return e.err
+}
+
+// unreachable records a failure to reach the server, logging the first of a run of failures.
+func (s *Redis) unreachable(err error) error {
+	if !s.failing.Swap(true) {
+		log.Printf("Shared state at %s is unreachable: %v", s.options.Addr, err)
+	}
+	return &unreachableError{err: err}
+}
+
+// reachable records a successful exchange with the server, logging recovery after failures.
+func (s *Redis) reachable() {
+	if s.failing.Swap(false) {
+		log.Printf("Shared state at %s is reachable again", s.options.Addr)
+	}
+}
+
+// isNetworkError reports whether err is a failure to reach the server.
+func isNetworkError(err error) bool {
+	var unreachable *unreachableError
+	return errors.As(err, &unreachable)
+}
+
+// fallback applies the policy to an error. It reports true with no error if the store should
+// carry on as though it were empty, and otherwise returns the error to report.
+func (s *Redis) fallback(err error) (bool, error) {
+	if !isNetworkError(err) {
+		return false, err
+	}
+	if s.options.Policy == FailOpen {
+		return true, nil
+	}
+	return false, &npc.Error{Kind: npc.ErrUnavailable, Message: "shared state is unavailable", Err: err}
+}
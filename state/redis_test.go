@@ -0,0 +1,429 @@
+package state
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server, implementing the commands Redis uses.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	hang     atomic.Bool  // Stop answering commands, to test timeouts
+	accepted atomic.Int32 // Connections accepted
+
+	mu       sync.Mutex
+	values   map[string]fakeValue
+	versions map[string]int // Bumped on every change, for WATCH
+}
+
+// fakeValue is a value held by fakeRedis.
+type fakeValue struct {
+	value   string
+	expires time.Time
+}
+
+// fakeSession is the state of one client connection.
+type fakeSession struct {
+	authed  bool
+	watched map[string]int
+	queued  [][]string
+	multi   bool
+}
+
+// newFakeRedis starts a fakeRedis that is stopped when the test ends.
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	f := &fakeRedis{listener: listener, password: password, values: make(map[string]fakeValue), versions: make(map[string]int)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.accepted.Add(1)
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// addr returns the address the server listens on.
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+// serve answers the commands sent on a connection.
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	session := &fakeSession{authed: f.password == "", watched: make(map[string]int)}
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			b, _ := item.([]byte)
+			args[i] = string(b)
+		}
+		if f.hang.Load() {
+			continue
+		}
+		if _, err := conn.Write([]byte(f.handle(session, args))); err != nil {
+			return
+		}
+	}
+}
+
+// handle runs a command for a connection and returns the encoded reply.
+func (f *fakeRedis) handle(session *fakeSession, args []string) string {
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+	name := strings.ToUpper(args[0])
+	switch {
+	case name == "AUTH":
+		if len(args) != 2 || args[1] != f.password {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		session.authed = true
+		return "+OK\r\n"
+	case !session.authed:
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch name {
+	case "MULTI":
+		session.multi = true
+		return "+OK\r\n"
+	case "EXEC":
+		session.multi = false
+		queued := session.queued
+		session.queued = nil
+		watched := session.watched
+		session.watched = make(map[string]int)
+		for key, version := range watched {
+			if f.versions[key] != version {
+				return "*-1\r\n"
+			}
+		}
+		replies := fmt.Sprintf("*%d\r\n", len(queued))
+		for _, command := range queued {
+			replies += f.run(command)
+		}
+		return replies
+	case "DISCARD":
+		session.multi = false
+		session.queued = nil
+		return "+OK\r\n"
+	case "WATCH":
+		for _, key := range args[1:] {
+			f.expire(key)
+			session.watched[key] = f.versions[key]
+		}
+		return "+OK\r\n"
+	case "UNWATCH":
+		session.watched = make(map[string]int)
+		return "+OK\r\n"
+	}
+	if session.multi {
+		session.queued = append(session.queued, args)
+		return "+QUEUED\r\n"
+	}
+	return f.run(args)
+}
+
+// run executes a data command. The caller must hold f.mu.
+func (f *fakeRedis) run(args []string) string {
+	name := strings.ToUpper(args[0])
+	if len(args) > 1 {
+		f.expire(args[1])
+	}
+	switch name {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v.value)
+	case "SET":
+		key, value := args[1], fakeValue{value: args[2]}
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if _, ok := f.values[key]; ok {
+					return "$-1\r\n"
+				}
+			case "PX":
+				i++
+				ms, _ := strconv.Atoi(args[i])
+				value.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+		}
+		f.values[key] = value
+		f.versions[key]++
+		return "+OK\r\n"
+	case "DEL":
+		if _, ok := f.values[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		delete(f.values, args[1])
+		f.versions[args[1]]++
+		return ":1\r\n"
+	case "INCRBY":
+		v := f.values[args[1]]
+		count, err := strconv.ParseInt(v.value, 10, 64)
+		if v.value != "" && err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		delta, _ := strconv.ParseInt(args[2], 10, 64)
+		v.value = strconv.FormatInt(count+delta, 10)
+		f.values[args[1]] = v
+		f.versions[args[1]]++
+		return ":" + v.value + "\r\n"
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+// expire removes a key whose time has passed. The caller must hold f.mu.
+func (f *fakeRedis) expire(key string) {
+	if v, ok := f.values[key]; ok && !v.expires.IsZero() && !time.Now().Before(v.expires) {
+		delete(f.values, key)
+		f.versions[key]++
+	}
+}
+
+// ttl returns how long a key has left to live, or zero if it does not expire.
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if v := f.values[key]; !v.expires.IsZero() {
+		return time.Until(v.expires)
+	}
+	return 0
+}
+
+// bulk encodes a bulk string reply.
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// TestRedis tests the basic operations against the fake server.
+func TestRedis(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	store := NewRedis(RedisOptions{Addr: server.addr(), Password: "secret", DB: 1})
+	defer store.Close()
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "greeting", []byte("hello"), 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if value, ok, err := store.Get(ctx, "greeting"); err != nil || !ok || string(value) != "hello" {
+		t.Errorf("Expected hello, got %q %v %v", value, ok, err)
+	}
+	if _, ok, _ := store.Get(ctx, "missing"); ok {
+		t.Error("Expected a missing key not to be found")
+	}
+
+	if ok, _ := store.SetNX(ctx, "greeting", []byte("bye"), 0); ok {
+		t.Error("Expected SetNX not to replace an existing key")
+	}
+	if ok, _ := store.SetNX(ctx, "new", []byte("value"), time.Minute); !ok {
+		t.Error("Expected SetNX to set a missing key")
+	}
+	if ttl := server.ttl("new"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected new to expire within a minute, got %s", ttl)
+	}
+
+	for i, want := range []int64{2, 5} {
+		count, err := store.IncrBy(ctx, "counter", []int64{2, 3}[i], time.Minute)
+		if err != nil || count != want {
+			t.Errorf("Expected counter %d, got %d %v", want, count, err)
+		}
+	}
+	if ttl := server.ttl("counter"); ttl <= 0 {
+		t.Error("Expected the counter to expire")
+	}
+	if _, err := store.IncrBy(ctx, "greeting", 1, 0); err == nil || errors.Is(err, npc.ErrUnavailable) {
+		t.Errorf("Expected the server's error for a non-counter, got %v", err)
+	}
+
+	if err := store.Delete(ctx, "greeting"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, ok, _ := store.Get(ctx, "greeting"); ok {
+		t.Error("Expected greeting to be deleted")
+	}
+
+	if n := server.accepted.Load(); n != 1 {
+		t.Errorf("Expected one pooled connection to be reused, got %d connections", n)
+	}
+	if err := NewRedis(RedisOptions{Addr: server.addr(), Password: "wrong"}).Ping(ctx); err == nil {
+		t.Error("Expected a wrong password to be refused")
+	}
+}
+
+// TestRedisUpdate tests that updates are retried when the key changes before they commit.
+func TestRedisUpdate(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedis(RedisOptions{Addr: server.addr()})
+	other := NewRedis(RedisOptions{Addr: server.addr()})
+	ctx := context.Background()
+
+	calls := 0
+	err := store.Update(ctx, "list", time.Minute, func(value []byte, ok bool) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			// Another replica writes after the value was read
+			if err := other.Set(ctx, "list", []byte("a"), 0); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+		}
+		return append(value, 'b'), nil
+	})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the update to be retried once, got %d calls", calls)
+	}
+	if value, _, _ := store.Get(ctx, "list"); string(value) != "ab" {
+		t.Errorf("Expected ab, got %q", value)
+	}
+
+	failed := errors.New("failed")
+	if err := store.Update(ctx, "list", 0, func([]byte, bool) ([]byte, error) { return nil, failed }); err != failed {
+		t.Errorf("Expected the update's error, got %v", err)
+	}
+	if value, _, _ := store.Get(ctx, "list"); string(value) != "ab" {
+		t.Errorf("Expected a failed update to leave ab, got %q", value)
+	}
+}
+
+// TestRedisUnreachable tests the fail-closed and fail-open policies.
+func TestRedisUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	ctx := context.Background()
+
+	closed := NewRedis(RedisOptions{Addr: addr})
+	if _, _, err := closed.Get(ctx, "key"); !errors.Is(err, npc.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable failing closed, got %v", err)
+	}
+	if err := closed.Update(ctx, "key", 0, func([]byte, bool) ([]byte, error) { return nil, nil }); !errors.Is(err, npc.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable from Update failing closed, got %v", err)
+	}
+
+	open := NewRedis(RedisOptions{Addr: addr, Policy: FailOpen})
+	if _, ok, err := open.Get(ctx, "key"); ok || err != nil {
+		t.Errorf("Expected nothing to be found failing open, got %v %v", ok, err)
+	}
+	if ok, err := open.SetNX(ctx, "key", nil, 0); !ok || err != nil {
+		t.Errorf("Expected SetNX to succeed failing open, got %v %v", ok, err)
+	}
+	updated := false
+	err = open.Update(ctx, "key", 0, func(value []byte, ok bool) ([]byte, error) {
+		updated = !ok
+		return nil, nil
+	})
+	if err != nil || !updated {
+		t.Errorf("Expected Update to run on an empty value failing open, got %v %v", updated, err)
+	}
+	if err := open.Ping(ctx); err == nil {
+		t.Error("Expected Ping to report the server is unreachable whatever the policy")
+	}
+}
+
+// TestRedisTimeout tests that a server that stops answering does not hold up requests.
+func TestRedisTimeout(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedis(RedisOptions{Addr: server.addr(), Timeout: 50 * time.Millisecond})
+	ctx := context.Background()
+	if err := store.Ping(ctx); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	server.hang.Store(true)
+	start := time.Now()
+	if _, _, err := store.Get(ctx, "key"); !errors.Is(err, npc.ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable after a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the command to time out quickly, took %s", elapsed)
+	}
+
+	// The timed out connection is not reused
+	server.hang.Store(false)
+	if err := store.Ping(ctx); err != nil {
+		t.Errorf("Expected a new connection to work, got %v", err)
+	}
+	if n := server.accepted.Load(); n != 2 {
+		t.Errorf("Expected a second connection, got %d", n)
+	}
+}
+
+// TestRedisContextDone tests that a request whose context ends gets the context's error, rather
+// than the server being taken to be unreachable.
+func TestRedisContextDone(t *testing.T) {
+	server := newFakeRedis(t, "")
+	store := NewRedis(RedisOptions{Addr: server.addr(), Policy: FailOpen})
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := store.Get(canceled, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled failing open, got %v", err)
+	}
+	if _, err := store.IncrBy(canceled, "counter", 1, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from IncrBy, got %v", err)
+	}
+
+	server.hang.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := store.Get(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if store.failing.Load() {
+		t.Error("Expected the server not to be taken to be unreachable")
+	}
+
+	// The connection left waiting for a reply is not reused
+	server.hang.Store(false)
+	if err := store.Ping(context.Background()); err != nil {
+		t.Errorf("Expected a new connection to work, got %v", err)
+	}
+	if n := server.accepted.Load(); n != 2 {
+		t.Errorf("Expected a second connection, got %d", n)
+	}
+}
@@ -0,0 +1,220 @@
+// Package state keeps state that several npc2 replicas must share, such as rate limit counts,
+// sessions and idempotency keys, behind a small key-value and counter interface.
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// maxUpdateAttempts is how many times Update retries after another writer changes its key.
+const maxUpdateAttempts = 10
+
+// ErrConflict is returned by Update when the key kept changing under it.
+var ErrConflict = errors.New("state: too many concurrent updates")
+
+// Store is a key-value store with expiring keys and counters. A ttl of zero means the key
+// does not expire.
+type Store interface {
+	// Get returns the value of a key, reporting false if it is not set.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set sets the value of a key.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetNX sets the value of a key only if it is not already set, reporting whether it was.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete removes a key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// IncrBy adds delta to the counter at key, returning its new value. A missing counter
+	// starts at zero and expires after ttl.
+	IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Update replaces the value of a key with the result of update, which is passed the current
+	// value. If another writer changes the key meanwhile, update is called again with the new
+	// value, so it must not have side effects.
+	Update(ctx context.Context, key string, ttl time.Duration, update func(value []byte, ok bool) ([]byte, error)) error
+}
+
+// Memory is a Store held in memory. It is not shared between processes, so suits a single
+// replica and tests.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	writes  int
+}
+
+// memoryEntry is a value held by Memory.
+type memoryEntry struct {
+	value   []byte
+	expires time.Time // Zero if the entry does not expire
+}
+
+// pruneEvery is how many writes Memory makes between removing expired entries.
+const pruneEvery = 1000
+
+// NewMemory creates an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{entries: make(map[string]memoryEntry)}
+}
+
+// Get returns a copy of the value of a key.
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.get(key, time.Now())
+	return value, ok, nil
+}
+
+// Set sets the value of a key.
+func (m *Memory) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.set(key, value, ttl, time.Now())
+	return nil
+}
+
+// SetNX sets the value of a key if it is not already set.
+func (m *Memory) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := m.get(key, now); ok {
+		return false, nil
+	}
+	m.set(key, value, ttl, now)
+	return true, nil
+}
+
+// Delete removes a key.
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+// IncrBy adds delta to a counter.
+func (m *Memory) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	value, ok := m.get(key, now)
+	if !ok {
+		m.set(key, []byte(strconv.FormatInt(delta, 10)), ttl, now)
+		return delta, nil
+	}
+	count, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, errors.New("state: value is not a counter")
+	}
+	count += delta
+	entry := m.entries[key]
+	entry.value = []byte(strconv.FormatInt(count, 10))
+	m.entries[key] = entry
+	return count, nil
+}
+
+// Update replaces the value of a key. Memory holds its lock throughout, so update is called once.
+func (m *Memory) Update(ctx context.Context, key string, ttl time.Duration, update func(value []byte, ok bool) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	value, ok := m.get(key, now)
+	value, err := update(value, ok)
+	if err != nil {
+		return err
+	}
+	m.set(key, value, ttl, now)
+	return nil
+}
+
+// get returns a copy of the value of a live key. The caller must hold m.mu.
+func (m *Memory) get(key string, now time.Time) ([]byte, bool) {
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !entry.expires.IsZero() && !now.Before(entry.expires) {
+		delete(m.entries, key)
+		return nil, false
+	}
+	return append([]byte(nil), entry.value...), true
+}
+
+// set stores a copy of a value, now and then removing expired entries. The caller must hold m.mu.
+func (m *Memory) set(key string, value []byte, ttl time.Duration, now time.Time) {
+	if m.writes++; m.writes%pruneEvery == 0 {
+		for k, entry := range m.entries {
+			if !entry.expires.IsZero() && !now.Before(entry.expires) {
+				delete(m.entries, k)
+			}
+		}
+	}
+	entry := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+	m.entries[key] = entry
+}
+
+// SessionStore keeps sessions in a Store, so every replica sees the same conversations.
+// Sessions are stored as JSON under "session:" followed by their key, and expire with them.
+type SessionStore struct {
+	Store Store
+}
+
+// NewSessionStore creates a SessionStore keeping sessions in store.
+func NewSessionStore(store Store) *SessionStore {
+	return &SessionStore{Store: store}
+}
+
+// Load returns the session with the given key, or nil if there is none or it has expired.
+func (s *SessionStore) Load(ctx context.Context, key npc.SessionKey) (*npc.Session, error) {
+	data, ok, err := s.Store.Get(ctx, sessionKey(key))
+	if err != nil || !ok {
+		return nil, err
+	}
+	var session npc.Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	if session.Expired(time.Now()) {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// Save stores a session until it expires.
+func (s *SessionStore) Save(ctx context.Context, session *npc.Session) error {
+	var ttl time.Duration
+	if !session.Expires.IsZero() {
+		if ttl = time.Until(session.Expires); ttl <= 0 {
+			return s.Delete(ctx, session.Key)
+		}
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return s.Store.Set(ctx, sessionKey(session.Key), data, ttl)
+}
+
+// Delete removes a session.
+func (s *SessionStore) Delete(ctx context.Context, key npc.SessionKey) error {
+	return s.Store.Delete(ctx, sessionKey(key))
+}
+
+// sessionKey returns the key a session is stored under.
+func sessionKey(key npc.SessionKey) string {
+	return "session:" + key.String()
+}
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dyluth/npc2/npc"
+)
+
+// TestMemory tests the in-memory store, including expiry.
+func TestMemory(t *testing.T) {
+	store := NewMemory()
+	ctx := context.Background()
+
+	store.Set(ctx, "short", []byte("lived"), 10*time.Millisecond)
+	if ok, _ := store.SetNX(ctx, "short", []byte("again"), 0); ok {
+		t.Error("Expected SetNX not to replace a live key")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok, _ := store.Get(ctx, "short"); ok {
+		t.Error("Expected the key to have expired")
+	}
+
+	if count, _ := store.IncrBy(ctx, "counter", 2, time.Minute); count != 2 {
+		t.Errorf("Expected 2, got %d", count)
+	}
+	if count, _ := store.IncrBy(ctx, "counter", -1, time.Minute); count != 1 {
+		t.Errorf("Expected 1, got %d", count)
+	}
+
+	store.Update(ctx, "counter", 0, func(value []byte, ok bool) ([]byte, error) {
+		return append(value, '0'), nil
+	})
+	if value, _, _ := store.Get(ctx, "counter"); string(value) != "10" {
+		t.Errorf("Expected 10, got %q", value)
+	}
+}
+
+// TestSessionStore tests that sessions kept in a Store are shared by every SessionStore using it.
+func TestSessionStore(t *testing.T) {
+	shared := NewMemory()
+	first, second := NewSessionStore(shared), NewSessionStore(shared)
+	ctx := context.Background()
+
+	key := npc.SessionKey{Source: "Slack", ChannelID: "C1", User: "U1"}
+	session := npc.NewSession(key)
+	session.Set("env", "prod")
+	session.Expires = time.Now().Add(time.Minute)
+	if err := first.Save(ctx, session); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := second.Load(ctx, key)
+	if err != nil || loaded == nil || loaded.Get("env") != "prod" {
+		t.Fatalf("Expected the session from the other store, got %+v %v", loaded, err)
+	}
+
+	second.Delete(ctx, key)
+	if loaded, _ := first.Load(ctx, key); loaded != nil {
+		t.Errorf("Expected the session to be deleted, got %+v", loaded)
+	}
+}